@@ -0,0 +1,405 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrMisaligned is returned when the sender domain of a batch fails the checks
+// of the worker's AlignmentChecker and EnforceAlignment is set.
+var ErrMisaligned = errors.New("sender domain isn't aligned")
+
+// DefaultAlignmentCacheTTL is how long an AlignmentChecker caches the status
+// of a domain if its CacheTTL isn't set.
+var DefaultAlignmentCacheTTL = 10 * time.Minute
+
+// maxSPFLookups is the number of DNS lookups an SPF check may make, as set
+// by RFC 7208 section 4.6.4.
+const maxSPFLookups = 10
+
+// SenderDomainer is implemented by Mail instances which can report the domain
+// they are sent from before being generated, so that the worker's
+// AlignmentChecker can check it. Mail instances which don't implement it
+// aren't checked.
+type SenderDomainer interface {
+	SenderDomain() string
+}
+
+// Resolver performs the DNS lookups of an AlignmentChecker. It is
+// implemented by *net.Resolver.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// AlignmentChecker checks that the DNS records of a sender domain are set up
+// for the mail sent from it to be delivered: that its SPF record authorizes
+// the addresses mail is sent from, that the keys of its DKIM selectors are
+// published and that it has a DMARC policy. The zero value only checks for a
+// DMARC policy.
+//
+// SPF records are evaluated for the ip4, ip6, a, mx and include mechanisms
+// and the redirect modifier. Terms using macros and the exists and ptr
+// mechanisms never match, so records relying on them are reported as not
+// authorizing the addresses.
+type AlignmentChecker struct {
+	// SendingIPs are the addresses mail is sent from, which the SPF record
+	// must authorize. SPF isn't checked if there are none.
+	SendingIPs []net.IP
+	// DKIMSelectors are the selectors mail is signed with, whose keys must
+	// be published under the domain.
+	DKIMSelectors []string
+	// SkipDMARC disables checking that the domain publishes a DMARC
+	// policy.
+	SkipDMARC bool
+	// Resolver performs the DNS lookups. It defaults to
+	// net.DefaultResolver.
+	Resolver Resolver
+	// CacheTTL is how long the status of a domain is cached for. It
+	// defaults to DefaultAlignmentCacheTTL. The TTLs of the records
+	// themselves aren't available through Resolver.
+	CacheTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedAlignment
+}
+
+// cachedAlignment is the status of a domain cached by an AlignmentChecker.
+type cachedAlignment struct {
+	status  AlignmentStatus
+	expires time.Time
+}
+
+// AlignmentStatus is the outcome of an AlignmentChecker's checks for a domain.
+type AlignmentStatus struct {
+	Domain string
+	// SPF, DKIM and DMARC report whether each check passed. Checks which
+	// aren't configured pass.
+	SPF   bool
+	DKIM  bool
+	DMARC bool
+	// Problems describes every failed check.
+	Problems []string
+}
+
+// Aligned reports whether every check passed.
+func (s AlignmentStatus) Aligned() bool {
+	return len(s.Problems) == 0
+}
+
+// Err returns an error wrapping ErrMisaligned and describing the problems
+// found, or nil if every check passed.
+func (s AlignmentStatus) Err() error {
+	if s.Aligned() {
+		return nil
+	}
+	return fmt.Errorf("%w: %s: %s", ErrMisaligned, s.Domain, strings.Join(s.Problems, "; "))
+}
+
+// Check runs the checks for the domain, returning the cached status if the
+// domain was checked less than CacheTTL ago. An error is returned, and nothing
+// is cached, if a lookup failed temporarily. Records which don't exist are
+// reported as Problems instead.
+func (ac *AlignmentChecker) Check(ctx context.Context, domain string) (AlignmentStatus, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	ac.mu.Lock()
+	cached, ok := ac.cache[domain]
+	ac.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.status, nil
+	}
+
+	status := AlignmentStatus{Domain: domain, SPF: true, DKIM: true, DMARC: true}
+	for _, ip := range ac.SendingIPs {
+		lookups := 0
+		pass, err := ac.checkSPF(ctx, domain, ip, &lookups)
+		if err != nil {
+			return AlignmentStatus{}, err
+		}
+		if !pass {
+			status.SPF = false
+			status.Problems = append(status.Problems, fmt.Sprintf("SPF record doesn't authorize %s", ip))
+		}
+	}
+	for _, selector := range ac.DKIMSelectors {
+		found, err := ac.findRecord(ctx, selector+"._domainkey."+domain, isDKIMKey)
+		if err != nil {
+			return AlignmentStatus{}, err
+		}
+		if !found {
+			status.DKIM = false
+			status.Problems = append(status.Problems, fmt.Sprintf("no DKIM key published for selector %q", selector))
+		}
+	}
+	if !ac.SkipDMARC {
+		found, err := ac.findRecord(ctx, "_dmarc."+domain, isDMARCRecord)
+		if err != nil {
+			return AlignmentStatus{}, err
+		}
+		if !found {
+			status.DMARC = false
+			status.Problems = append(status.Problems, "no DMARC policy published")
+		}
+	}
+
+	ttl := ac.CacheTTL
+	if ttl <= 0 {
+		ttl = DefaultAlignmentCacheTTL
+	}
+	ac.mu.Lock()
+	if ac.cache == nil {
+		ac.cache = make(map[string]cachedAlignment)
+	}
+	ac.cache[domain] = cachedAlignment{status: status, expires: time.Now().Add(ttl)}
+	ac.mu.Unlock()
+	return status, nil
+}
+
+// resolver returns the checker's Resolver.
+func (ac *AlignmentChecker) resolver() Resolver {
+	if ac.Resolver != nil {
+		return ac.Resolver
+	}
+	return net.DefaultResolver
+}
+
+// lookupTXT returns the TXT records of name, which are empty if it doesn't
+// exist. Only temporary failures are returned as errors.
+func (ac *AlignmentChecker) lookupTXT(ctx context.Context, name string) ([]string, error) {
+	records, err := ac.resolver().LookupTXT(ctx, name)
+	if isTemporaryDNSError(err) {
+		return nil, err
+	}
+	return records, nil
+}
+
+// findRecord reports whether one of the TXT records of name matches.
+func (ac *AlignmentChecker) findRecord(ctx context.Context, name string, match func(string) bool) (bool, error) {
+	records, err := ac.lookupTXT(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	for _, r := range records {
+		if match(r) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// isTemporaryDNSError reports whether the lookup failed for a reason other
+// than the name or record not existing.
+func isTemporaryDNSError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTemporary || dnsErr.IsTimeout
+	}
+	return true
+}
+
+// isDKIMKey reports whether the TXT record is a DKIM key which hasn't been
+// revoked.
+func isDKIMKey(record string) bool {
+	for _, tag := range strings.Split(record, ";") {
+		tag = strings.TrimSpace(tag)
+		if strings.HasPrefix(tag, "p=") {
+			return strings.TrimSpace(tag[len("p="):]) != ""
+		}
+	}
+	return false
+}
+
+// isDMARCRecord reports whether the TXT record is a DMARC policy.
+func isDMARCRecord(record string) bool {
+	return strings.HasPrefix(strings.ToLower(record), "v=dmarc1")
+}
+
+// checkSPF reports whether the SPF record of the domain passes mail sent from
+// the address, counting the DNS lookups made against maxSPFLookups.
+func (ac *AlignmentChecker) checkSPF(ctx context.Context, domain string, ip net.IP, lookups *int) (bool, error) {
+	records, err := ac.lookupTXT(ctx, domain)
+	if err != nil {
+		return false, err
+	}
+	var record string
+	for _, r := range records {
+		if lr := strings.ToLower(r); lr == "v=spf1" || strings.HasPrefix(lr, "v=spf1 ") {
+			// Domains with more than one SPF record fail the check.
+			if record != "" {
+				return false, nil
+			}
+			record = r
+		}
+	}
+	if record == "" {
+		return false, nil
+	}
+	redirect := ""
+	for _, term := range strings.Fields(record)[1:] {
+		if strings.Contains(term, "%") {
+			continue
+		}
+		if i := strings.Index(term, "="); i >= 0 && !strings.ContainsAny(term[:i], ":/") {
+			if strings.EqualFold(term[:i], "redirect") {
+				redirect = term[i+1:]
+			}
+			continue
+		}
+		qualifier := byte('+')
+		if strings.IndexByte("+-~?", term[0]) >= 0 {
+			qualifier, term = term[0], term[1:]
+		}
+		match, err := ac.matchSPF(ctx, domain, term, ip, lookups)
+		if err != nil {
+			return false, err
+		}
+		if match {
+			return qualifier == '+', nil
+		}
+	}
+	if redirect != "" {
+		*lookups++
+		if *lookups > maxSPFLookups {
+			return false, nil
+		}
+		return ac.checkSPF(ctx, strings.ToLower(redirect), ip, lookups)
+	}
+	return false, nil
+}
+
+// matchSPF reports whether the SPF mechanism matches the address.
+func (ac *AlignmentChecker) matchSPF(ctx context.Context, domain, mechanism string, ip net.IP, lookups *int) (bool, error) {
+	name, arg := mechanism, ""
+	if i := strings.IndexAny(mechanism, ":/"); i >= 0 {
+		name, arg = mechanism[:i], mechanism[i:]
+	}
+	switch strings.ToLower(name) {
+	case "all":
+		return true, nil
+	case "ip4", "ip6":
+		arg = strings.TrimPrefix(arg, ":")
+		if !strings.Contains(arg, "/") {
+			return ip.Equal(net.ParseIP(arg)), nil
+		}
+		_, network, err := net.ParseCIDR(arg)
+		return err == nil && network.Contains(ip), nil
+	case "include":
+		*lookups++
+		if *lookups > maxSPFLookups || !strings.HasPrefix(arg, ":") {
+			return false, nil
+		}
+		return ac.checkSPF(ctx, strings.ToLower(arg[1:]), ip, lookups)
+	case "a", "mx":
+		*lookups++
+		if *lookups > maxSPFLookups {
+			return false, nil
+		}
+		target, ones4, ones6 := parseSPFTarget(domain, arg)
+		hosts := []string{target}
+		if strings.EqualFold(name, "mx") {
+			mxs, err := ac.resolver().LookupMX(ctx, target)
+			if isTemporaryDNSError(err) {
+				return false, err
+			}
+			hosts = hosts[:0]
+			for _, mx := range mxs {
+				hosts = append(hosts, mx.Host)
+			}
+		}
+		for _, host := range hosts {
+			addrs, err := ac.resolver().LookupIPAddr(ctx, host)
+			if isTemporaryDNSError(err) {
+				return false, err
+			}
+			for _, addr := range addrs {
+				if (addr.IP.To4() == nil) != (ip.To4() == nil) {
+					continue
+				}
+				ones, bits := ones4, 32
+				if addr.IP.To4() == nil {
+					ones, bits = ones6, 128
+				}
+				if addr.IP.Mask(net.CIDRMask(ones, bits)).Equal(ip.Mask(net.CIDRMask(ones, bits))) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	case "exists", "ptr":
+		*lookups++
+		return false, nil
+	default:
+		return false, nil
+	}
+}
+
+// parseSPFTarget parses the argument of an a or mx mechanism, made of an
+// optional ":domain" followed by optional "/ip4-cidr" and "//ip6-cidr" prefix
+// lengths.
+func parseSPFTarget(domain, arg string) (string, int, int) {
+	target := domain
+	if strings.HasPrefix(arg, ":") {
+		arg = arg[1:]
+		i := strings.Index(arg, "/")
+		if i < 0 {
+			i = len(arg)
+		}
+		target, arg = strings.ToLower(arg[:i]), arg[i:]
+	}
+	ones4, ones6 := 32, 128
+	if i := strings.Index(arg, "//"); i >= 0 {
+		if n, err := strconv.Atoi(arg[i+2:]); err == nil && n >= 0 && n <= 128 {
+			ones6 = n
+		}
+		arg = arg[:i]
+	}
+	if strings.HasPrefix(arg, "/") {
+		if n, err := strconv.Atoi(arg[1:]); err == nil && n >= 0 && n <= 32 {
+			ones4 = n
+		}
+	}
+	return target, ones4, ones6
+}
+
+// checkAlignment runs the worker's AlignmentChecker for the sender domains of
+// the Mail instances, logging the problems found. If EnforceAlignment is set,
+// the first problem or lookup failure is returned as an error.
+func (mw *MailWorker) checkAlignment(ctx context.Context, ams []Mail) error {
+	if mw.AlignmentChecker == nil {
+		return nil
+	}
+	checked := make(map[string]bool)
+	for _, m := range ams {
+		sd, ok := m.(SenderDomainer)
+		if !ok {
+			continue
+		}
+		domain := strings.ToLower(sd.SenderDomain())
+		if domain == "" || checked[domain] {
+			continue
+		}
+		checked[domain] = true
+		status, err := mw.AlignmentChecker.Check(ctx, domain)
+		if err == nil {
+			err = status.Err()
+		}
+		if err == nil {
+			continue
+		}
+		if mw.EnforceAlignment {
+			return err
+		}
+		Logger.Printf("WARNING: alignment check of %s failed: %s\n", domain, err)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"reflect"
+)
+
+// fakeResolver is a Resolver answering from maps, counting the lookups made.
+type fakeResolver struct {
+	txt     map[string][]string
+	addrs   map[string][]string
+	mx      map[string][]string
+	err     error
+	lookups int
+}
+
+func (r *fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	r.lookups++
+	if r.err != nil {
+		return nil, r.err
+	}
+	if records, ok := r.txt[name]; ok {
+		return records, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.lookups++
+	var addrs []net.IPAddr
+	for _, a := range r.addrs[host] {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(a)})
+	}
+	return addrs, nil
+}
+
+func (r *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	r.lookups++
+	var mxs []*net.MX
+	for _, host := range r.mx[name] {
+		mxs = append(mxs, &net.MX{Host: host})
+	}
+	return mxs, nil
+}
+
+// senderDomainMessage is a mockMessage sent from a domain.
+type senderDomainMessage struct {
+	*mockMessage
+	domain string
+}
+
+func (sm *senderDomainMessage) SenderDomain() string { return sm.domain }
+
+func newAlignmentResolver() *fakeResolver {
+	return &fakeResolver{
+		txt: map[string][]string{
+			"example.com":                    {"google-site-verification=abc", "v=spf1 ip4:192.0.2.0/24 include:_spf.example.net a:relay.example.com mx -all"},
+			"_spf.example.net":               {"v=spf1 ip6:2001:db8::/32 ~all"},
+			"mail._domainkey.example.com":    {"v=DKIM1; k=rsa; p=MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQC"},
+			"revoked._domainkey.example.com": {"v=DKIM1; p="},
+			"_dmarc.example.com":             {"v=DMARC1; p=reject"},
+		},
+		addrs: map[string][]string{
+			"relay.example.com": {"198.51.100.7", "2001:db9::7"},
+			"mx.example.com":    {"203.0.113.25"},
+		},
+		mx: map[string][]string{
+			"example.com": {"mx.example.com"},
+		},
+	}
+}
+
+func (ms *MailerSuite) TestAlignmentChecker() {
+	resolver := newAlignmentResolver()
+	ac := &AlignmentChecker{
+		SendingIPs:    []net.IP{net.ParseIP("192.0.2.10"), net.ParseIP("2001:db8::1"), net.ParseIP("198.51.100.7"), net.ParseIP("203.0.113.25")},
+		DKIMSelectors: []string{"mail"},
+		Resolver:      resolver,
+	}
+	status, err := ac.Check(context.Background(), "Example.com.")
+	if err != nil {
+		ms.T().Fatalf("Unexpected error when checking: %s", err)
+	}
+	if !status.Aligned() || !status.SPF || !status.DKIM || !status.DMARC || status.Err() != nil {
+		ms.T().Fatalf("Unexpected status. Expected an aligned domain, Got %+v", status)
+	}
+
+	// The status is cached
+	lookups := resolver.lookups
+	if _, err := ac.Check(context.Background(), "example.com"); err != nil || resolver.lookups != lookups {
+		ms.T().Fatalf("Status wasn't cached. Got %d more lookups (%v)", resolver.lookups-lookups, err)
+	}
+
+	ac = &AlignmentChecker{
+		SendingIPs:    []net.IP{net.ParseIP("192.0.3.1"), net.ParseIP("198.51.100.8")},
+		DKIMSelectors: []string{"revoked", "missing"},
+		Resolver:      resolver,
+	}
+	status, err = ac.Check(context.Background(), "example.com")
+	if err != nil {
+		ms.T().Fatalf("Unexpected error when checking: %s", err)
+	}
+	expected := []string{
+		"SPF record doesn't authorize 192.0.3.1",
+		"SPF record doesn't authorize 198.51.100.8",
+		`no DKIM key published for selector "revoked"`,
+		`no DKIM key published for selector "missing"`,
+	}
+	if status.SPF || status.DKIM || !status.DMARC || !reflect.DeepEqual(status.Problems, expected) {
+		ms.T().Fatalf("Unexpected status. Expected problems %v, Got %+v", expected, status)
+	}
+	if !errors.Is(status.Err(), ErrMisaligned) {
+		ms.T().Fatalf("Unexpected error. Expected %v, Got %v", ErrMisaligned, status.Err())
+	}
+
+	status, err = (&AlignmentChecker{Resolver: resolver}).Check(context.Background(), "example.org")
+	if err != nil || status.DMARC || len(status.Problems) != 1 {
+		ms.T().Fatalf("Unexpected status. Expected a missing DMARC policy, Got %+v (%v)", status, err)
+	}
+
+	// Temporary failures are returned, and not cached
+	resolver.err = &net.DNSError{Err: "server misbehaving", Name: "example.org", IsTemporary: true}
+	ac = &AlignmentChecker{Resolver: resolver}
+	if _, err := ac.Check(context.Background(), "example.org"); err != resolver.err {
+		ms.T().Fatalf("Unexpected error. Expected %v, Got %v", resolver.err, err)
+	}
+	resolver.err = nil
+	if _, err := ac.Check(context.Background(), "example.org"); err != nil {
+		ms.T().Fatalf("Unexpected error when checking again: %s", err)
+	}
+}
+
+func (ms *MailerSuite) TestEnforceAlignment() {
+	mw := NewMailWorker()
+	mw.AlignmentChecker = &AlignmentChecker{
+		SendingIPs: []net.IP{net.ParseIP("192.0.3.1")},
+		Resolver:   newAlignmentResolver(),
+	}
+	ams := []Mail{
+		&senderDomainMessage{mockMessage: newMockMessage("from@example.com", []string{"to@example.com"}, bytes.NewBufferString("Email")), domain: "example.com"},
+	}
+	// Problems are only logged by default
+	if err := mw.approve(context.Background(), ams); err != nil {
+		ms.T().Fatalf("Unexpected error when approving: %s", err)
+	}
+	mw.EnforceAlignment = true
+	if err := mw.approve(context.Background(), ams); !errors.Is(err, ErrMisaligned) {
+		ms.T().Fatalf("Unexpected error. Expected %v, Got %v", ErrMisaligned, err)
+	}
+	// Mail without a sender domain isn't checked
+	ams = []Mail{newMockMessage("from@example.com", []string{"to@example.com"}, bytes.NewBufferString("Email"))}
+	if err := mw.approve(context.Background(), ams); err != nil {
+		ms.T().Fatalf("Unexpected error when approving: %s", err)
+	}
+}
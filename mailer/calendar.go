@@ -0,0 +1,40 @@
+package mailer
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gophish/gomail"
+)
+
+// AddCalendarInvite adds the iCalendar object ics to the message as an
+// alternative to its body, with the text/calendar content type and the method
+// parameter mail clients need to show it as an invite they can reply to
+// rather than as an attachment. Mail instances call it from Generate once
+// the body is set. The method is the iTIP method (RFC 5546) of the object,
+// such as "REQUEST" or "CANCEL", and must match its METHOD property if it has
+// one. The settings are applied to the part as with AddAlternative.
+func AddCalendarInvite(message *gomail.Message, method, ics string, settings ...gomail.PartSetting) error {
+	method = strings.ToUpper(strings.TrimSpace(method))
+	if method == "" || strings.ContainsAny(method, " \t\r\n;\"") {
+		return fmt.Errorf("invalid calendar method %q", method)
+	}
+	if m, ok := calendarMethod(ics); ok && !strings.EqualFold(m, method) {
+		return fmt.Errorf("calendar method %q doesn't match the object's METHOD %q", method, m)
+	}
+	message.AddAlternative("text/calendar; method="+method, ics, settings...)
+	return nil
+}
+
+// calendarMethod returns the value of the METHOD property of the iCalendar
+// object, if it has one.
+func calendarMethod(ics string) (string, bool) {
+	for _, line := range strings.Split(ics, "\n") {
+		line = strings.TrimRight(line, "\r")
+		i := strings.Index(line, ":")
+		if i != -1 && strings.EqualFold(line[:i], "METHOD") {
+			return strings.TrimSpace(line[i+1:]), true
+		}
+	}
+	return "", false
+}
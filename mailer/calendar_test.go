@@ -0,0 +1,33 @@
+package mailer
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/gophish/gomail"
+)
+
+const testInvite = "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nMETHOD:REQUEST\r\nBEGIN:VEVENT\r\nUID:1@example.com\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+
+func (ms *MailerSuite) TestAddCalendarInvite() {
+	message := gomail.NewMessage()
+	message.SetBody("text/plain", "You're invited")
+	if err := AddCalendarInvite(message, "request", testInvite); err != nil {
+		ms.T().Fatalf("Unexpected error when adding the invite: %s", err)
+	}
+	buff := &bytes.Buffer{}
+	message.WriteTo(buff)
+	if !strings.Contains(buff.String(), "Content-Type: text/calendar; method=REQUEST") {
+		ms.T().Fatalf("Invite wasn't added with the calendar content type. Got %s", buff.String())
+	}
+	if !strings.Contains(buff.String(), testInvite) {
+		ms.T().Fatalf("Invite wasn't added intact")
+	}
+
+	if err := AddCalendarInvite(gomail.NewMessage(), "CANCEL", testInvite); err == nil {
+		ms.T().Fatalf("Expected an error for a method not matching the object's")
+	}
+	if err := AddCalendarInvite(gomail.NewMessage(), "REQUEST; charset=x", testInvite); err == nil {
+		ms.T().Fatalf("Expected an error for an invalid method")
+	}
+}
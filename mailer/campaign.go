@@ -0,0 +1,105 @@
+package mailer
+
+import (
+	"context"
+	"sync"
+)
+
+// campaignKey is the context key of the campaign a batch was enqueued for
+// with EnqueueCampaign.
+type campaignKey struct{}
+
+// campaigns tracks the batches of every campaign which haven't been
+// processed yet, along with the summary of those which have. The zero value
+// is ready to use.
+type campaigns struct {
+	mu        sync.Mutex
+	campaigns map[string]*campaign
+}
+
+// campaign is the state of a campaign with outstanding batches.
+type campaign struct {
+	outstanding int
+	summary     BatchSummary
+}
+
+// add records an outstanding batch for the campaign.
+func (cs *campaigns) add(key string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.campaigns == nil {
+		cs.campaigns = make(map[string]*campaign)
+	}
+	c, ok := cs.campaigns[key]
+	if !ok {
+		c = &campaign{}
+		cs.campaigns[key] = c
+	}
+	c.outstanding++
+}
+
+// done records that an outstanding batch of the campaign is done, merging
+// its summary into the campaign's. It returns the campaign's summary and
+// true if that was the last one.
+func (cs *campaigns) done(key string, s BatchSummary) (BatchSummary, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	c, ok := cs.campaigns[key]
+	if !ok {
+		return BatchSummary{}, false
+	}
+	c.summary = c.summary.Merge(s)
+	c.outstanding--
+	if c.outstanding > 0 {
+		return BatchSummary{}, false
+	}
+	delete(cs.campaigns, key)
+	return c.summary, true
+}
+
+// EnqueueCampaign enqueues the batches as with EnqueueContext, grouping them
+// under the campaign identified by key. Once every batch enqueued for the
+// campaign has been processed, OnCampaignComplete is called with the merged
+// summary of all of them. Batches may be added to a campaign with several
+// calls, as long as the campaign isn't complete yet: the call itself keeps
+// the campaign open until all of its batches are enqueued.
+//
+// Every batch is validated before any is enqueued. If the worker is shut
+// down part way through, ErrShutdown is returned and the batches enqueued
+// until then are still sent.
+func (mw *MailWorker) EnqueueCampaign(ctx context.Context, key string, batches ...[]Mail) error {
+	for _, ms := range batches {
+		if err := mw.validate(ms); err != nil {
+			return err
+		}
+	}
+	ctx = context.WithValue(ctx, campaignKey{}, key)
+	if mw.OnCampaignComplete != nil {
+		mw.campaigns.add(key)
+		defer mw.campaignDone(key, BatchSummary{})
+	}
+	for _, ms := range batches {
+		if err := mw.enqueueBatches(batch{ctx: ctx, mails: ms}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// campaignOf returns the campaign the batch was enqueued for, if it is
+// tracked for the OnCampaignComplete hook.
+func (mw *MailWorker) campaignOf(ctx context.Context) (string, bool) {
+	if mw.OnCampaignComplete == nil {
+		return "", false
+	}
+	key, ok := ctx.Value(campaignKey{}).(string)
+	return key, ok
+}
+
+// campaignDone records that one of the campaign's outstanding batches is
+// done with the summary, calling OnCampaignComplete if it was the last one.
+func (mw *MailWorker) campaignDone(key string, s BatchSummary) {
+	if cs, complete := mw.campaigns.done(key, s); complete {
+		mw.OnCampaignComplete(key, cs)
+	}
+}
@@ -0,0 +1,118 @@
+package mailer
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Capabilities are the SMTP service extensions a server advertised in its
+// reply to EHLO, for the Senders implementing ExtensionSender. The zero value
+// is used for other Senders, and reports that nothing is known to be
+// supported.
+type Capabilities struct {
+	extensions map[string]string
+}
+
+// NewCapabilities returns the Capabilities described by the extensions,
+// keyed by extension keyword with their parameters as values, as returned by
+// ExtensionSender.
+func NewCapabilities(extensions map[string]string) Capabilities {
+	c := Capabilities{extensions: make(map[string]string, len(extensions))}
+	for name, params := range extensions {
+		c.extensions[strings.ToUpper(name)] = params
+	}
+	return c
+}
+
+// capabilitiesOf returns the Capabilities of the Sender's connection.
+func capabilitiesOf(sender Sender) Capabilities {
+	if es, ok := sender.(ExtensionSender); ok {
+		return NewCapabilities(es.Extensions())
+	}
+	return Capabilities{}
+}
+
+// Known reports whether the Sender reported the server's extensions at all.
+func (c Capabilities) Known() bool {
+	return c.extensions != nil
+}
+
+// Has reports whether the server advertised the extension.
+func (c Capabilities) Has(name string) bool {
+	_, ok := c.extensions[strings.ToUpper(name)]
+	return ok
+}
+
+// Param returns the parameters the server advertised the extension with,
+// and whether it advertised it.
+func (c Capabilities) Param(name string) (string, bool) {
+	params, ok := c.extensions[strings.ToUpper(name)]
+	return params, ok
+}
+
+// Extensions returns a copy of the extensions the server advertised.
+func (c Capabilities) Extensions() map[string]string {
+	extensions := make(map[string]string, len(c.extensions))
+	for name, params := range c.extensions {
+		extensions[name] = params
+	}
+	return extensions
+}
+
+// MaxSize returns the largest message the server accepts, in bytes, as
+// advertised by the SIZE extension (RFC 1870). ok is false if the server
+// didn't advertise a limit, including when it advertised SIZE without one
+// or with 0.
+func (c Capabilities) MaxSize() (size int64, ok bool) {
+	params, ok := c.Param("SIZE")
+	if !ok {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(params), 10, 64)
+	if err != nil || size <= 0 {
+		return 0, false
+	}
+	return size, true
+}
+
+// SupportsSTARTTLS reports whether the server offered STARTTLS, even if the
+// connection has since been upgraded.
+func (c Capabilities) SupportsSTARTTLS() bool {
+	return c.Has("STARTTLS")
+}
+
+// SupportsPipelining reports whether the server advertised PIPELINING
+// (RFC 2920).
+func (c Capabilities) SupportsPipelining() bool {
+	return c.Has("PIPELINING")
+}
+
+// SupportsChunking reports whether the server advertised CHUNKING
+// (RFC 3030).
+func (c Capabilities) SupportsChunking() bool {
+	return c.Has("CHUNKING")
+}
+
+// SupportsSMTPUTF8 reports whether the server advertised SMTPUTF8
+// (RFC 6531).
+func (c Capabilities) SupportsSMTPUTF8() bool {
+	return c.Has("SMTPUTF8")
+}
+
+// Supports8BitMIME reports whether the server advertised 8BITMIME
+// (RFC 6152).
+func (c Capabilities) Supports8BitMIME() bool {
+	return c.Has("8BITMIME")
+}
+
+// SupportsDSN reports whether the server advertised DSN (RFC 3461).
+func (c Capabilities) SupportsDSN() bool {
+	return c.Has("DSN")
+}
+
+// AuthMechanisms returns the SASL mechanisms the server advertised with the
+// AUTH extension.
+func (c Capabilities) AuthMechanisms() []string {
+	params, _ := c.Param("AUTH")
+	return strings.Fields(params)
+}
@@ -0,0 +1,75 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+)
+
+func (ms *MailerSuite) TestCapabilities() {
+	caps := NewCapabilities(map[string]string{
+		"size":       "1048576",
+		"PIPELINING": "",
+		"AUTH":       "PLAIN LOGIN",
+	})
+	if !caps.Known() || !caps.Has("Size") || caps.Has("CHUNKING") {
+		ms.T().Fatalf("Unexpected extensions: %v", caps.Extensions())
+	}
+	if size, ok := caps.MaxSize(); !ok || size != 1048576 {
+		ms.T().Fatalf("Unexpected max size. Expected %d, Got %d (%t)", 1048576, size, ok)
+	}
+	if !caps.SupportsPipelining() || caps.SupportsSTARTTLS() || caps.SupportsSMTPUTF8() {
+		ms.T().Fatalf("Unexpected supported extensions: %v", caps.Extensions())
+	}
+	if got := caps.AuthMechanisms(); !reflect.DeepEqual(got, []string{"PLAIN", "LOGIN"}) {
+		ms.T().Fatalf("Unexpected auth mechanisms: %v", got)
+	}
+	// SIZE without a limit doesn't cap the message size
+	if _, ok := NewCapabilities(map[string]string{"SIZE": "0"}).MaxSize(); ok {
+		ms.T().Fatalf("Unexpected max size for SIZE 0")
+	}
+	// Nothing is known when the Sender doesn't report its extensions
+	var unknown Capabilities
+	if unknown.Known() || unknown.Has("SIZE") || len(unknown.Extensions()) != 0 {
+		ms.T().Fatalf("Unexpected zero Capabilities: %v", unknown.Extensions())
+	}
+}
+
+func (ms *MailerSuite) TestOnConnectCapabilities() {
+	server := newFakeSMTPServer()
+	defer server.Close()
+	server.extensions = append(server.extensions, "SIZE 35882577", "PIPELINING", "X-CUSTOM")
+
+	var got []Capabilities
+	p := &Processor{}
+	p.OnConnect = func(host string, caps Capabilities) {
+		got = append(got, caps)
+	}
+	d := server.dialer()
+	m := newMockMessage("from@example.com", []string{"to@example.com"}, bytes.NewBufferString("Email"))
+	stats := p.ProcessChunk(context.Background(), d, []Mail{m})
+	if stats.Sent != 1 {
+		ms.T().Fatalf("Unexpected stats: %+v", stats)
+	}
+	if len(got) != 1 {
+		ms.T().Fatalf("Unexpected number of OnConnect calls. Expected %d, Got %d", 1, len(got))
+	}
+	caps := got[0]
+	if size, ok := caps.MaxSize(); !ok || size != 35882577 {
+		ms.T().Fatalf("Unexpected max size. Expected %d, Got %d (%t)", 35882577, size, ok)
+	}
+	if !caps.SupportsPipelining() || caps.SupportsChunking() {
+		ms.T().Fatalf("Unexpected capabilities: %v", caps.Extensions())
+	}
+	if got := caps.AuthMechanisms(); !reflect.DeepEqual(got, []string{"PLAIN", "CRAM-MD5", "XOAUTH2"}) {
+		ms.T().Fatalf("Unexpected auth mechanisms: %v", got)
+	}
+
+	result, err := Probe(context.Background(), d)
+	if err != nil {
+		ms.T().Fatalf("Unexpected error when probing: %s", err)
+	}
+	if !reflect.DeepEqual(result.Capabilities, caps) {
+		ms.T().Fatalf("Unexpected probed capabilities: %v", result.Capabilities.Extensions())
+	}
+}
@@ -0,0 +1,75 @@
+package mailer
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrClientCertRejected is wrapped by the *PermanentError SMTPDialer returns
+// when the server rejects the client certificate it presented.
+var ErrClientCertRejected = errors.New("server rejected the client certificate")
+
+// clientCertAlerts are the TLS alerts servers send when they reject a client
+// certificate, as worded by crypto/tls.
+var clientCertAlerts = []string{
+	"bad certificate",
+	"unsupported certificate",
+	"revoked certificate",
+	"expired certificate",
+	"unknown certificate",
+	"certificate required",
+	"access denied",
+}
+
+// isClientCertRejection returns whether the error is a TLS alert sent by the
+// server because of our client certificate.
+func isClientCertRejection(err error) bool {
+	var oe *net.OpError
+	if !errors.As(err, &oe) || oe.Op != "remote error" {
+		return false
+	}
+	msg := oe.Err.Error()
+	for _, alert := range clientCertAlerts {
+		if strings.Contains(msg, alert) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientCertificateFiles returns a function suitable for SMTPDialer's
+// ClientCertificate which loads a PEM encoded certificate and key pair from
+// the files. The pair is loaded again whenever either file is modified, so
+// that renewed certificates are picked up without restarting the worker. If
+// reloading fails, the error is returned until the files are fixed.
+func ClientCertificateFiles(certFile, keyFile string) func() (*tls.Certificate, error) {
+	var mu sync.Mutex
+	var cert *tls.Certificate
+	var certMod, keyMod time.Time
+	return func() (*tls.Certificate, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		certInfo, err := os.Stat(certFile)
+		if err != nil {
+			return nil, err
+		}
+		keyInfo, err := os.Stat(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		if cert != nil && certInfo.ModTime().Equal(certMod) && keyInfo.ModTime().Equal(keyMod) {
+			return cert, nil
+		}
+		pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cert, certMod, keyMod = &pair, certInfo.ModTime(), keyInfo.ModTime()
+		return cert, nil
+	}
+}
@@ -0,0 +1,41 @@
+package mailer
+
+import (
+	"context"
+	"time"
+)
+
+// Clock provides the timers the worker waits on between chunks, so that tests
+// can control the passage of time.
+type Clock interface {
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the Clock used when the worker has none.
+type realClock struct{}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// clock returns the worker's Clock.
+func (mw *MailWorker) clock() Clock {
+	if mw.Clock != nil {
+		return mw.Clock
+	}
+	return realClock{}
+}
+
+// wait waits for the delay, returning the context's error if it is cancelled
+// first.
+func (mw *MailWorker) wait(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-mw.clock().After(delay):
+		return nil
+	}
+}
@@ -0,0 +1,271 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// fakeClock is a Clock whose timers fire when the test sends on the channel
+// they return.
+type fakeClock struct {
+	timers chan chan time.Time
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	t := make(chan time.Time, 1)
+	c.timers <- t
+	return t
+}
+
+func (ms *MailerSuite) TestChunkDelay() {
+	defer func(size int, delay time.Duration) {
+		MailChunkSize = size
+		MailDelayTime = delay
+	}(MailChunkSize, MailDelayTime)
+	MailChunkSize = 1
+	MailDelayTime = time.Hour
+
+	for _, cancelled := range []bool{false, true} {
+		clock := &fakeClock{timers: make(chan chan time.Time)}
+		mw := NewMailWorker()
+		mw.Clock = clock
+		dialer := newMockDialer()
+		dialer.setDial(func() (Sender, error) {
+			sender := newMockSender()
+			sender.setSend(func(*mockMessage) error { return nil })
+			return sender, nil
+		})
+		messages := generateMessages(dialer)
+		messages[1].(*mockMessage).setDialer(func() (Dialer, error) { return dialer, nil })
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			mw.processBatch(ctx, messages)
+			close(done)
+		}()
+		timer := <-clock.timers
+		if !messages[0].(*mockMessage).finished {
+			ms.T().Fatalf("First chunk wasn't sent before waiting")
+		}
+		if cancelled {
+			cancel()
+		} else {
+			timer <- time.Now()
+		}
+		<-done
+		cancel()
+
+		second := messages[1].(*mockMessage)
+		if cancelled && (second.finished || second.backoffCount != 1) {
+			ms.T().Fatalf("Second chunk wasn't backed off when cancelled during the delay")
+		}
+		if !cancelled && !second.finished {
+			ms.T().Fatalf("Second chunk wasn't sent once the delay elapsed")
+		}
+	}
+}
+
+func (ms *MailerSuite) TestChunkDelayCancelledRemainder() {
+	defer func(size int, delay time.Duration) {
+		MailChunkSize = size
+		MailDelayTime = delay
+	}(MailChunkSize, MailDelayTime)
+	MailChunkSize = 1
+	MailDelayTime = time.Hour
+
+	clock := &fakeClock{timers: make(chan chan time.Time)}
+	mw := NewMailWorker()
+	mw.Clock = clock
+	mw.PerMessageDialers = true
+	newDialer := func() *mockDialer {
+		dialer := newMockDialer()
+		dialer.setDial(func() (Sender, error) {
+			sender := newMockSender()
+			sender.setSend(func(*mockMessage) error { return nil })
+			return sender, nil
+		})
+		return dialer
+	}
+	first, second := newDialer(), newDialer()
+	var messages []Mail
+	for i, dialer := range []*mockDialer{first, first, second} {
+		m := newMockMessage(fmt.Sprintf("%d@example.com", i), []string{"to@example.com"}, bytes.NewBufferString("Email"))
+		dialer := dialer
+		m.setDialer(func() (Dialer, error) { return dialer, nil })
+		messages = append(messages, m)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		mw.processBatch(ctx, messages)
+		close(done)
+	}()
+	<-clock.timers
+	cancel()
+	<-done
+
+	// Every message which wasn't attempted is backed off, including those
+	// of the Dialer groups which hadn't been started.
+	if !messages[0].(*mockMessage).finished {
+		ms.T().Fatalf("First chunk wasn't sent before waiting")
+	}
+	for _, m := range messages[1:] {
+		mm := m.(*mockMessage)
+		if mm.finished || mm.backoffCount != 1 {
+			ms.T().Fatalf("Message %s wasn't backed off when cancelled during the delay", mm.from)
+		}
+	}
+	if second.dialCount != 0 {
+		ms.T().Fatalf("Unexpected dial for a cancelled Dialer group. Got %d dials", second.dialCount)
+	}
+}
+
+func (ms *MailerSuite) TestRemainderChunk() {
+	defer func(size int, delay time.Duration) {
+		MailChunkSize = size
+		MailDelayTime = delay
+	}(MailChunkSize, MailDelayTime)
+	MailChunkSize = 2
+	MailDelayTime = time.Hour
+
+	clock := &fakeClock{timers: make(chan chan time.Time)}
+	mw := NewMailWorker()
+	mw.Clock = clock
+	var progress []int
+	mw.OnProgress = func(sent, total int) {
+		progress = append(progress, sent)
+	}
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		sender := newMockSender()
+		sender.setSend(func(*mockMessage) error { return nil })
+		return sender, nil
+	})
+	var messages []Mail
+	for i := 0; i < 5; i++ {
+		m := newMockMessage("from@example.com", []string{"to@example.com"}, bytes.NewBufferString("Email"))
+		m.setDialer(func() (Dialer, error) { return dialer, nil })
+		messages = append(messages, m)
+	}
+	finished := func() int {
+		n := 0
+		for _, m := range messages {
+			if m.(*mockMessage).finished {
+				n++
+			}
+		}
+		return n
+	}
+
+	done := make(chan struct{})
+	go func() {
+		mw.processBatch(context.Background(), messages)
+		close(done)
+	}()
+	// The final, smaller chunk is waited for like the others.
+	for _, expected := range []int{2, 4} {
+		timer := <-clock.timers
+		if got := finished(); got != expected {
+			ms.T().Fatalf("Unexpected messages sent before waiting. Expected %d, Got %d", expected, got)
+		}
+		timer <- time.Now()
+	}
+	<-done
+
+	if finished() != len(messages) {
+		ms.T().Fatalf("Remainder chunk wasn't sent")
+	}
+	if dialer.dialCount != 3 {
+		ms.T().Fatalf("Unexpected number of connections. Expected %d, Got %d", 3, dialer.dialCount)
+	}
+	if !reflect.DeepEqual(progress, []int{1, 2, 3, 4, 5}) {
+		ms.T().Fatalf("Unexpected progress. Got %v", progress)
+	}
+}
+
+func (ms *MailerSuite) TestEnqueueWithDeadline() {
+	defer func(size int, delay time.Duration) {
+		MailChunkSize = size
+		MailDelayTime = delay
+	}(MailChunkSize, MailDelayTime)
+	MailChunkSize = 1
+	MailDelayTime = time.Hour
+
+	clock := &fakeClock{timers: make(chan chan time.Time)}
+	mw := NewMailWorker()
+	mw.Clock = clock
+	reasons := make(chan error, 2)
+	mw.OnResult = func(m Mail, r Result) {
+		if r.Outcome == OutcomeBackoff {
+			reasons <- r.Err
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go mw.Start(ctx)
+
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		sender := newMockSender()
+		sender.setSend(func(*mockMessage) error { return nil })
+		return sender, nil
+	})
+	newBatch := func(n int) []Mail {
+		var messages []Mail
+		for i := 0; i < n; i++ {
+			m := newMockMessage(fmt.Sprintf("%d@example.com", i), []string{"to@example.com"}, bytes.NewBufferString("Email"))
+			m.setDialer(func() (Dialer, error) { return dialer, nil })
+			messages = append(messages, m)
+		}
+		return messages
+	}
+
+	// The deadline passes while waiting between chunks
+	messages := newBatch(3)
+	if err := mw.EnqueueWithDeadline(time.Now().Add(50*time.Millisecond), messages); err != nil {
+		ms.T().Fatalf("Unexpected error when enqueueing: %s", err)
+	}
+	<-clock.timers
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-reasons:
+			if err != ErrBatchDeadline {
+				ms.T().Fatalf("Unexpected backoff reason. Expected %s, Got %v", ErrBatchDeadline, err)
+			}
+		case <-time.After(time.Second):
+			ms.T().Fatalf("Messages weren't backed off once the deadline passed")
+		}
+	}
+	if !messages[0].(*mockMessage).finished {
+		ms.T().Fatalf("First chunk wasn't sent before the deadline")
+	}
+	for _, m := range messages[1:] {
+		if mm := m.(*mockMessage); mm.finished || mm.backoffCount != 1 {
+			ms.T().Fatalf("Message %s wasn't backed off once the deadline passed", mm.from)
+		}
+	}
+
+	// Nothing is dialed for a batch enqueued past its deadline
+	dialer.dialCount = 0
+	messages = newBatch(1)
+	if err := mw.EnqueueWithDeadline(time.Now().Add(-time.Minute), messages); err != nil {
+		ms.T().Fatalf("Unexpected error when enqueueing: %s", err)
+	}
+	select {
+	case err := <-reasons:
+		if err != ErrBatchDeadline {
+			ms.T().Fatalf("Unexpected backoff reason. Expected %s, Got %v", ErrBatchDeadline, err)
+		}
+	case <-time.After(time.Second):
+		ms.T().Fatalf("Message wasn't backed off past the deadline")
+	}
+	if dialer.dialCount != 0 {
+		ms.T().Fatalf("Unexpected dial past the deadline. Got %d dials", dialer.dialCount)
+	}
+}
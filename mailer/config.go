@@ -0,0 +1,177 @@
+package mailer
+
+import (
+	"math"
+	"time"
+)
+
+// WorkerConfig is a snapshot of the configuration which determines how a
+// MailWorker paces its sending, with defaults applied to the settings left
+// unset. It is a copy, so changing it doesn't affect the worker.
+type WorkerConfig struct {
+	// ChunkSize is the number of messages sent over a single connection
+	// before waiting MailDelayTime (see MailChunkSize).
+	ChunkSize int
+	// MailDelayTime is the time waited between chunks.
+	MailDelayTime time.Duration
+	// MaxBatchSize is the largest batch handed to the worker at once (see
+	// MailWorker.MaxBatchSize).
+	MaxBatchSize int
+	// MaxReconnectAttempts is the number of connection attempts made for a
+	// chunk (see MaxReconnectAttempts), unless its first Mail implements
+	// ReconnectLimiter.
+	MaxReconnectAttempts int
+	// The remaining fields are those of the MailWorker and its Processor
+	// of the same name.
+	GetDialerRetries    int
+	GetDialerRetryDelay time.Duration
+	FailFast            bool
+	PerMessageDialers   bool
+	Scheduling          SchedulingStrategy
+	// Warmup, AdaptiveRate and AdaptiveConcurrency are nil if unset.
+	Warmup                 *WarmupPolicy
+	AdaptiveRate           *AdaptiveRate
+	AdaptiveConcurrency    *AdaptiveConcurrency
+	ConnectionPolicy       ConnectionPolicy
+	MaxOpenConnections     int
+	ConnectionRate         float64
+	ConnectionBurst        int
+	MaxConcurrentPerDomain int
+	MaxBytesPerSecond      float64
+	GenerateWorkers        int
+	MaxConcurrentGenerate  int
+	CancelGrace            time.Duration
+	RecipientCooldown      time.Duration
+	MaxCooldownRecipients  int
+}
+
+// Config returns the configuration currently used by the worker.
+func (mw *MailWorker) Config() WorkerConfig {
+	cfg := WorkerConfig{
+		ChunkSize:              MailChunkSize,
+		MailDelayTime:          MailDelayTime,
+		MaxBatchSize:           mw.MaxBatchSize,
+		MaxReconnectAttempts:   MaxReconnectAttempts,
+		GetDialerRetries:       mw.GetDialerRetries,
+		GetDialerRetryDelay:    mw.GetDialerRetryDelay,
+		FailFast:               mw.FailFast,
+		PerMessageDialers:      mw.PerMessageDialers,
+		Scheduling:             mw.Scheduling,
+		ConnectionPolicy:       mw.ConnectionPolicy,
+		MaxOpenConnections:     mw.MaxOpenConnections,
+		ConnectionRate:         mw.ConnectionRate,
+		ConnectionBurst:        mw.ConnectionBurst,
+		MaxConcurrentPerDomain: mw.MaxConcurrentPerDomain,
+		MaxBytesPerSecond:      mw.MaxBytesPerSecond,
+		GenerateWorkers:        mw.GenerateWorkers,
+		MaxConcurrentGenerate:  mw.MaxConcurrentGenerate,
+		CancelGrace:            mw.CancelGrace,
+		RecipientCooldown:      mw.RecipientCooldown,
+		MaxCooldownRecipients:  mw.MaxCooldownRecipients,
+	}
+	if cfg.RecipientCooldown > 0 && cfg.MaxCooldownRecipients <= 0 {
+		cfg.MaxCooldownRecipients = DefaultMaxCooldownRecipients
+	}
+	if wp := mw.Warmup; wp != nil {
+		cfg.Warmup = &WarmupPolicy{
+			Window:   wp.window(),
+			Schedule: append([]int(nil), wp.Schedule...),
+			Store:    wp.Store,
+		}
+	}
+	if ar := mw.AdaptiveRate; ar != nil {
+		cfg.AdaptiveRate = &AdaptiveRate{
+			MinRate:  ar.MinRate,
+			MaxRate:  ar.MaxRate,
+			Increase: ar.increase(),
+			Decrease: ar.decrease(),
+		}
+	}
+	if ac := mw.AdaptiveConcurrency; ac != nil {
+		cfg.AdaptiveConcurrency = &AdaptiveConcurrency{
+			MaxConnections: ac.max(),
+			ErrorThreshold: ac.threshold(),
+			Window:         ac.window(),
+		}
+	}
+	return cfg
+}
+
+// EstimateDuration returns the expected time needed to send n messages
+// enqueued together as a single call to Enqueue with the given
+// configuration. It accounts for the delays between chunks, for
+// AdaptiveRate sending at most MaxRate messages per second, for
+// ConnectionRate limiting how often chunks connect and for the Warmup caps
+// holding messages back until later windows. It doesn't account for the time
+// spent talking to the server, for MaxBytesPerSecond, which depends on the
+// size of the messages, or for failures and retries, so it is a lower bound
+// useful for showing an ETA. It assumes every message is sent to the same
+// host.
+func EstimateDuration(n int, cfg WorkerConfig) time.Duration {
+	if n <= 0 {
+		return 0
+	}
+	// Once the cap of a window is reached, the rest waits for the next
+	// one, so only the messages of the last window are left to send then.
+	var held time.Duration
+	if wp := cfg.Warmup; wp != nil && len(wp.Schedule) > 0 {
+		window := wp.window()
+		for i := 0; ; i++ {
+			limit := wp.Schedule[len(wp.Schedule)-1]
+			if i < len(wp.Schedule) {
+				limit = wp.Schedule[i]
+			}
+			if n <= limit {
+				break
+			}
+			// The host never gets past a cap of zero.
+			if limit <= 0 && i >= len(wp.Schedule)-1 {
+				return time.Duration(math.MaxInt64)
+			}
+			if limit > 0 {
+				n -= limit
+			}
+			held += window
+		}
+	}
+	return held + estimateSending(n, cfg)
+}
+
+// estimateSending returns the expected time needed to send n messages
+// without any of them being held back by a Warmup.
+func estimateSending(n int, cfg WorkerConfig) time.Duration {
+	size := cfg.ChunkSize
+	if size < 1 {
+		size = 1
+	}
+	total := n
+	// Batches split by MaxBatchSize are processed concurrently, so the
+	// largest one determines how long sending takes.
+	if cfg.MaxBatchSize > 0 && n > cfg.MaxBatchSize {
+		n = cfg.MaxBatchSize
+	}
+	chunks := (n + size - 1) / size
+	estimate := time.Duration(chunks-1) * cfg.MailDelayTime
+	// AdaptiveRate starts at MaxRate, which it never exceeds. The messages
+	// of a chunk are spaced by it on top of the delays between chunks, and
+	// concurrent batches share the host's rate.
+	if ar := cfg.AdaptiveRate; ar != nil && ar.MaxRate > 0 {
+		spacing := time.Duration(float64(time.Second) / ar.MaxRate)
+		estimate += time.Duration(n-chunks) * spacing
+		if shared := time.Duration(total-1) * spacing; shared > estimate {
+			estimate = shared
+		}
+	}
+	// Every chunk of every batch makes at least one connection attempt.
+	if cfg.ConnectionRate > 0 {
+		burst := cfg.ConnectionBurst
+		if burst < 1 {
+			burst = 1
+		}
+		attempts := (total+size-1)/size - burst
+		if dials := time.Duration(float64(attempts) / cfg.ConnectionRate * float64(time.Second)); dials > estimate {
+			estimate = dials
+		}
+	}
+	return estimate
+}
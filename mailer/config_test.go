@@ -0,0 +1,100 @@
+package mailer
+
+import (
+	"math"
+	"time"
+)
+
+func (ms *MailerSuite) TestEstimateDuration() {
+	cfg := WorkerConfig{
+		ChunkSize:     10,
+		MailDelayTime: time.Minute,
+	}
+	tests := []struct {
+		n            int
+		maxBatchSize int
+		expected     time.Duration
+	}{
+		{0, 0, 0},
+		{1, 0, 0},
+		{10, 0, 0},
+		{11, 0, time.Minute},
+		{35, 0, 3 * time.Minute},
+		// Split batches are sent concurrently
+		{35, 20, time.Minute},
+	}
+	for _, test := range tests {
+		cfg.MaxBatchSize = test.maxBatchSize
+		got := EstimateDuration(test.n, cfg)
+		if got != test.expected {
+			ms.T().Fatalf("Unexpected estimate for %d messages with MaxBatchSize %d. Expected %s, Got %s", test.n, test.maxBatchSize, test.expected, got)
+		}
+	}
+}
+
+func (ms *MailerSuite) TestEstimateDurationRateLimits() {
+	tests := []struct {
+		name     string
+		n        int
+		cfg      WorkerConfig
+		expected time.Duration
+	}{
+		// 20 messages spaced by 100ms, with no delay between the two chunks
+		{"adaptive rate", 20, WorkerConfig{ChunkSize: 10, AdaptiveRate: &AdaptiveRate{MaxRate: 10}}, 1900 * time.Millisecond},
+		// The spacing within chunks adds up with the delays between them
+		{"adaptive rate and delay", 20, WorkerConfig{ChunkSize: 10, MailDelayTime: time.Minute, AdaptiveRate: &AdaptiveRate{MaxRate: 10}}, time.Minute + 1800*time.Millisecond},
+		// Concurrent batches share the host's rate
+		{"shared rate", 20, WorkerConfig{ChunkSize: 10, MaxBatchSize: 10, AdaptiveRate: &AdaptiveRate{MaxRate: 10}}, 1900 * time.Millisecond},
+		// 10 chunks, the first 2 of which connect right away
+		{"connection rate", 100, WorkerConfig{ChunkSize: 10, MaxBatchSize: 10, ConnectionRate: 2, ConnectionBurst: 2}, 4 * time.Second},
+		{"warmup", 1000, WorkerConfig{ChunkSize: 10, Warmup: &WarmupPolicy{Window: time.Hour, Schedule: []int{10}}}, 99 * time.Hour},
+		// 10 and 20 messages, then 40 for 9 windows, leaving 10 chunks of
+		// one message for the last one
+		{"warmup schedule", 400, WorkerConfig{ChunkSize: 1, MailDelayTime: time.Second, Warmup: &WarmupPolicy{Window: time.Hour, Schedule: []int{10, 20, 40}}}, 11*time.Hour + 9*time.Second},
+		{"warmup never ending", 20, WorkerConfig{ChunkSize: 10, Warmup: &WarmupPolicy{Window: time.Hour, Schedule: []int{10, 0}}}, time.Duration(math.MaxInt64)},
+	}
+	for _, test := range tests {
+		got := EstimateDuration(test.n, test.cfg)
+		if got != test.expected {
+			ms.T().Fatalf("Unexpected estimate with %s. Expected %s, Got %s", test.name, test.expected, got)
+		}
+	}
+}
+
+func (ms *MailerSuite) TestConfig() {
+	mw := NewMailWorker()
+	mw.MaxBatchSize = 50
+	mw.Scheduling = ScheduleDomainFair
+	mw.Warmup = &WarmupPolicy{Schedule: []int{10, 100}}
+	mw.AdaptiveRate = &AdaptiveRate{MinRate: 1, MaxRate: 10}
+	mw.MaxConnectionAge = time.Minute
+	mw.RecipientCooldown = time.Hour
+
+	cfg := mw.Config()
+	if cfg.ChunkSize != MailChunkSize || cfg.MailDelayTime != MailDelayTime || cfg.MaxBatchSize != 50 {
+		ms.T().Fatalf("Unexpected pacing in config: %+v", cfg)
+	}
+	if cfg.Scheduling != ScheduleDomainFair || cfg.ConnectionPolicy.MaxConnectionAge != time.Minute {
+		ms.T().Fatalf("Unexpected settings in config: %+v", cfg)
+	}
+	// Defaults are applied to the settings left unset
+	if cfg.Warmup.Window != DefaultWarmupWindow {
+		ms.T().Fatalf("Unexpected warmup window. Expected %s, Got %s", DefaultWarmupWindow, cfg.Warmup.Window)
+	}
+	if cfg.AdaptiveRate.Increase != 1 || cfg.AdaptiveRate.Decrease != 0.5 {
+		ms.T().Fatalf("Unexpected adaptive rate: %+v", *cfg.AdaptiveRate)
+	}
+	if cfg.MaxCooldownRecipients != DefaultMaxCooldownRecipients {
+		ms.T().Fatalf("Unexpected cooldown recipients. Expected %d, Got %d", DefaultMaxCooldownRecipients, cfg.MaxCooldownRecipients)
+	}
+	if cfg.AdaptiveConcurrency != nil {
+		ms.T().Fatalf("Unexpected adaptive concurrency: %+v", *cfg.AdaptiveConcurrency)
+	}
+
+	// The snapshot is a copy
+	cfg.Warmup.Schedule[0] = 1000
+	cfg.AdaptiveRate.MaxRate = 1000
+	if mw.Warmup.Schedule[0] != 10 || mw.Warmup.Window != 0 || mw.AdaptiveRate.MaxRate != 10 {
+		ms.T().Fatalf("Changing the config changed the worker's settings")
+	}
+}
@@ -0,0 +1,437 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ConnectionPolicy holds the settings determining how long the connections
+// used to send chunks are used, and when they are reset or replaced. The zero
+// value uses a connection for a whole chunk, only resetting it after a failed
+// send, and closes it once the chunk is sent. Processor embeds a
+// ConnectionPolicy, and Validate reports settings which contradict each
+// other.
+type ConnectionPolicy struct {
+	// MaxMessagesPerConnection, if greater than zero, is the number of
+	// messages sent over a connection before it is replaced by a new one,
+	// even in the middle of a chunk, for servers limiting how many
+	// messages they accept per connection.
+	MaxMessagesPerConnection int
+	// MaxConnectionAge, if non-zero, is how long a connection is used
+	// before being replaced by a new one, even in the middle of a chunk.
+	// This preempts connections being silently dropped by NAT gateways or
+	// load balancers with idle limits.
+	MaxConnectionAge time.Duration
+	// MaxConsecutiveFailuresPerConnection, if greater than zero, is the
+	// number of messages in a row which may be backed off or errored out
+	// over a connection before it is replaced by a new one for the next
+	// message, since a server which keeps rejecting messages may have
+	// gotten the connection into a bad state. Unlike AdaptiveConcurrency,
+	// this only concerns the connection, not the host.
+	MaxConsecutiveFailuresPerConnection int
+	// ResetEvery, if greater than zero, makes the Processor reset the
+	// connection after every ResetEvery messages sent over it, even if
+	// they were all accepted, which is reported to OnReset as
+	// ResetProactive. Connections are always reset after a failed send.
+	ResetEvery int
+	// KeepConnectionOnResetFailure makes the Processor keep sending over a
+	// connection whose Sender failed to reset. By default the connection
+	// is considered unusable and is re-dialed before sending the rest of
+	// the chunk.
+	KeepConnectionOnResetFailure bool
+	// IdleConnectionTimeout, if greater than zero, keeps the connection
+	// used for a chunk open once the chunk is sent if its Dialer implements
+	// FingerprintDialer or its first Mail implements ConnectionKeyer. Later
+	// chunks with the same Fingerprint, or for the same host and key,
+	// including those of later batches, reuse it rather than dialing again.
+	// Connections are closed once idle for the timeout, or when
+	// CloseIdleConnections is called. They keep holding their
+	// MaxOpenConnections slot while idle.
+	IdleConnectionTimeout time.Duration
+	// IdleKeepAlive, if greater than zero, is how often connections kept
+	// open by IdleConnectionTimeout, for example while the worker waits
+	// MailDelayTime between chunks, are checked with a NOOP if their
+	// Sender implements NoopSender, so that servers don't drop them for
+	// being idle. Connections failing the check are closed.
+	IdleKeepAlive time.Duration
+	// IdleProbeThreshold, if greater than zero, is how long a connection
+	// may go unused, for example while kept open by IdleConnectionTimeout
+	// or while the Processor waits for a rate limit, before it is checked
+	// ahead of the next message with a NOOP, or a RSET if its Sender doesn't
+	// implement NoopSender. Connections failing the check are re-dialed, so
+	// that the message isn't the one to find out the connection was lost.
+	IdleProbeThreshold time.Duration
+}
+
+// Validate returns an error if the policy has negative settings, or settings
+// contradicting each other.
+func (cp ConnectionPolicy) Validate() error {
+	switch {
+	case cp.MaxMessagesPerConnection < 0, cp.MaxConnectionAge < 0, cp.MaxConsecutiveFailuresPerConnection < 0,
+		cp.ResetEvery < 0, cp.IdleConnectionTimeout < 0, cp.IdleKeepAlive < 0, cp.IdleProbeThreshold < 0:
+		return errors.New("connection policy settings can't be negative")
+	case cp.ResetEvery > 0 && cp.MaxMessagesPerConnection > 0 && cp.ResetEvery >= cp.MaxMessagesPerConnection:
+		return errors.New("ResetEvery must be less than MaxMessagesPerConnection, or connections are replaced before being reset")
+	case cp.IdleKeepAlive > 0 && cp.IdleConnectionTimeout == 0:
+		return errors.New("IdleKeepAlive requires IdleConnectionTimeout, since connections aren't kept idle otherwise")
+	case cp.IdleKeepAlive > 0 && cp.IdleKeepAlive >= cp.IdleConnectionTimeout:
+		return errors.New("IdleKeepAlive must be less than IdleConnectionTimeout, or idle connections are closed before being checked")
+	case cp.IdleConnectionTimeout > 0 && cp.MaxConnectionAge > 0 && cp.IdleConnectionTimeout >= cp.MaxConnectionAge:
+		return errors.New("IdleConnectionTimeout must be less than MaxConnectionAge, or idle connections expire before being reused")
+	}
+	return nil
+}
+
+// replacement returns why the connection should be replaced before sending
+// another message over it, or an empty string if it shouldn't.
+func (cp *ConnectionPolicy) replacement(conn *connection) string {
+	switch {
+	case cp.MaxConnectionAge > 0 && time.Since(conn.dialed) > cp.MaxConnectionAge:
+		return fmt.Sprintf("is older than %s", cp.MaxConnectionAge)
+	case cp.MaxMessagesPerConnection > 0 && conn.messages >= cp.MaxMessagesPerConnection:
+		return fmt.Sprintf("was used for %d messages", conn.messages)
+	case cp.MaxConsecutiveFailuresPerConnection > 0 && conn.failures >= cp.MaxConsecutiveFailuresPerConnection:
+		return fmt.Sprintf("failed the last %d messages", conn.failures)
+	}
+	return ""
+}
+
+// probeIdle checks the connection is still alive if it has been unused for
+// longer than IdleProbeThreshold, re-dialing it if it isn't. The error is
+// only returned if the connection couldn't be re-dialed.
+func (p *Processor) probeIdle(ctx context.Context, conn *connection) error {
+	if p.IdleProbeThreshold <= 0 || time.Since(conn.used) <= p.IdleProbeThreshold {
+		return nil
+	}
+	var err error
+	if ns, ok := conn.sender.(NoopSender); ok {
+		err = ns.Noop()
+	} else {
+		err = conn.sender.Reset()
+	}
+	if err == nil {
+		conn.used = time.Now()
+		return nil
+	}
+	Logger.Printf("Connection to %s failed its idle probe, reconnecting: %s\n", conn.host, err)
+	return p.redial(ctx, conn)
+}
+
+// resetDue returns whether the connection should be reset after the message
+// which was just sent over it.
+func (cp *ConnectionPolicy) resetDue(conn *connection) bool {
+	return cp.ResetEvery > 0 && conn.messages > 0 && conn.messages%cp.ResetEvery == 0
+}
+
+// connection is the connection to a host used to send a chunk of Mail. It
+// keeps track of how to dial the host again should the connection be lost.
+type connection struct {
+	host     string
+	dialer   Dialer
+	attempts int
+	sender   Sender
+	// dialed is when the current sender was dialed, and used when it was
+	// last sent over or checked.
+	dialed time.Time
+	used   time.Time
+	// messages is the number of messages sent since then, and failures
+	// the number of those in a row which were backed off or errored out.
+	messages int
+	failures int
+	// release frees the connection's MaxOpenConnections slot, if any.
+	release func()
+	// caps are the Capabilities the server advertised when the current
+	// sender was dialed.
+	caps Capabilities
+	// closed, if set, is called with the error returned by the sender's
+	// Close method once it is closed.
+	closed func(host string, err error)
+}
+
+// dial connects to the host, making at most conn.attempts attempts.
+func (p *Processor) dial(ctx context.Context, conn *connection) error {
+	release, err := p.acquireConnection(ctx)
+	if err != nil {
+		return err
+	}
+	sender, err := dialHost(ctx, p.throttle(ctx, conn.dialer), conn.attempts)
+	if err != nil {
+		release()
+		p.hosts.recordDialError(conn.host, err)
+		return err
+	}
+	// dialHost doesn't return a Sender if the context was cancelled
+	if sender == nil {
+		release()
+		return ctx.Err()
+	}
+	conn.sender = sender
+	conn.dialed = time.Now()
+	conn.used = conn.dialed
+	conn.messages, conn.failures = 0, 0
+	conn.release = release
+	conn.caps = capabilitiesOf(sender)
+	conn.closed = p.connectionClosed
+	p.connected(conn.host, sender)
+	if p.OnConnect != nil {
+		p.OnConnect(conn.host, conn.caps)
+	}
+	if p.OnNewConnection != nil {
+		p.OnNewConnection(sender, conn.host)
+	}
+	return nil
+}
+
+// redial closes the current connection and dials the host again. If this
+// fails, the connection is left closed.
+func (p *Processor) redial(ctx context.Context, conn *connection) error {
+	conn.close()
+	return p.dial(ctx, conn)
+}
+
+// close closes the connection, if open.
+func (conn *connection) close() {
+	if conn.sender != nil {
+		err := conn.sender.Close()
+		conn.sender = nil
+		conn.release()
+		if conn.closed != nil {
+			conn.closed(conn.host, err)
+		}
+	}
+}
+
+// connectionClosed logs the error returned when closing a connection to
+// the host, if any, and passes it to OnConnectionClose. For SMTPDialer this
+// is the reply to QUIT, so a failure may mean the last message sent over the
+// connection wasn't committed by the server.
+func (p *Processor) connectionClosed(host string, err error) {
+	if err != nil {
+		Logger.Printf("WARNING: connection to %s wasn't closed cleanly, the last message sent over it may not have been delivered: %s\n", host, err)
+	}
+	if p.OnConnectionClose != nil {
+		p.OnConnectionClose(host, err)
+	}
+}
+
+// idleConnections holds the connections kept open between chunks when
+// IdleConnectionTimeout is set, keyed by host and connection key. The zero
+// value is ready to use.
+type idleConnections struct {
+	mu    sync.Mutex
+	conns map[string]*idleConnection
+}
+
+// idleConnection is a connection waiting to be reused, the timer which
+// closes it once idle for too long and the one checking it is still alive.
+// mu is held while the connection is being checked.
+type idleConnection struct {
+	mu        sync.Mutex
+	conn      *connection
+	timer     *time.Timer
+	keepalive *time.Timer
+}
+
+// stop stops the idle connection's timers, waiting for any check in progress
+// to finish.
+func (idle *idleConnection) stop() {
+	idle.mu.Lock()
+	defer idle.mu.Unlock()
+	idle.timer.Stop()
+	if idle.keepalive != nil {
+		idle.keepalive.Stop()
+	}
+}
+
+// take removes and returns the idle connection for the key, or nil if there
+// is none.
+func (ic *idleConnections) take(key string) *connection {
+	ic.mu.Lock()
+	idle, ok := ic.conns[key]
+	if !ok {
+		ic.mu.Unlock()
+		return nil
+	}
+	delete(ic.conns, key)
+	ic.mu.Unlock()
+	idle.stop()
+	// The connection may have failed a check in the meantime.
+	if idle.conn.sender == nil {
+		return nil
+	}
+	return idle.conn
+}
+
+// put keeps the connection open for reuse under the key, closing it once
+// it has been idle for the timeout and checking it every keepalive if
+// non-zero. If there already is an idle connection for the key, the new one
+// is closed instead.
+func (ic *idleConnections) put(key string, conn *connection, timeout, keepalive time.Duration) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	if _, ok := ic.conns[key]; ok {
+		conn.close()
+		return
+	}
+	if ic.conns == nil {
+		ic.conns = make(map[string]*idleConnection)
+	}
+	idle := &idleConnection{conn: conn}
+	idle.timer = time.AfterFunc(timeout, func() {
+		// The connection may have been taken in the meantime.
+		if !ic.remove(key, idle) {
+			return
+		}
+		idle.stop()
+		conn.close()
+	})
+	if ns, ok := conn.sender.(NoopSender); ok && keepalive > 0 {
+		idle.keepalive = time.AfterFunc(keepalive, func() {
+			ic.check(key, idle, ns, keepalive)
+		})
+	}
+	ic.conns[key] = idle
+}
+
+// check sends a NOOP over the idle connection for the key, closing it if
+// that fails and checking it again after the interval otherwise.
+func (ic *idleConnections) check(key string, idle *idleConnection, ns NoopSender, interval time.Duration) {
+	ic.mu.Lock()
+	if ic.conns[key] != idle {
+		ic.mu.Unlock()
+		return
+	}
+	// Holding the idle connection's lock makes take wait for the check.
+	idle.mu.Lock()
+	defer idle.mu.Unlock()
+	ic.mu.Unlock()
+	if err := ns.Noop(); err != nil {
+		Logger.Printf("Idle connection to %s failed its keepalive, closing it: %s\n", idle.conn.host, err)
+		ic.remove(key, idle)
+		idle.timer.Stop()
+		idle.conn.close()
+		return
+	}
+	idle.conn.used = time.Now()
+	idle.keepalive.Reset(interval)
+}
+
+// remove removes the idle connection for the key, reporting whether it was
+// still there.
+func (ic *idleConnections) remove(key string, idle *idleConnection) bool {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	if ic.conns[key] != idle {
+		return false
+	}
+	delete(ic.conns, key)
+	return true
+}
+
+// closeAll closes every idle connection.
+func (ic *idleConnections) closeAll() {
+	ic.mu.Lock()
+	conns := ic.conns
+	ic.conns = nil
+	ic.mu.Unlock()
+	for _, idle := range conns {
+		idle.stop()
+		idle.conn.close()
+	}
+}
+
+// persistentKey returns the key under which the connection used for a chunk
+// starting with the Mail is kept open between chunks, and whether it should
+// be.
+func (p *Processor) persistentKey(m Mail, dialer Dialer, host string) (string, bool) {
+	if p.IdleConnectionTimeout <= 0 {
+		return "", false
+	}
+	if fd, ok := dialer.(FingerprintDialer); ok {
+		return "fingerprint\x00" + fd.Fingerprint(), true
+	}
+	ck, ok := m.(ConnectionKeyer)
+	if !ok {
+		return "", false
+	}
+	return "key\x00" + host + "\x00" + ck.ConnectionKey(), true
+}
+
+// CloseIdleConnections closes the connections kept open for reuse because
+// of IdleConnectionTimeout. MailWorker calls it when it is shut down.
+func (p *Processor) CloseIdleConnections() {
+	p.idle.closeAll()
+}
+
+// acquireConnection blocks until opening a connection wouldn't exceed
+// MaxOpenConnections, returning the function used to free the slot once the
+// connection is closed. It returns the context's error if it is cancelled
+// while waiting.
+func (p *Processor) acquireConnection(ctx context.Context) (func(), error) {
+	if p.MaxOpenConnections <= 0 {
+		return func() {}, nil
+	}
+	p.connSlotsOnce.Do(func() {
+		p.connSlots = make(chan struct{}, p.MaxOpenConnections)
+	})
+	select {
+	case p.connSlots <- struct{}{}:
+		return func() { <-p.connSlots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// throttledDialer is a Dialer which waits for the Processor's ConnectionRate
+// to allow another connection attempt before dialing.
+type throttledDialer struct {
+	Dialer
+	ctx context.Context
+	p   *Processor
+}
+
+func (d *throttledDialer) Dial() (Sender, error) {
+	wait := d.p.dials.reserve(d.p.ConnectionRate, d.p.ConnectionBurst)
+	if wait > 0 {
+		t := time.NewTimer(wait)
+		defer t.Stop()
+		select {
+		case <-d.ctx.Done():
+			return nil, d.ctx.Err()
+		case <-t.C:
+		}
+	}
+	return d.Dialer.Dial()
+}
+
+// throttle returns the dialer to use so that connection attempts follow the
+// ConnectionRate.
+func (p *Processor) throttle(ctx context.Context, dialer Dialer) Dialer {
+	if p.ConnectionRate <= 0 {
+		return dialer
+	}
+	return &throttledDialer{Dialer: dialer, ctx: ctx, p: p}
+}
+
+// isConnectionLost returns whether the error returned when sending a message
+// indicates that the connection was dropped, for example by the server
+// closing an idle connection.
+func isConnectionLost(err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	case errors.Is(err, syscall.EPIPE), errors.Is(err, syscall.ECONNRESET):
+		return true
+	case errors.Is(err, net.ErrClosed):
+		return true
+	}
+	return false
+}
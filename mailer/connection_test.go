@@ -0,0 +1,248 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"net/textproto"
+	"reflect"
+	"time"
+)
+
+func (ms *MailerSuite) TestConnectionPolicyValidate() {
+	valid := []ConnectionPolicy{
+		{},
+		{MaxMessagesPerConnection: 10, ResetEvery: 5},
+		{IdleConnectionTimeout: time.Minute, IdleKeepAlive: 10 * time.Second, MaxConnectionAge: time.Hour},
+	}
+	for _, cp := range valid {
+		if err := cp.Validate(); err != nil {
+			ms.T().Fatalf("Unexpected error validating %+v: %s", cp, err)
+		}
+	}
+	invalid := []ConnectionPolicy{
+		{MaxMessagesPerConnection: -1},
+		{IdleProbeThreshold: -time.Second},
+		{MaxMessagesPerConnection: 5, ResetEvery: 5},
+		{IdleKeepAlive: time.Second},
+		{IdleConnectionTimeout: time.Second, IdleKeepAlive: time.Minute},
+		{IdleConnectionTimeout: time.Hour, MaxConnectionAge: time.Minute},
+	}
+	for _, cp := range invalid {
+		if err := cp.Validate(); err == nil {
+			ms.T().Fatalf("Expected an error validating %+v", cp)
+		}
+	}
+}
+
+func (ms *MailerSuite) TestMaxMessagesPerConnection() {
+	p := &Processor{ConnectionPolicy: ConnectionPolicy{MaxMessagesPerConnection: 2, ResetEvery: 1}}
+	var reasons []ResetReason
+	p.OnReset = func(reason ResetReason, err error) {
+		reasons = append(reasons, reason)
+	}
+	var senders []*mockSender
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		sender := newMockSender()
+		sender.setSend(func(*mockMessage) error { return nil })
+		senders = append(senders, sender)
+		return sender, nil
+	})
+	var messages []Mail
+	for i := 0; i < 5; i++ {
+		messages = append(messages, newMockMessage("from@example.com", []string{"to@example.com"}, bytes.NewBufferString("Email")))
+	}
+	stats := p.ProcessChunk(context.Background(), dialer, messages)
+
+	if stats != (BatchStats{Sent: 5}) {
+		ms.T().Fatalf("Unexpected stats. Expected every message to be sent, Got %+v", stats)
+	}
+	if len(senders) != 3 {
+		ms.T().Fatalf("Unexpected number of connections. Expected %d, Got %d", 3, len(senders))
+	}
+	for i, sender := range senders {
+		if len(sender.messages) != sender.resetCount {
+			ms.T().Fatalf("Connection %d wasn't reset after every message. Got %d resets for %d messages", i, sender.resetCount, len(sender.messages))
+		}
+	}
+	for _, reason := range reasons {
+		if reason != ResetProactive {
+			ms.T().Fatalf("Unexpected reset reason. Expected %s, Got %s", ResetProactive, reason)
+		}
+	}
+}
+
+func (ms *MailerSuite) TestOnNewConnection() {
+	p := &Processor{ConnectionPolicy: ConnectionPolicy{MaxMessagesPerConnection: 2}}
+	var senders, connected []*mockSender
+	used := false
+	p.OnNewConnection = func(sender Sender, host string) {
+		s := sender.(*mockSender)
+		used = used || len(s.messages) != 0
+		connected = append(connected, s)
+	}
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		sender := newMockSender()
+		sender.setSend(func(*mockMessage) error { return nil })
+		senders = append(senders, sender)
+		return sender, nil
+	})
+	var messages []Mail
+	for i := 0; i < 5; i++ {
+		messages = append(messages, newMockMessage("from@example.com", []string{"to@example.com"}, bytes.NewBufferString("Email")))
+	}
+	stats := p.ProcessChunk(context.Background(), dialer, messages)
+
+	if stats != (BatchStats{Sent: 5}) {
+		ms.T().Fatalf("Unexpected stats. Expected every message to be sent, Got %+v", stats)
+	}
+	if len(connected) != 3 || len(senders) != 3 {
+		ms.T().Fatalf("Unexpected number of OnNewConnection calls. Expected %d, Got %d for %d connections", 3, len(connected), len(senders))
+	}
+	if used {
+		ms.T().Fatalf("A connection was used before OnNewConnection was called")
+	}
+	for i := range senders {
+		if connected[i] != senders[i] {
+			ms.T().Fatalf("OnNewConnection wasn't called with connection %d", i)
+		}
+	}
+}
+
+func (ms *MailerSuite) TestOnConnectionClose() {
+	type closed struct {
+		host string
+		err  error
+	}
+	var got []closed
+	p := &Processor{
+		OnConnectionClose: func(host string, err error) {
+			got = append(got, closed{host, err})
+		},
+	}
+	quitErr := &textproto.Error{Code: 451, Msg: "Local error in processing"}
+	for _, closeErr := range []error{nil, quitErr} {
+		got = nil
+		dialer := newMockDialer()
+		dialer.setDial(func() (Sender, error) {
+			sender := &closeErrorSender{mockSender: newMockSender(), closeErr: closeErr}
+			sender.setSend(func(*mockMessage) error { return nil })
+			return sender, nil
+		})
+		m := newMockMessage("from@example.com", []string{"to@example.com"}, bytes.NewBufferString("Email"))
+		stats := p.ProcessChunk(context.Background(), dialer, []Mail{m})
+
+		if stats != (BatchStats{Sent: 1}) {
+			ms.T().Fatalf("Unexpected stats. Expected a successful send, Got %+v", stats)
+		}
+		expected := []closed{{"mock.example.com:25", closeErr}}
+		if !reflect.DeepEqual(got, expected) {
+			ms.T().Fatalf("Unexpected OnConnectionClose calls. Expected %v, Got %v", expected, got)
+		}
+	}
+}
+
+func (ms *MailerSuite) TestIdleKeepAlive() {
+	sender := &noopSender{mockSender: newMockSender()}
+	sender.setSend(func(*mockMessage) error { return nil })
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		return sender, nil
+	})
+	newBatch := func() []Mail {
+		m := newMockMessage("from@example.com", []string{"to@example.com"}, bytes.NewBufferString("Email"))
+		return []Mail{&keyedMessage{mockMessage: m, key: "campaign"}}
+	}
+
+	p := &Processor{ConnectionPolicy: ConnectionPolicy{IdleConnectionTimeout: time.Minute, IdleKeepAlive: 5 * time.Millisecond}}
+	defer p.CloseIdleConnections()
+	p.ProcessChunk(context.Background(), dialer, newBatch())
+	deadline := time.Now().Add(time.Second)
+	for sender.noopCount() < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if sender.noopCount() < 2 {
+		ms.T().Fatalf("Idle connection wasn't kept alive. Got %d NOOPs", sender.noopCount())
+	}
+	// The connection passed its checks, so it is reused
+	p.ProcessChunk(context.Background(), dialer, newBatch())
+	if dialer.dialCount != 1 {
+		ms.T().Fatalf("Connection wasn't reused. Expected %d dial, Got %d", 1, dialer.dialCount)
+	}
+
+	// Once a check fails, the connection is closed and a new one is dialed
+	sender.mu.Lock()
+	sender.fail = true
+	sender.mu.Unlock()
+	idleCount := func() int {
+		p.idle.mu.Lock()
+		defer p.idle.mu.Unlock()
+		return len(p.idle.conns)
+	}
+	deadline = time.Now().Add(time.Second)
+	for idleCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if idleCount() > 0 {
+		ms.T().Fatalf("Idle connection which failed its keepalive wasn't closed")
+	}
+	dialer.setDial(func() (Sender, error) {
+		sender := newMockSender()
+		sender.setSend(func(*mockMessage) error { return nil })
+		return sender, nil
+	})
+	p.ProcessChunk(context.Background(), dialer, newBatch())
+	if dialer.dialCount != 2 {
+		ms.T().Fatalf("Unexpected number of dials. Expected %d, Got %d", 2, dialer.dialCount)
+	}
+}
+
+func (ms *MailerSuite) TestIdleProbeThreshold() {
+	// Every message after the first waits longer than the threshold
+	p := &Processor{
+		ConnectionPolicy: ConnectionPolicy{IdleProbeThreshold: 20 * time.Millisecond},
+		OnResult: func(Mail, Result) {
+			time.Sleep(50 * time.Millisecond)
+		},
+	}
+	newMessages := func() []Mail {
+		return []Mail{
+			newMockMessage("from@example.com", []string{"to@example.com"}, bytes.NewBufferString("Email")),
+			newMockMessage("from@example.com", []string{"to@example.com"}, bytes.NewBufferString("Email")),
+		}
+	}
+
+	// A connection failing its probe is re-dialed
+	var senders []*noopSender
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		sender := &noopSender{mockSender: newMockSender(), fail: len(senders) == 0}
+		sender.setSend(func(*mockMessage) error { return nil })
+		senders = append(senders, sender)
+		return sender, nil
+	})
+	stats := p.ProcessChunk(context.Background(), dialer, newMessages())
+	if stats != (BatchStats{Sent: 2}) {
+		ms.T().Fatalf("Unexpected stats. Expected every message to be sent, Got %+v", stats)
+	}
+	if len(senders) != 2 || senders[0].noopCount() != 1 {
+		ms.T().Fatalf("Connection wasn't re-dialed after failing its probe. Got %d connections", len(senders))
+	}
+	if len(senders[0].messages) != 1 || len(senders[1].messages) != 1 {
+		ms.T().Fatalf("Unexpected messages per connection. Got %d and %d", len(senders[0].messages), len(senders[1].messages))
+	}
+
+	// Senders which don't implement NoopSender are reset
+	sender := newMockSender()
+	sender.setSend(func(*mockMessage) error { return nil })
+	dialer = newMockDialer()
+	dialer.setDial(func() (Sender, error) { return sender, nil })
+	stats = p.ProcessChunk(context.Background(), dialer, newMessages())
+	if stats != (BatchStats{Sent: 2}) {
+		ms.T().Fatalf("Unexpected stats. Expected every message to be sent, Got %+v", stats)
+	}
+	if dialer.dialCount != 1 || sender.resetCount != 1 {
+		ms.T().Fatalf("Unexpected probe. Expected a single reset, Got %d resets over %d connections", sender.resetCount, dialer.dialCount)
+	}
+}
@@ -0,0 +1,116 @@
+package mailer
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxCooldownRecipients is the number of recipients a Processor
+// remembers for its RecipientCooldown when MaxCooldownRecipients isn't set.
+var DefaultMaxCooldownRecipients = 100000
+
+// recipientCooldowns remembers when recipients were last sent to. The zero
+// value is ready to use.
+type recipientCooldowns struct {
+	mu   sync.Mutex
+	sent map[string]time.Time
+	// order holds the recipients in the order they were claimed, so the
+	// oldest can be forgotten first. Entries whose time no longer matches
+	// sent are stale.
+	order []cooldownEntry
+}
+
+type cooldownEntry struct {
+	addr string
+	at   time.Time
+}
+
+// normalizeAddress returns the key an address is compared with, ignoring
+// case and surrounding whitespace.
+func normalizeAddress(addr string) string {
+	return strings.ToLower(strings.TrimSpace(addr))
+}
+
+// claim records that the recipients are being sent to at now, unless one of
+// them was already sent to less than cooldown ago, in which case it returns
+// false and records nothing. At most max recipients are remembered.
+func (rc *recipientCooldowns) claim(to []string, now time.Time, cooldown time.Duration, max int) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.expire(now.Add(-cooldown))
+	for _, addr := range to {
+		if _, ok := rc.sent[normalizeAddress(addr)]; ok {
+			return false
+		}
+	}
+	if rc.sent == nil {
+		rc.sent = make(map[string]time.Time)
+	}
+	for _, addr := range to {
+		key := normalizeAddress(addr)
+		rc.sent[key] = now
+		rc.order = append(rc.order, cooldownEntry{addr: key, at: now})
+	}
+	for len(rc.sent) > max {
+		rc.pop()
+	}
+	return true
+}
+
+// forget removes the recipients, which weren't sent to after all.
+func (rc *recipientCooldowns) forget(to []string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for _, addr := range to {
+		delete(rc.sent, normalizeAddress(addr))
+	}
+}
+
+// expire forgets the recipients sent to before cutoff.
+func (rc *recipientCooldowns) expire(cutoff time.Time) {
+	for len(rc.order) > 0 && !rc.order[0].at.After(cutoff) {
+		rc.pop()
+	}
+}
+
+// pop forgets the oldest recipient, unless it was claimed again since.
+func (rc *recipientCooldowns) pop() {
+	e := rc.order[0]
+	rc.order = rc.order[1:]
+	if at, ok := rc.sent[e.addr]; ok && at.Equal(e.at) {
+		delete(rc.sent, e.addr)
+	}
+}
+
+// claimRecipients returns ErrRecipientCooldown if RecipientCooldown is set
+// and one of the recipients was sent to more recently, and records that they
+// are being sent to otherwise.
+func (p *Processor) claimRecipients(to []string) error {
+	if p.RecipientCooldown <= 0 {
+		return nil
+	}
+	max := p.MaxCooldownRecipients
+	if max <= 0 {
+		max = DefaultMaxCooldownRecipients
+	}
+	if !p.cooldowns.claim(to, time.Now(), p.RecipientCooldown, max) {
+		return ErrRecipientCooldown
+	}
+	return nil
+}
+
+// releaseRecipients forgets the recipients of a delivery which weren't sent
+// to, so they can be sent to again right away.
+func (p *Processor) releaseRecipients(d delivery) {
+	if !d.claimed {
+		return
+	}
+	if d.err != nil {
+		p.cooldowns.forget(d.recipients)
+		return
+	}
+	for addr := range d.rejected {
+		p.cooldowns.forget([]string{addr})
+	}
+}
@@ -0,0 +1,84 @@
+package mailer
+
+import (
+	"context"
+	"net/textproto"
+	"time"
+)
+
+func (ms *MailerSuite) TestRecipientCooldown() {
+	p := &Processor{RecipientCooldown: time.Hour}
+	var reasons []error
+	p.OnResult = func(m Mail, r Result) {
+		reasons = append(reasons, r.Err)
+	}
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		sender := newMockSender()
+		sender.setSend(func(*mockMessage) error { return nil })
+		return sender, nil
+	})
+
+	// Both messages are sent to the same recipient
+	messages := generateMessages(dialer)
+	stats := p.ProcessChunk(context.Background(), dialer, messages)
+	expected := BatchStats{Sent: 1, Backoffs: 1}
+	if stats != expected {
+		ms.T().Fatalf("Unexpected stats. Expected %+v, Got %+v", expected, stats)
+	}
+	if reasons[1] != ErrRecipientCooldown {
+		ms.T().Fatalf("Unexpected backoff reason. Expected %s, Got %v", ErrRecipientCooldown, reasons[1])
+	}
+
+	p.SkipCooldownRecipients = true
+	stats = p.ProcessChunk(context.Background(), dialer, generateMessages(dialer))
+	expected = BatchStats{Skipped: 2}
+	if stats != expected {
+		ms.T().Fatalf("Unexpected stats. Expected %+v, Got %+v", expected, stats)
+	}
+}
+
+func (ms *MailerSuite) TestRecipientCooldownFailedSend() {
+	p := &Processor{RecipientCooldown: time.Hour}
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		sender := newMockSender()
+		sender.setSend(func(mm *mockMessage) error {
+			if mm.from == "first@example.com" {
+				return &textproto.Error{Code: 550, Msg: "Rejected"}
+			}
+			return nil
+		})
+		return sender, nil
+	})
+
+	// The recipient wasn't sent the first message, so it can be sent the
+	// second one.
+	stats := p.ProcessChunk(context.Background(), dialer, generateMessages(dialer))
+	expected := BatchStats{Sent: 1, Errors: 1}
+	if stats != expected {
+		ms.T().Fatalf("Unexpected stats. Expected %+v, Got %+v", expected, stats)
+	}
+}
+
+func (ms *MailerSuite) TestRecipientCooldownsBounded() {
+	var rc recipientCooldowns
+	now := time.Now()
+	if !rc.claim([]string{"first@example.com"}, now, time.Hour, 1) {
+		ms.T().Fatalf("Expected the first recipient to be claimed")
+	}
+	if rc.claim([]string{" FIRST@example.com"}, now, time.Hour, 1) {
+		ms.T().Fatalf("Expected the recipient to be in its cooldown")
+	}
+	if !rc.claim([]string{"second@example.com"}, now, time.Hour, 1) {
+		ms.T().Fatalf("Expected the second recipient to be claimed")
+	}
+	// Only one recipient is remembered, so the first one was forgotten
+	if len(rc.sent) != 1 || !rc.claim([]string{"first@example.com"}, now, time.Hour, 1) {
+		ms.T().Fatalf("Expected the oldest recipient to be forgotten")
+	}
+	// Recipients are forgotten once their cooldown has passed
+	if !rc.claim([]string{"first@example.com"}, now.Add(time.Hour), time.Hour, 1) {
+		ms.T().Fatalf("Expected the cooldown to have passed")
+	}
+}
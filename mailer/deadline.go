@@ -0,0 +1,31 @@
+package mailer
+
+import (
+	"context"
+	"time"
+)
+
+// deadlineKey is the context key of the deadline of a batch enqueued with
+// EnqueueWithDeadline.
+type deadlineKey struct{}
+
+// EnqueueWithDeadline is like Enqueue, but the batch must be sent by the
+// deadline, such as the time a campaign was promised to finish by. Once it
+// passes, the messages being sent get CancelGrace to complete, the Mail
+// instances which haven't been attempted yet are backed off with
+// ErrBatchDeadline and the batch ends. Parts of the batch held back by a
+// Warmup keep the deadline.
+func (mw *MailWorker) EnqueueWithDeadline(deadline time.Time, ms []Mail) error {
+	ctx := context.WithValue(context.Background(), deadlineKey{}, deadline)
+	return mw.enqueueBatches(batch{ctx: ctx, mails: ms})
+}
+
+// withBatchDeadline returns a copy of ctx which expires with the deadline of
+// the batch it belongs to, if any, and the function to release it.
+func withBatchDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Value(deadlineKey{}).(time.Time)
+	if !ok {
+		return ctx, func() {}
+	}
+	return context.WithDeadline(ctx, deadline)
+}
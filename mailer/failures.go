@@ -0,0 +1,97 @@
+package mailer
+
+import (
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+// Failure describes a Mail instance which was errored out.
+type Failure struct {
+	Time time.Time
+	Mail Mail
+	Err  error
+	// Code and Response are the SMTP reply code and text the server
+	// rejected the message with, if any.
+	Code     int
+	Response string
+	// Labels are the labels of the Mail, if it implements Labeler.
+	Labels map[string]string
+}
+
+// FailureBuffer retains the most recent Failures in memory, so that what just
+// failed and why can be inspected, for example from a debugging endpoint,
+// without going through the logs. It is bounded by Size and MaxAge so it
+// doesn't grow with the number of failures. The zero value retains the last
+// 100 failures, and is safe to use concurrently.
+//
+// Settings must not be changed once failures are being recorded.
+type FailureBuffer struct {
+	// Size is the number of failures retained. Defaults to 100.
+	Size int
+	// MaxAge, if non-zero, is how long failures are retained for.
+	MaxAge time.Duration
+
+	mu       sync.Mutex
+	failures []Failure
+	// next is the index the next failure is stored at once the buffer
+	// is full.
+	next int
+}
+
+func (fb *FailureBuffer) size() int {
+	if fb.Size <= 0 {
+		return 100
+	}
+	return fb.Size
+}
+
+// add records a failure, replacing the oldest one if the buffer is full.
+func (fb *FailureBuffer) add(f Failure) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	if len(fb.failures) < fb.size() {
+		fb.failures = append(fb.failures, f)
+		return
+	}
+	fb.failures[fb.next] = f
+	fb.next = (fb.next + 1) % len(fb.failures)
+}
+
+// RecentFailures returns the failures retained, oldest first.
+func (fb *FailureBuffer) RecentFailures() []Failure {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	recent := make([]Failure, 0, len(fb.failures))
+	recent = append(recent, fb.failures[fb.next:]...)
+	recent = append(recent, fb.failures[:fb.next]...)
+	if fb.MaxAge <= 0 {
+		return recent
+	}
+	cutoff := time.Now().Add(-fb.MaxAge)
+	for i, f := range recent {
+		if f.Time.After(cutoff) {
+			return recent[i:]
+		}
+	}
+	return recent[:0]
+}
+
+// recordFailure adds the error for the Mail to the Processor's Failures, if
+// set.
+func (p *Processor) recordFailure(m Mail, err error) {
+	if p.Failures == nil {
+		return
+	}
+	f := Failure{
+		Time:   time.Now(),
+		Mail:   m,
+		Err:    err,
+		Labels: mailLabels(m),
+	}
+	if te, ok := err.(*textproto.Error); ok {
+		f.Code = te.Code
+		f.Response = te.Msg
+	}
+	p.Failures.add(f)
+}
@@ -0,0 +1,48 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/textproto"
+	"time"
+)
+
+func (ms *MailerSuite) TestFailureBuffer() {
+	fb := &FailureBuffer{Size: 2}
+	p := &Processor{Failures: fb}
+	errs := []error{
+		errors.New("first"),
+		&textproto.Error{Code: 550, Msg: "No such user"},
+		errors.New("third"),
+	}
+	var messages []*mockMessage
+	for _, err := range errs {
+		m := newMockMessage("from@example.com", []string{"to@example.com"}, bytes.NewBufferString("Email"))
+		messages = append(messages, m)
+		p.fail(context.Background(), m, err)
+	}
+
+	// Only the most recent failures are retained
+	recent := fb.RecentFailures()
+	if len(recent) != 2 {
+		ms.T().Fatalf("Unexpected number of failures. Expected %d, Got %d", 2, len(recent))
+	}
+	if recent[0].Mail != messages[1] || recent[1].Mail != messages[2] {
+		ms.T().Fatalf("Unexpected failures. Got %+v", recent)
+	}
+	if recent[0].Code != 550 || recent[0].Response != "No such user" {
+		ms.T().Fatalf("Unexpected SMTP reply. Got %d %q", recent[0].Code, recent[0].Response)
+	}
+	if recent[1].Err != errs[2] {
+		ms.T().Fatalf("Unexpected error. Expected %v, Got %v", errs[2], recent[1].Err)
+	}
+
+	// Failures older than MaxAge are dropped
+	fb.MaxAge = time.Minute
+	fb.failures[fb.next].Time = time.Now().Add(-time.Hour)
+	recent = fb.RecentFailures()
+	if len(recent) != 1 || recent[0].Mail != messages[2] {
+		ms.T().Fatalf("Unexpected failures once expired. Got %+v", recent)
+	}
+}
@@ -0,0 +1,79 @@
+package mailer
+
+import (
+	"context"
+
+	"github.com/gophish/gomail"
+)
+
+// generated is a message generated ahead of being sent.
+type generated struct {
+	message *gomail.Message
+	err     error
+}
+
+// pregenerate starts GenerateWorkers goroutines generating the messages for
+// the provided Mail instances. The returned channels each receive the result
+// for the Mail at the same index. The workers stop picking up new Mail once
+// the context is cancelled, in which case the remaining channels never
+// receive a value.
+func (p *Processor) pregenerate(ctx context.Context, ms []Mail) []chan generated {
+	results := make([]chan generated, len(ms))
+	for i := range results {
+		results[i] = make(chan generated, 1)
+	}
+	jobs := make(chan int, len(ms))
+	for i := range ms {
+		jobs <- i
+	}
+	close(jobs)
+
+	workers := p.GenerateWorkers
+	if workers > len(ms) {
+		workers = len(ms)
+	}
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := range jobs {
+				if ctx.Err() != nil {
+					return
+				}
+				message := gomail.NewMessage(p.MessageSettings...)
+				err := p.generate(ctx, message, ms[i])
+				if ctx.Err() != nil {
+					return
+				}
+				results[i] <- generated{message: message, err: err}
+			}
+		}()
+	}
+	return results
+}
+
+// sendPipelined sends the Mail instances over the connection in order while
+// their messages are generated concurrently by pregenerate. It otherwise
+// behaves like the send loop in processChunk.
+func (p *Processor) sendPipelined(ctx context.Context, conn *connection, ms []Mail, t *tally) {
+	// Stop generating messages we won't get to send if we return early.
+	genCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := p.pregenerate(genCtx, ms)
+	for i, m := range ms {
+		if p.pace(ctx, t, len(ms)) != nil || p.acquireSend(ctx, conn.host) != nil {
+			return
+		}
+		var g generated
+		select {
+		case <-ctx.Done():
+			return
+		case g = <-results[i]:
+		}
+		if g.err != nil {
+			t.add(p.generateFailed(ctx, m, g.err), 1)
+			continue
+		}
+		if !p.send(ctx, conn, g.message, m, ms[i+1:], t) {
+			return
+		}
+	}
+}
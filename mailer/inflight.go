@@ -0,0 +1,185 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+)
+
+// ErrAlreadyInFlight is the reason Mail instances are skipped with when
+// GuardInFlight is set and they are already being sent as part of another
+// batch.
+var ErrAlreadyInFlight = errors.New("mail is already being sent in another batch")
+
+// IdempotencyKeyer is implemented by Mail instances which can identify the
+// message they send, so that GuardInFlight recognizes distinct Mail instances
+// for the same message, such as those loaded twice from a database. Other
+// Mail instances are identified by identity.
+type IdempotencyKeyer interface {
+	IdempotencyKey() string
+}
+
+// idempotencyKey is the in-flight key of Mail instances implementing
+// IdempotencyKeyer.
+type idempotencyKey string
+
+// inFlightKey is the context key of the inFlightOwner of a batch.
+type inFlightKey struct{}
+
+// inFlightOwner identifies the batch Mail instances are in flight for. Parts
+// of the batch held back by a Warmup share it, so they aren't mistaken for
+// duplicates.
+type inFlightOwner uint64
+
+// inFlightHeldKey is the context key set on the parts of a batch held back by
+// a Warmup, whose Mail instances keep the claims of the batch they were part
+// of until they are done with.
+type inFlightHeldKey struct{}
+
+// inFlight is the concurrency-safe set of Mail instances being sent. The zero
+// value is ready to use.
+type inFlight struct {
+	mu    sync.Mutex
+	next  inFlightOwner
+	mails map[interface{}]*inFlightEntry
+}
+
+// inFlightEntry is a Mail in flight, with the number of claims its owner
+// holds on it.
+type inFlightEntry struct {
+	owner inFlightOwner
+	refs  int
+}
+
+// inFlightMailKey returns the key identifying the Mail in flight, and false
+// if it can't be tracked.
+func inFlightMailKey(m Mail) (interface{}, bool) {
+	if ik, ok := m.(IdempotencyKeyer); ok {
+		return idempotencyKey(ik.IdempotencyKey()), true
+	}
+	if !reflect.TypeOf(m).Comparable() {
+		return nil, false
+	}
+	return m, true
+}
+
+// claim marks the Mail instance as in flight for the owner, reporting false
+// if it already is for another owner.
+func (f *inFlight) claim(key interface{}, owner inFlightOwner) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.mails == nil {
+		f.mails = make(map[interface{}]*inFlightEntry)
+	}
+	e, ok := f.mails[key]
+	if !ok {
+		e = &inFlightEntry{owner: owner}
+		f.mails[key] = e
+	}
+	if e.owner != owner {
+		return false
+	}
+	e.refs++
+	return true
+}
+
+// newOwner returns a new inFlightOwner for a batch.
+func (f *inFlight) newOwner() inFlightOwner {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.next++
+	return f.next
+}
+
+// release releases a claim on the Mail instance.
+func (f *inFlight) release(key interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e, ok := f.mails[key]
+	if !ok {
+		return
+	}
+	e.refs--
+	if e.refs == 0 {
+		delete(f.mails, key)
+	}
+}
+
+// claimInFlight marks the Mail instances of a batch as in flight if
+// GuardInFlight is set, skipping those which already are, or which appear
+// more than once in the batch. It returns the context to process the batch
+// with, the Mail instances to send and the function to call once the batch
+// is done with them.
+func (mw *MailWorker) claimInFlight(ctx context.Context, ms []Mail, p *progress) (context.Context, []Mail, func()) {
+	// Held parts already own their claims, which processBatch releases.
+	if !mw.GuardInFlight || heldInFlight(ctx) {
+		return ctx, ms, func() {}
+	}
+	owner, ok := ctx.Value(inFlightKey{}).(inFlightOwner)
+	if !ok {
+		owner = mw.inFlight.newOwner()
+		ctx = context.WithValue(ctx, inFlightKey{}, owner)
+	}
+	var claimed []interface{}
+	seen := make(map[interface{}]bool)
+	kept := make([]Mail, 0, len(ms))
+	for _, m := range ms {
+		key, ok := inFlightMailKey(m)
+		if !ok {
+			kept = append(kept, m)
+			continue
+		}
+		if seen[key] || !mw.inFlight.claim(key, owner) {
+			mw.skip(ctx, m, ErrAlreadyInFlight)
+			p.add(1)
+			continue
+		}
+		seen[key] = true
+		claimed = append(claimed, key)
+		kept = append(kept, m)
+	}
+	return ctx, kept, func() {
+		for _, key := range claimed {
+			mw.inFlight.release(key)
+		}
+	}
+}
+
+// heldInFlight reports whether the batch's Mail instances were handed over
+// with their claims by holdInFlight.
+func heldInFlight(ctx context.Context) bool {
+	held, _ := ctx.Value(inFlightHeldKey{}).(bool)
+	return held
+}
+
+// holdInFlight takes another claim on the Mail instances of a batch about to
+// be held back for later, returning the context to enqueue them with. The
+// claims are released by releaseInFlight once the held batch is done with
+// them, so the Mail instances stay in flight in the meantime rather than
+// being released with the batch they were part of.
+func (mw *MailWorker) holdInFlight(ctx context.Context, ms []Mail) context.Context {
+	owner, ok := ctx.Value(inFlightKey{}).(inFlightOwner)
+	if !mw.GuardInFlight || !ok {
+		return ctx
+	}
+	for _, m := range ms {
+		if key, ok := inFlightMailKey(m); ok {
+			mw.inFlight.claim(key, owner)
+		}
+	}
+	return context.WithValue(ctx, inFlightHeldKey{}, true)
+}
+
+// releaseInFlight releases the claims taken by holdInFlight on the Mail
+// instances of a held batch, if ctx is that of one.
+func (mw *MailWorker) releaseInFlight(ctx context.Context, ms []Mail) {
+	if !mw.GuardInFlight || !heldInFlight(ctx) {
+		return
+	}
+	for _, m := range ms {
+		if key, ok := inFlightMailKey(m); ok {
+			mw.inFlight.release(key)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"time"
+)
+
+// idempotentMessage is a mockMessage with an IdempotencyKey.
+type idempotentMessage struct {
+	*mockMessage
+	key string
+}
+
+func (im *idempotentMessage) IdempotencyKey() string { return im.key }
+
+func (ms *MailerSuite) TestGuardInFlight() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mw := NewMailWorker()
+	mw.GuardInFlight = true
+	results := make(chan Result, 10)
+	mw.OnResult = func(m Mail, r Result) {
+		results <- r
+	}
+	go mw.Start(ctx)
+
+	sending := make(chan struct{}, 10)
+	unblock := make(chan struct{})
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		sender := newMockSender()
+		sender.setSend(func(mm *mockMessage) error {
+			sending <- struct{}{}
+			<-unblock
+			return nil
+		})
+		return sender, nil
+	})
+	newMessage := func(key string) Mail {
+		m := newMockMessage("from@example.com", []string{"to@example.com"}, bytes.NewBufferString("Email"))
+		m.setDialer(func() (Dialer, error) { return dialer, nil })
+		return &idempotentMessage{mockMessage: m, key: key}
+	}
+	expectResult := func(outcome Outcome, err error) {
+		select {
+		case r := <-results:
+			if r.Outcome != outcome || r.Err != err {
+				ms.T().Fatalf("Unexpected result. Expected %s with %v, Got %s with %v", outcome, err, r.Outcome, r.Err)
+			}
+		case <-time.After(time.Second):
+			ms.T().Fatalf("Timed out waiting for a %s result", outcome)
+		}
+	}
+
+	first := newMessage("first")
+	if err := mw.Enqueue([]Mail{first}); err != nil {
+		ms.T().Fatalf("Unexpected error when enqueueing: %s", err)
+	}
+	<-sending
+	// Another Mail for the same message is a duplicate while the first is
+	// being sent, as is a Mail appearing twice in a batch.
+	second := newMessage("second")
+	if err := mw.Enqueue([]Mail{newMessage("first"), second, second}); err != nil {
+		ms.T().Fatalf("Unexpected error when enqueueing: %s", err)
+	}
+	expectResult(OutcomeSkipped, ErrAlreadyInFlight)
+	expectResult(OutcomeSkipped, ErrAlreadyInFlight)
+	<-sending
+	close(unblock)
+	expectResult(OutcomeSuccess, nil)
+	expectResult(OutcomeSuccess, nil)
+	if err := mw.FlushAndWait(context.Background()); err != nil {
+		ms.T().Fatalf("Unexpected error flushing: %s", err)
+	}
+
+	// Once sent, the message may be enqueued again
+	if err := mw.Enqueue([]Mail{first}); err != nil {
+		ms.T().Fatalf("Unexpected error when enqueueing: %s", err)
+	}
+	expectResult(OutcomeSuccess, nil)
+}
+
+func (ms *MailerSuite) TestGuardInFlightWarmup() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mw := NewMailWorker()
+	mw.GuardInFlight = true
+	mw.Warmup = &WarmupPolicy{Window: 200 * time.Millisecond, Schedule: []int{1}}
+	results := make(chan Result, 10)
+	mw.OnResult = func(m Mail, r Result) {
+		results <- r
+	}
+	go mw.Start(ctx)
+
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		sender := newMockSender()
+		sender.setSend(func(*mockMessage) error { return nil })
+		return sender, nil
+	})
+	newMessage := func(key string) Mail {
+		m := newMockMessage("from@example.com", []string{"to@example.com"}, bytes.NewBufferString("Email"))
+		m.setDialer(func() (Dialer, error) { return dialer, nil })
+		return &idempotentMessage{mockMessage: m, key: key}
+	}
+	expectResult := func(outcome Outcome, err error) {
+		select {
+		case r := <-results:
+			if r.Outcome != outcome || r.Err != err {
+				ms.T().Fatalf("Unexpected result. Expected %s with %v, Got %s with %v", outcome, err, r.Outcome, r.Err)
+			}
+		case <-time.After(time.Second):
+			ms.T().Fatalf("Timed out waiting for a %s result", outcome)
+		}
+	}
+
+	// The second message waits for the next window
+	if err := mw.Enqueue([]Mail{newMessage("first"), newMessage("second")}); err != nil {
+		ms.T().Fatalf("Unexpected error when enqueueing: %s", err)
+	}
+	expectResult(OutcomeSuccess, nil)
+	if err := mw.FlushAndWait(ctx); err != nil {
+		ms.T().Fatalf("Unexpected error flushing: %s", err)
+	}
+
+	// It is still in flight while deferred
+	if err := mw.Enqueue([]Mail{newMessage("second")}); err != nil {
+		ms.T().Fatalf("Unexpected error when enqueueing: %s", err)
+	}
+	expectResult(OutcomeSkipped, ErrAlreadyInFlight)
+	expectResult(OutcomeSuccess, nil)
+
+	// And released once the deferred part is done with it
+	deadline := time.Now().Add(time.Second)
+	for {
+		mw.inFlight.mu.Lock()
+		n := len(mw.inFlight.mails)
+		mw.inFlight.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			ms.T().Fatalf("Mail is still in flight after being sent. Got %d in flight", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
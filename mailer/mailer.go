@@ -3,10 +3,12 @@ package mailer
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"log"
-	"net/textproto"
 	"os"
+	"reflect"
+	"sync"
 	"time"
 
 	"github.com/gophish/gomail"
@@ -22,6 +24,50 @@ var MaxReconnectAttempts = 10
 // is reached.
 var ErrMaxConnectAttempts = errors.New("max connection attempts reached")
 
+// ErrShutdown is returned by Enqueue when the worker is no longer accepting
+// mail because its context has been cancelled.
+var ErrShutdown = errors.New("mail worker has been shut down")
+
+// ErrEmptyBatch is returned by Enqueue when given no Mail instances.
+var ErrEmptyBatch = errors.New("batch contains no mail")
+
+// ErrNilMail is returned by Enqueue when given a nil Mail instance.
+var ErrNilMail = errors.New("batch contains a nil mail")
+
+// ErrMixedDialers is returned by Enqueue when ValidateDialers is set and the
+// Mail instances of a batch don't all connect to the same host.
+var ErrMixedDialers = errors.New("batch mixes mail for different hosts")
+
+// ErrNoRecipients is reported as the Err of the Result of a Mail whose message
+// has no recipients left once generated and redirected. Such Mail is skipped
+// without attempting to send it, and none of its Success, Backoff or Error
+// methods are called.
+var ErrNoRecipients = errors.New("message has no recipients")
+
+// ErrChunkBackedOff is the reason the Mail instances of a chunk are backed
+// off with without being sent when another message of the chunk was backed off
+// and AtomicChunks is set.
+var ErrChunkBackedOff = errors.New("another message of the chunk was backed off")
+
+// ErrUnsupportedRecipient is the error Mail fails with when its sender or one
+// of its recipients has a non-ASCII address but the server doesn't advertise
+// the SMTPUTF8 extension needed to send to it. The message isn't attempted.
+var ErrUnsupportedRecipient = errors.New("address requires SMTPUTF8, which the server doesn't support")
+
+// ErrRecipientCooldown is the reason Mail instances are backed off or skipped
+// with when one of their recipients was sent to less than the Processor's
+// RecipientCooldown ago.
+var ErrRecipientCooldown = errors.New("recipient was sent to too recently")
+
+// ErrHostCancelled is the reason Mail instances are backed off with when
+// CancelHost is called for the host they were going to be sent to.
+var ErrHostCancelled = errors.New("sending to the host was cancelled")
+
+// ErrBatchDeadline is the reason Mail instances are backed off with when the
+// deadline of a batch enqueued with EnqueueWithDeadline passes before they
+// are sent.
+var ErrBatchDeadline = errors.New("batch deadline passed")
+
 // Logger is the logger for the worker
 var Logger = log.New(os.Stdout, " ", log.Ldate|log.Ltime|log.Lshortfile)
 
@@ -32,12 +78,124 @@ type Sender interface {
 	Reset() error
 }
 
+// CompressionSender is implemented by Senders which can report whether their
+// connection negotiated compression, and with which algorithm. The worker
+// logs this for every new connection and counts compressed connections in
+// HostStats.
+type CompressionSender interface {
+	Compression() (algorithm string, ok bool)
+}
+
+// ChunkingSender is implemented by Senders which can report whether the
+// server advertised the CHUNKING extension (RFC 3030), and whether they use it
+// to send messages with BDAT rather than DATA. The worker logs this for every
+// new connection and counts chunking connections in HostStats.
+type ChunkingSender interface {
+	Chunking() (advertised, enabled bool)
+}
+
+// RecipientSender is implemented by Senders which can send a message to the
+// recipients the server accepts even though it rejects others. The worker
+// uses SendRecipients instead of Send for these Senders, returning the
+// rejected recipients with the server's reply. If every recipient is
+// rejected, an error is returned instead.
+type RecipientSender interface {
+	SendRecipients(from string, to []string, msg io.WriterTo) (rejected map[string]error, err error)
+}
+
+// ResponseSender is implemented by Senders which can report the reply the
+// server sent after accepting the last message, which often contains the
+// queue ID the server assigned to it. The worker passes the reply to the
+// OnResult hook of successfully sent Mail.
+type ResponseSender interface {
+	LastResponse() string
+}
+
+// UTF8Sender is implemented by Senders which know whether the server
+// advertises the SMTPUTF8 extension (RFC 6531). When it doesn't, the worker
+// fails Mail addressed from or to a non-ASCII address with
+// ErrUnsupportedRecipient rather than letting the server reject it. Messages
+// are handed to Senders which don't implement UTF8Sender regardless.
+type UTF8Sender interface {
+	SMTPUTF8() bool
+}
+
+// TimingSender is implemented by Senders which measure how long the phases of
+// sending a message take, such as the one returned by SMTPDialer. The worker
+// passes the timings of every attempt to the AuditFunc, and those of sent
+// messages to the OnResult hook, to help tell whether slowness comes from
+// the network, TLS or the server.
+type TimingSender interface {
+	LastTimings() SendTimings
+}
+
+// FlushSender is implemented by Senders which buffer what they send, such as
+// file based sinks. The worker calls Flush after every message the Sender
+// accepted, and treats a Flush error as a failure to send the message.
+// Success is only called once Flush returns, so a Sender which makes
+// messages durable in Flush guarantees that success is never reported for a
+// message which a crash could still lose. Copies sent to the
+// ArchiveRecipient are flushed too.
+type FlushSender interface {
+	Flush() error
+}
+
+// NoopSender is implemented by Senders which can check that the server is
+// still responding without sending a message, such as with the SMTP NOOP
+// command. Probe uses it to make sure the server answers once connected.
+type NoopSender interface {
+	Noop() error
+}
+
+// ExtensionSender is implemented by Senders which can report the service
+// extensions the server advertised in its reply to EHLO, keyed by extension
+// keyword with their parameters as values. The worker captures them in the
+// Capabilities of every new connection, which are passed to the OnConnect
+// hook and reported by Probe.
+type ExtensionSender interface {
+	Extensions() map[string]string
+}
+
 // Dialer dials to an SMTP server and returns the SendCloser
 type Dialer interface {
 	Dial() (Sender, error)
 }
 
-// Mail is an interface that handles the common operations for email messages
+// FingerprintDialer is implemented by Dialers which can tell when another
+// Dialer connects to the same server with the same settings and credentials.
+// Dialers returning the same Fingerprint may share connections even if they
+// are distinct instances, both within a batch when PerMessageDialers is set
+// and across batches when IdleConnectionTimeout is set. Dialers which don't
+// implement it only share connections when they are equal.
+type FingerprintDialer interface {
+	Fingerprint() string
+}
+
+// fingerprintKey is the key of Dialers sharing a Fingerprint.
+type fingerprintKey string
+
+// dialerKey returns the key grouping Dialers which may share connections,
+// and false if the Dialer can't be grouped with any other.
+func dialerKey(d Dialer) (interface{}, bool) {
+	if fd, ok := d.(FingerprintDialer); ok {
+		return fingerprintKey(fd.Fingerprint()), true
+	}
+	if reflect.TypeOf(d).Comparable() {
+		return d, true
+	}
+	return nil, false
+}
+
+// Mail is an interface that handles the common operations for email messages.
+//
+// The worker never calls the Backoff, Error and Success methods of the same
+// Mail instance concurrently, even if it was enqueued in more than one batch.
+// Mail instances which share state with each other, such as the messages of a
+// campaign, can implement CallbackGrouper to extend this guarantee to the
+// whole group.
+//
+// Success is called once the Sender has accepted the message, and flushed it
+// if the Sender implements FlushSender, before the connection is closed.
 type Mail interface {
 	Backoff(reason error) error
 	Error(err error) error
@@ -46,6 +204,61 @@ type Mail interface {
 	GetDialer() (Dialer, error)
 }
 
+// ContextGenerator is implemented by Mail instances which need the context of
+// their batch when generating the message, for example to read the values of
+// the context passed to EnqueueContext. The worker calls GenerateContext
+// instead of Generate for these Mail instances.
+type ContextGenerator interface {
+	GenerateContext(ctx context.Context, msg *gomail.Message) error
+}
+
+// ReconnectLimiter is implemented by Mail instances which need a different
+// number of connection attempts than MaxReconnectAttempts. The value returned
+// by the first Mail in a batch applies to the whole batch, which lets
+// latency-sensitive messages fail fast while bulk campaigns keep trying.
+// Values less than 1 are ignored.
+type ReconnectLimiter interface {
+	MaxReconnects() int
+}
+
+// ConnectionKeyer is implemented by Mail instances whose connections may be
+// kept open between batches when the worker's IdleConnectionTimeout is set,
+// for example to trickle the messages of a campaign in small batches over a
+// single connection. Chunks for the same host share a connection when their
+// first Mail returns the same key, so the key must identify the sending
+// profile the Dialer authenticates with.
+type ConnectionKeyer interface {
+	ConnectionKey() string
+}
+
+// CallbackGrouper is implemented by Mail instances which share state with
+// other Mail instances. The Backoff, Error and Success methods of Mail
+// instances returning equal CallbackGroup values are never called
+// concurrently. The returned value must be comparable.
+type CallbackGrouper interface {
+	CallbackGroup() interface{}
+}
+
+// Labeler is implemented by Mail instances which carry labels, such as the
+// campaign, segment or A/B variant they belong to. The labels are passed to
+// the OnResult hook and the AuditFunc, and included in the worker's logs
+// about the message, so deliverability can be analysed per label without
+// separate bookkeeping. Metrics backends usually create a time series for
+// every distinct set of labels, so avoid exporting labels with unbounded
+// values, such as recipient addresses, as metric labels.
+type Labeler interface {
+	Labels() map[string]string
+}
+
+// HeaderProvider is implemented by Mail instances which need additional
+// headers set on their message, such as a per-recipient List-Unsubscribe
+// header. ExtraHeaders is called after Generate, and its headers replace any
+// of the same name set by Generate unless the worker's KeepGeneratedHeaders
+// is set.
+type HeaderProvider interface {
+	ExtraHeaders() map[string][]string
+}
+
 // Mailer is a global instance of the mailer that can
 // be used in applications. It is the responsibility of the application
 // to call Mailer.Start()
@@ -60,66 +273,819 @@ func init() {
 // to be sent to the same server.
 type MailWorker struct {
 	Queue chan []Mail
+	// batches receives the batches handed to the worker by Enqueue.
+	batches chan batch
+
+	// OnProgress, if set, is called as the messages in a batch are processed
+	// with the number of messages processed so far and the size of the batch.
+	// Messages count as processed whether they were sent, backed off or
+	// errored.
+	OnProgress func(sent, total int)
+	// ProgressEvery is the number of processed messages between calls to
+	// OnProgress. Values less than 1 report every message.
+	ProgressEvery int
+	// MaxBatchSize is the largest batch Enqueue hands to the worker at once.
+	// Larger slices are split so that each part can be processed
+	// independently. Zero means no limit.
+	MaxBatchSize int
+	// FailFast makes the worker give up on the rest of a batch as soon as
+	// it fails to connect for one of its chunks, erroring out every
+	// remaining message instead of trying again for the next chunk. This
+	// is most useful for small, interactive batches such as test emails.
+	FailFast bool
+	// GetDialerRetries is the number of times GetDialer is retried when it
+	// fails, for example because the sending profile couldn't be loaded.
+	// The first retry waits GetDialerRetryDelay, with the delay doubling
+	// for every subsequent retry.
+	GetDialerRetries    int
+	GetDialerRetryDelay time.Duration
+	// BackoffOnDialerError makes the worker back off the Mail instances of
+	// a chunk when GetDialer keeps failing, so they can be retried later,
+	// rather than erroring them out.
+	BackoffOnDialerError bool
+	// ValidateDialers makes Enqueue check that every Mail instance of a
+	// batch connects to the same host, as reported by the Address of their
+	// Dialer, since the whole batch is sent using the first one's.
+	ValidateDialers bool
+	// Warmup, if set, caps how many messages are sent to each host per
+	// window following a ramp-up schedule, to warm up new sending IPs.
+	// Batches exceeding the cap are held until the next window.
+	Warmup *WarmupPolicy
+	// IgnoreCancelledBatches makes the worker leave the Mail instances of a
+	// batch untouched when it is shut down before the batch starts being
+	// sent, or while waiting MailDelayTime between two of its chunks. By
+	// default they are backed off so they can be retried later.
+	IgnoreCancelledBatches bool
+	// OnIdle, if set, is called whenever the worker runs out of work: every
+	// batch it received has been processed and none is scheduled for later
+	// or part way through being enqueued. It is called from the Start loop,
+	// so it must not block or enqueue more mail itself. Batches sent on
+	// Queue one after the other may each be followed by a call.
+	OnIdle func()
+	// PerMessageDialers makes the worker get the Dialer of every Mail in a
+	// batch rather than only the first one's for each chunk. The Mail are
+	// grouped by Dialer, and each group is sent over its own connections,
+	// so a batch can mix messages for different sending profiles. Dialers
+	// are grouped when they are equal or share a Fingerprint (see
+	// FingerprintDialer), so other Dialers returned as pointers must be
+	// shared between Mail instances to share a connection.
+	PerMessageDialers bool
+	// Scheduling is the order in which the Mail instances of every batch
+	// are sent, which matters most when sending is rate limited. It
+	// defaults to ScheduleFIFO. Batches are scheduled independently of
+	// each other.
+	Scheduling SchedulingStrategy
+	// GuardInFlight makes the worker skip Mail instances which are already
+	// being sent as part of another batch, or which appear more than once
+	// in a batch, reporting them with OutcomeSkipped and
+	// ErrAlreadyInFlight. Mail instances are identified by their
+	// IdempotencyKey if they implement IdempotencyKeyer, and by identity
+	// otherwise. This protects campaigns from producers enqueueing the same
+	// Mail twice.
+	GuardInFlight bool
+	// Clock, if set, provides the timers used to wait MailDelayTime between
+	// chunks. It defaults to the system clock.
+	Clock Clock
+	// ApprovalFunc, if set, is called once for every batch before anything
+	// is dialed, and may block until the batch is approved, for example by
+	// a human reviewing the campaign. If it returns an error the batch's
+	// mail is errored out with it, or backed off if BackoffUnapproved is
+	// set. ApprovalFunc should return promptly once its context is
+	// cancelled, after which the batch is handled as if the worker had been
+	// shut down before it started.
+	ApprovalFunc func(ctx context.Context, b BatchInfo) error
+	// BackoffUnapproved makes the worker back off rather than error out the
+	// mail of batches ApprovalFunc returned an error for.
+	BackoffUnapproved bool
+	// AlignmentChecker, if set, checks the sender domains of every batch
+	// before anything is dialed, for the Mail instances implementing
+	// SenderDomainer. Problems are logged, unless EnforceAlignment is set,
+	// in which case the batch is handled as if ApprovalFunc had returned
+	// the error.
+	AlignmentChecker *AlignmentChecker
+	EnforceAlignment bool
+	// OnBatchFailed, if set, is called once for every batch for which we
+	// couldn't get a Dialer or connect to the host for any of its chunks,
+	// with the last error which kept us from doing so. The
+	// Mail instances are still handled with their Error or Backoff methods
+	// as usual, but a single call is a clearer sign of a misconfigured
+	// sending profile than an error for every message. It is called from
+	// the goroutine processing the batch, once it is done.
+	OnBatchFailed func(err error, b BatchInfo)
+	// OnBatchDone, if set, is called with the BatchSummary of every batch
+	// once it has been processed, from the goroutine which processed it.
+	// The parts of a batch held back by a Warmup are summarized separately.
+	OnBatchDone func(s BatchSummary)
+	// OnCampaignComplete, if set, is called once all the batches enqueued
+	// for a campaign with EnqueueCampaign have been processed, with the
+	// merged BatchSummary of all of them, from the goroutine which
+	// processed the last one. Campaigns with batches left over when the
+	// worker is shut down never complete.
+	OnCampaignComplete func(key string, s BatchSummary)
+
+	// Processor sends the chunks of every batch, and its settings apply
+	// to all of them.
+	Processor
+
+	warmup   warmupTracker
+	flushes  chan chan (<-chan struct{})
+	running  activity
+	done     chan struct{}
+	doneOnce sync.Once
+
+	// sending tracks the chunks being sent so CancelHost can cancel them,
+	// and hostCancels hands its host to the Start loop.
+	hostCancels chan string
+	sending     hostRegistry
+
+	// enqueuing counts the calls to enqueueBatches in progress.
+	enqueuing activity
+
+	// campaigns tracks the outstanding batches of every campaign.
+	campaigns campaigns
+	// inFlight holds the Mail instances being sent when GuardInFlight is
+	// set.
+	inFlight inFlight
 }
 
 // NewMailWorker returns an instance of MailWorker with the mail queue
 // initialized.
 func NewMailWorker() *MailWorker {
 	return &MailWorker{
-		Queue: make(chan []Mail),
+		Queue:       make(chan []Mail),
+		batches:     make(chan batch),
+		flushes:     make(chan chan (<-chan struct{})),
+		done:        make(chan struct{}),
+		hostCancels: make(chan string),
+	}
+}
+
+// Enqueue hands the provided slice of Mail instances to the worker. Unlike
+// sending on Queue directly, Enqueue won't block forever if the worker is shut
+// down while waiting: it returns ErrShutdown instead.
+//
+// If MaxBatchSize is set, larger slices are split into consecutive batches of
+// at most MaxBatchSize messages which are enqueued in order. If the worker is
+// shut down part way through, the batches enqueued until then are still sent.
+func (mw *MailWorker) Enqueue(ms []Mail) error {
+	return mw.EnqueueContext(context.Background(), ms)
+}
+
+// EnqueueContext is like Enqueue, but the values of ctx, such as trace IDs,
+// are made available while the batch is processed: to Mail instances
+// implementing ContextGenerator and to the OnResult hook through
+// Result.Context. Cancelling ctx doesn't cancel the batch, which only stops
+// when the worker does.
+func (mw *MailWorker) EnqueueContext(ctx context.Context, ms []Mail) error {
+	return mw.enqueueBatches(batch{ctx: ctx, mails: ms})
+}
+
+// EnqueueAt is like Enqueue, but the worker holds on to the batch and doesn't
+// start sending it before sendTime. Batches which are still waiting when the
+// worker is shut down are left untouched.
+func (mw *MailWorker) EnqueueAt(sendTime time.Time, ms []Mail) error {
+	return mw.enqueueBatches(batch{ctx: context.Background(), mails: ms, notBefore: sendTime})
+}
+
+// enqueueBatches hands the batch to the worker after validating it, first
+// splitting it according to MaxBatchSize.
+func (mw *MailWorker) enqueueBatches(b batch) error {
+	if err := mw.validate(b.mails); err != nil {
+		return err
+	}
+	// The worker mustn't report being idle between the parts of the batch.
+	mw.enqueuing.add()
+	defer mw.enqueuing.done()
+	for mw.MaxBatchSize > 0 && len(b.mails) > mw.MaxBatchSize {
+		part := b
+		part.mails = b.mails[:mw.MaxBatchSize]
+		err := mw.enqueue(part)
+		if err != nil {
+			return err
+		}
+		b.mails = b.mails[mw.MaxBatchSize:]
+	}
+	return mw.enqueue(b)
+}
+
+// validate checks that the Mail instances can be sent as a batch, so that
+// mistakes are reported to the caller of Enqueue rather than once the batch is
+// being processed.
+func (mw *MailWorker) validate(ms []Mail) error {
+	if len(ms) == 0 {
+		return ErrEmptyBatch
+	}
+	for i, m := range ms {
+		if m == nil {
+			return fmt.Errorf("%w at index %d", ErrNilMail, i)
+		}
+	}
+	if !mw.ValidateDialers {
+		return nil
+	}
+	var host string
+	for i, m := range ms {
+		dialer, err := m.GetDialer()
+		if err != nil {
+			return fmt.Errorf("getting dialer of mail at index %d: %w", i, err)
+		}
+		addr := dialerAddress(dialer)
+		if i == 0 {
+			host = addr
+			continue
+		}
+		if addr != host {
+			return fmt.Errorf("%w: mail at index %d is for %s rather than %s", ErrMixedDialers, i, addr, host)
+		}
+	}
+	return nil
+}
+
+// enqueue hands a single batch to the worker.
+func (mw *MailWorker) enqueue(b batch) error {
+	b.ctx = withStreamPart(b.ctx)
+	key, tracked := mw.campaignOf(b.ctx)
+	if tracked {
+		mw.campaigns.add(key)
 	}
+	select {
+	case mw.batches <- b:
+		return nil
+	case <-mw.done:
+		endStreamPart(b.ctx)
+		if tracked {
+			mw.campaignDone(key, BatchSummary{})
+		}
+		return ErrShutdown
+	}
+}
+
+// shutdown marks the worker as no longer accepting mail, releasing any
+// producers blocked in Enqueue.
+func (mw *MailWorker) shutdown() {
+	mw.doneOnce.Do(func() {
+		close(mw.done)
+	})
 }
 
 // Start launches the mail worker to begin listening on the Queue channel
 // for new slices of Mail instances to process.
 func (mw *MailWorker) Start(ctx context.Context) {
+	pending := &schedule{}
+	// idle is closed once the batches dispatched so far are processed. It
+	// is only armed when there is an OnIdle hook to call.
+	var idle <-chan struct{}
 	for {
 		select {
 		case <-ctx.Done():
+			for _, b := range pending.drain() {
+				mw.releaseInFlight(b.ctx, b.mails)
+				endStreamPart(b.ctx)
+			}
+			mw.shutdown()
+			mw.CloseIdleConnections()
 			return
 		case ms := <-mw.Queue:
-			go func(ctx context.Context, ams []Mail) {
-				Logger.Printf("Mailer got %d mail to send", len(ams))
-
-				for len(ams) > MailChunkSize {
-					ms := ams[:MailChunkSize]
-					dialer, err := ms[0].GetDialer()
-					if err != nil {
-						errorMail(err, ms)
-						return
-					}
-					sendMail(ctx, dialer, ms)
-					time.Sleep(MailDelayTime)
-					ams = ams[MailChunkSize:]
-				}
+			mw.dispatch(ctx, ms)
+		case b := <-mw.batches:
+			if time.Now().Before(b.notBefore) {
+				pending.add(b)
+				continue
+			}
+			mw.dispatch(batchContext{Context: ctx, values: b.ctx}, b.mails)
+		case now := <-pending.C():
+			for _, b := range pending.due(now) {
+				mw.dispatch(batchContext{Context: ctx, values: b.ctx}, b.mails)
+			}
+		case reply := <-mw.flushes:
+			reply <- mw.running.wait()
+		case host := <-mw.hostCancels:
+			if pending.len() > 0 {
+				mw.running.add()
+				go func(batches []batch) {
+					defer mw.running.done()
+					mw.cancelPending(ctx, host, batches)
+				}(pending.drain())
+			}
+		case <-idle:
+			idle = nil
+			// More work is on its way, and dispatching it re-arms idle.
+			if pending.len() == 0 && !mw.enqueuing.active() {
+				mw.OnIdle()
+			}
+		}
+		if mw.OnIdle != nil && idle == nil && mw.running.active() {
+			idle = mw.running.wait()
+		}
+	}
+}
+
+// dispatch starts processing a batch in its own goroutine.
+func (mw *MailWorker) dispatch(ctx context.Context, ms []Mail) {
+	mw.running.add()
+	go func() {
+		defer mw.running.done()
+		ctx = mw.withSummary(ctx, ms)
+		mw.processBatch(ctx, ms)
+		mw.batchDone(ctx)
+		endStreamPart(ctx)
+	}()
+}
+
+// FlushAndWait blocks until every batch handed to the worker so far, whether
+// through Enqueue or by sending on Queue, has been processed. The worker
+// keeps running and accepting new batches while we wait. Batches held by
+// EnqueueAt are only waited for once their send time has come.
+//
+// FlushAndWait returns the context's error if it is cancelled first, and
+// ErrShutdown if the worker has stopped.
+func (mw *MailWorker) FlushAndWait(ctx context.Context) error {
+	// The request goes through the Start loop so that any batch it has
+	// already received is accounted for.
+	reply := make(chan (<-chan struct{}), 1)
+	select {
+	case mw.flushes <- reply:
+	case <-mw.done:
+		return ErrShutdown
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	idle := <-reply
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// CancelHost stops sending to the host, as reported by the Address of the
+// Dialer, without affecting other hosts, for example while a relay is down.
+// The Mail instances of the batches being sent to the host which haven't been
+// sent yet, and of the batches held by EnqueueAt or a Warmup for the host, are
+// backed off with ErrHostCancelled so they can be enqueued again once the host
+// recovers. A message which is being sent when CancelHost is called is
+// finished first. Batches enqueued afterwards are sent as usual.
+//
+// CancelHost returns ErrShutdown if the worker has stopped.
+func (mw *MailWorker) CancelHost(host string) error {
+	mw.sending.cancel(host)
+	// The scheduled batches belong to the Start loop.
+	select {
+	case mw.hostCancels <- host:
+		return nil
+	case <-mw.done:
+		return ErrShutdown
+	}
+}
 
-				if len(ams) == 0 {
-					return
+// cancelPending backs off the Mail instances of the scheduled batches which
+// are going to be sent to host, and schedules the rest again.
+func (mw *MailWorker) cancelPending(ctx context.Context, host string, batches []batch) {
+	for _, b := range batches {
+		bctx := batchContext{Context: ctx, values: b.ctx}
+		var keep, cancelled []Mail
+		switch {
+		case mw.PerMessageDialers:
+			for _, m := range b.mails {
+				if mw.sendsTo(bctx, m, host) {
+					mw.backoff(bctx, m, ErrHostCancelled)
+					cancelled = append(cancelled, m)
+					continue
 				}
+				keep = append(keep, m)
+			}
+		// Otherwise the first Mail's Dialer is used for the whole batch.
+		case mw.sendsTo(bctx, b.mails[0], host):
+			for _, m := range b.mails {
+				mw.backoff(bctx, m, ErrHostCancelled)
+			}
+			cancelled = b.mails
+		default:
+			keep = b.mails
+		}
+		// The rescheduled part keeps the claims on its Mail instances.
+		mw.releaseInFlight(b.ctx, cancelled)
+		if len(keep) > 0 {
+			rescheduled := b
+			rescheduled.mails = keep
+			if err := mw.enqueue(rescheduled); err != nil {
+				Logger.Printf("Failed to reschedule %d mail: %s\n", len(keep), err)
+				mw.releaseInFlight(b.ctx, keep)
+			}
+		}
+		// The rescheduled part, if any, now stands for the batch in its
+		// campaign.
+		if key, tracked := mw.campaignOf(b.ctx); tracked {
+			s := BatchSummary{}
+			s.Backoffs = len(b.mails) - len(keep)
+			mw.campaignDone(key, s)
+		}
+		endStreamPart(b.ctx)
+	}
+}
+
+// sendsTo returns whether the Mail instance is sent to host. Mail for which we
+// can't get a Dialer is assumed not to be.
+func (mw *MailWorker) sendsTo(ctx context.Context, m Mail, host string) bool {
+	dialer, err := mw.getDialer(ctx, m)
+	return err == nil && dialerAddress(dialer) == host
+}
+
+// batch is a slice of Mail instances enqueued together with the context
+// passed to EnqueueContext.
+type batch struct {
+	ctx   context.Context
+	mails []Mail
+	// notBefore is the time passed to EnqueueAt, if any.
+	notBefore time.Time
+}
+
+// BatchInfo describes a batch waiting for the worker's ApprovalFunc, or
+// passed to its OnBatchFailed hook.
+type BatchInfo struct {
+	// Mail are the Mail instances of the batch which are going to be
+	// sent, once those opting out through Filterer are removed.
+	Mail []Mail
+}
 
-				dialer, err := ams[0].GetDialer()
-				if err != nil {
-					errorMail(err, ams)
-					return
+// approve checks the sender domains of the batch with the worker's
+// AlignmentChecker and waits for the batch to be approved, if the worker has
+// an ApprovalFunc.
+func (mw *MailWorker) approve(ctx context.Context, ams []Mail) error {
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err := mw.checkAlignment(ctx, ams); err != nil {
+		return err
+	}
+	if mw.ApprovalFunc == nil {
+		return nil
+	}
+	return mw.ApprovalFunc(ctx, BatchInfo{Mail: ams})
+}
+
+// batchContext is the context a batch is processed with. It is cancelled when
+// the worker's context is, but carries the values of the context the batch
+// was enqueued with.
+type batchContext struct {
+	context.Context
+	values context.Context
+}
+
+// Value returns the value for key from the context the batch was enqueued
+// with, falling back to the worker's context.
+func (c batchContext) Value(key interface{}) interface{} {
+	if v := c.values.Value(key); v != nil {
+		return v
+	}
+	return c.Context.Value(key)
+}
+
+// processBatch sends a slice of Mail instances received on the Queue, splitting
+// it into chunks of MailChunkSize and waiting MailDelayTime between each chunk.
+func (mw *MailWorker) processBatch(ctx context.Context, ams []Mail) {
+	Logger.Printf("Mailer got %d mail to send", len(ams))
+	if mw.RedirectFunc != nil {
+		Logger.Println("WARNING: recipient redirection is enabled, mail will not be sent to the original recipients")
+	}
+	p := mw.newProgress(len(ams))
+	defer mw.releaseInFlight(ctx, ams)
+
+	ams = mw.filterMail(ctx, ams, p)
+	ctx, ams, release := mw.claimInFlight(ctx, ams, p)
+	defer release()
+	if len(ams) == 0 {
+		return
+	}
+	ams = mw.schedule(ams)
+	if err := mw.approve(ctx, ams); err != nil && ctx.Err() == nil {
+		Logger.Printf("Batch of %d mail wasn't approved: %s\n", len(ams), err)
+		if mw.BackoffUnapproved {
+			for _, m := range ams {
+				mw.backoff(ctx, m, err)
+			}
+		} else {
+			mw.errorMail(ctx, err, ams)
+		}
+		p.add(len(ams))
+		return
+	}
+	// If we're shutting down before we got started, there's no point
+	// connecting for a batch we won't get to send.
+	if ctx.Err() != nil {
+		mw.cancelled(ctx, ams, p)
+		return
+	}
+	f := &dialFailure{}
+	defer mw.batchFailed(f, ams)
+	if !mw.PerMessageDialers {
+		mw.sendChunks(ctx, ams, nil, p, f)
+		return
+	}
+	groups := mw.groupByDialer(ctx, ams, p, f)
+	for i, g := range groups {
+		if ctx.Err() != nil {
+			for _, rest := range groups[i:] {
+				mw.cancelled(ctx, rest.mails, p)
+			}
+			return
+		}
+		if err := mw.sendChunks(ctx, g.mails, g.dialer, p, f); err != nil {
+			for _, rest := range groups[i+1:] {
+				mw.errorMail(ctx, err, rest.mails)
+				p.add(len(rest.mails))
+			}
+			return
+		}
+	}
+}
+
+// sendChunks sends the Mail instances in chunks of MailChunkSize using the
+// given Dialer, or the Dialer of each chunk's first Mail if nil. It returns
+// the error which stopped it if FailFast is set. Whether the chunks got to
+// connect is recorded in f.
+func (mw *MailWorker) sendChunks(ctx context.Context, ams []Mail, dialer Dialer, p *progress, f *dialFailure) error {
+	attempts := maxReconnects(ams[0])
+	resolve := dialer == nil
+	// Every chunk is sent with a context CancelHost can cancel, and which
+	// expires with the batch's deadline.
+	release := func() {}
+	defer func() { release() }()
+	dctx, cancel := withBatchDeadline(ctx)
+	defer cancel()
+	for len(ams) > 0 {
+		ms := ams
+		if len(ms) > MailChunkSize {
+			ms = ams[:MailChunkSize]
+		}
+		if resolve {
+			var err error
+			dialer, err = mw.getDialer(ctx, ms[0])
+			if err != nil {
+				mw.dialerFailed(ctx, err, ms)
+				p.add(len(ms))
+				f.fail(err)
+				return nil
+			}
+		}
+		// Once the host's warmup cap is reached, the rest of the batch
+		// waits for the next window.
+		deferred := false
+		host := dialerAddress(dialer)
+		summarizeHost(ctx, host)
+		if granted, next := mw.takeWarmup(host, len(ms), time.Now()); granted < len(ms) {
+			mw.deferWarmup(ctx, host, ams[granted:], next)
+			// The deferred mail is tracked by the batch it's enqueued as.
+			p.drop(len(ams) - granted)
+			ms, ams, deferred = ms[:granted], ams[:granted], true
+		}
+		release()
+		var sendCtx context.Context
+		sendCtx, release = mw.sending.register(dctx, host)
+		if mw.hostCancelled(ctx, sendCtx, ams, p) {
+			return nil
+		}
+		if len(ms) > 0 {
+			stats := mw.processChunk(sendCtx, dialer, ms, attempts, p)
+			flushChunk(ctx, stats.Err)
+			f.record(stats)
+			if mw.hostCancelled(ctx, sendCtx, ams[stats.Total():], p) {
+				return nil
+			}
+			if stats.Err != nil && mw.FailFast {
+				mw.errorMail(ctx, stats.Err, ams[len(ms):])
+				p.add(len(ams[len(ms):]))
+				return stats.Err
+			}
+		}
+		ams = ams[len(ms):]
+		if len(ams) > 0 && !deferred {
+			if err := mw.wait(sendCtx, MailDelayTime); err != nil {
+				if !mw.hostCancelled(ctx, sendCtx, ams, p) {
+					mw.cancelled(ctx, ams, p)
 				}
-				sendMail(ctx, dialer, ams)
-			}(ctx, ms)
+				return nil
+			}
 		}
 	}
+	return nil
 }
 
-// errorMail is a helper to handle erroring out a slice of Mail instances
-// in the case that an unrecoverable error occurs.
-func errorMail(err error, ms []Mail) {
+// cancelled handles the Mail instances of a batch which we won't get to send
+// because the worker is shutting down, backing them off unless
+// IgnoreCancelledBatches is set.
+func (mw *MailWorker) cancelled(ctx context.Context, ams []Mail, p *progress) {
+	if mw.IgnoreCancelledBatches {
+		return
+	}
+	for _, m := range ams {
+		mw.backoff(ctx, m, ctx.Err())
+	}
+	p.add(len(ams))
+}
+
+// hostCancelled backs off the Mail instances of a batch which we won't get to
+// send because CancelHost cancelled sendCtx or the batch's deadline passed,
+// reporting whether it did. If the worker is shutting down, the Mail instances
+// are left to cancelled instead.
+func (mw *MailWorker) hostCancelled(ctx, sendCtx context.Context, ams []Mail, p *progress) bool {
+	if sendCtx.Err() == nil || ctx.Err() != nil {
+		return false
+	}
+	reason := ErrHostCancelled
+	if sendCtx.Err() == context.DeadlineExceeded {
+		reason = ErrBatchDeadline
+	}
+	for _, m := range ams {
+		mw.backoff(ctx, m, reason)
+	}
+	p.add(len(ams))
+	return true
+}
+
+// dialerGroup holds the Mail instances of a batch which share a Dialer.
+type dialerGroup struct {
+	dialer Dialer
+	mails  []Mail
+}
+
+// groupByDialer resolves the Dialer of every Mail instance, grouping those
+// with equal Dialers or Fingerprints in the order they first appear. Mail for
+// which we couldn't get a Dialer is handled right away.
+func (mw *MailWorker) groupByDialer(ctx context.Context, ams []Mail, p *progress, f *dialFailure) []dialerGroup {
+	var groups []dialerGroup
+	index := make(map[interface{}]int)
+	for _, m := range ams {
+		dialer, err := mw.getDialer(ctx, m)
+		if err != nil {
+			mw.dialerFailed(ctx, err, []Mail{m})
+			p.add(1)
+			f.fail(err)
+			continue
+		}
+		// Dialers which can't be grouped get a connection of their own.
+		if key, ok := dialerKey(dialer); ok {
+			if i, ok := index[key]; ok {
+				groups[i].mails = append(groups[i].mails, m)
+				continue
+			}
+			index[key] = len(groups)
+		}
+		groups = append(groups, dialerGroup{dialer: dialer, mails: []Mail{m}})
+	}
+	return groups
+}
+
+// getDialer returns the Dialer of the Mail instance, retrying up to
+// GetDialerRetries times if it fails.
+func (mw *MailWorker) getDialer(ctx context.Context, m Mail) (Dialer, error) {
+	delay := mw.GetDialerRetryDelay
+	dialer, err := m.GetDialer()
+	for retry := 0; err != nil && retry < mw.GetDialerRetries; retry++ {
+		Logger.Printf("Failed to get dialer, retrying in %s: %s%s\n", delay, err, formatLabels(mailLabels(m)))
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(delay):
+		}
+		delay *= 2
+		dialer, err = m.GetDialer()
+	}
+	return dialer, err
+}
+
+// dialerFailed handles the Mail instances of a chunk for which we couldn't
+// get a Dialer, backing them off if BackoffOnDialerError is set and erroring
+// them out otherwise.
+func (mw *MailWorker) dialerFailed(ctx context.Context, err error, ms []Mail) {
+	if !mw.BackoffOnDialerError {
+		mw.errorMail(ctx, err, ms)
+		return
+	}
 	for _, m := range ms {
-		m.Error(err)
+		mw.backoff(ctx, m, err)
 	}
 }
 
+// dialFailure records whether any chunk of a batch got to connect, and the
+// last error which kept one from doing so.
+type dialFailure struct {
+	connected bool
+	err       error
+}
+
+// fail records that a chunk couldn't get its Dialer or connect.
+func (f *dialFailure) fail(err error) {
+	f.err = err
+}
+
+// record records whether the chunk with the BatchStats got to connect. A
+// chunk every message of which was errored out with Err didn't get to send
+// anything.
+func (f *dialFailure) record(stats BatchStats) {
+	switch {
+	case stats.Err != nil && stats.Errors == stats.Total():
+		f.fail(stats.Err)
+	case stats.Total() > 0:
+		f.connected = true
+	}
+}
+
+// batchFailed calls the OnBatchFailed hook, if set, if none of the chunks of
+// the batch got to connect.
+func (mw *MailWorker) batchFailed(f *dialFailure, ams []Mail) {
+	if mw.OnBatchFailed == nil || f.connected || f.err == nil {
+		return
+	}
+	mw.OnBatchFailed(f.err, BatchInfo{Mail: ams})
+}
+
+// filterMail removes any Mail instances which implement Filterer and report
+// that they shouldn't be sent, reporting them as skipped.
+func (mw *MailWorker) filterMail(ctx context.Context, ms []Mail, p *progress) []Mail {
+	filtered := make([]Mail, 0, len(ms))
+	for _, m := range ms {
+		if f, ok := m.(Filterer); ok && !f.ShouldSend() {
+			mw.skip(ctx, m, nil)
+			p.add(1)
+			continue
+		}
+		filtered = append(filtered, m)
+	}
+	return filtered
+}
+
+// progress reports how far along the worker is in processing a batch.
+type progress struct {
+	processed int
+	total     int
+	every     int
+	report    func(sent, total int)
+}
+
+// newProgress returns a progress tracker for a batch of the given size, or nil
+// if neither an OnProgress callback nor a PacingFunc has been configured.
+func (mw *MailWorker) newProgress(total int) *progress {
+	if mw.OnProgress == nil && mw.PacingFunc == nil {
+		return nil
+	}
+	every := mw.ProgressEvery
+	if every < 1 {
+		every = 1
+	}
+	return &progress{
+		total:  total,
+		every:  every,
+		report: mw.OnProgress,
+	}
+}
+
+// add records that n more messages have been processed, reporting progress
+// each time another ProgressEvery messages have been processed and once the
+// whole batch is done. It is safe to call on a nil progress.
+func (p *progress) add(n int) {
+	if p == nil {
+		return
+	}
+	for i := 0; i < n; i++ {
+		p.processed++
+		if p.report != nil && (p.processed%p.every == 0 || p.processed == p.total) {
+			p.report(p.processed, p.total)
+		}
+	}
+}
+
+// drop records that n of the messages of the batch won't be processed as part
+// of it, reporting progress if the rest of the batch is done. It is safe to
+// call on a nil progress.
+func (p *progress) drop(n int) {
+	if p == nil || n <= 0 {
+		return
+	}
+	p.total -= n
+	if p.report != nil && p.processed > 0 && p.processed == p.total {
+		p.report(p.processed, p.total)
+	}
+}
+
+// maxReconnects returns the number of connection attempts to make for the
+// batch starting with the Mail.
+func maxReconnects(m Mail) int {
+	if rl, ok := m.(ReconnectLimiter); ok {
+		attempts := rl.MaxReconnects()
+		if attempts > 0 {
+			return attempts
+		}
+		Logger.Printf("Ignoring invalid MaxReconnects value %d\n", attempts)
+	}
+	return MaxReconnectAttempts
+}
+
 // dialHost attempts to make a connection to the host specified by the Dialer.
-// It returns MaxReconnectAttempts if the number of connection attempts has been
-// exceeded.
-func dialHost(ctx context.Context, dialer Dialer) (Sender, error) {
+// It returns ErrMaxConnectAttempts once maxAttempts connection attempts have
+// failed. A *PermanentError returned by the Dialer is returned immediately.
+func dialHost(ctx context.Context, dialer Dialer, maxAttempts int) (Sender, error) {
 	sendAttempt := 0
 	var sender Sender
 	var err error
@@ -134,72 +1100,15 @@ func dialHost(ctx context.Context, dialer Dialer) (Sender, error) {
 		if err == nil {
 			break
 		}
+		// There's no point reconnecting if the dialer told us it won't work
+		if isPermanent(err) {
+			break
+		}
 		sendAttempt++
-		if sendAttempt == MaxReconnectAttempts {
+		if sendAttempt >= maxAttempts {
 			err = ErrMaxConnectAttempts
 			break
 		}
 	}
 	return sender, err
 }
-
-// sendMail attempts to send the provided Mail instances.
-// If the context is cancelled before all of the mail are sent,
-// sendMail just returns and does not modify those emails.
-func sendMail(ctx context.Context, dialer Dialer, ms []Mail) {
-	sender, err := dialHost(ctx, dialer)
-	if err != nil {
-		errorMail(err, ms)
-		return
-	}
-	defer sender.Close()
-	message := gomail.NewMessage()
-	for _, m := range ms {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-			break
-		}
-		message.Reset()
-
-		err = m.Generate(message)
-		if err != nil {
-			m.Error(err)
-			continue
-		}
-
-		err = gomail.Send(sender, message)
-		if err != nil {
-			if te, ok := err.(*textproto.Error); ok {
-				switch {
-				// If it's a temporary error, we should backoff and try again later.
-				// We'll reset the connection so future messages don't incur a
-				// different error (see https://github.com/gophish/gophish/issues/787).
-				case te.Code >= 400 && te.Code <= 499:
-					m.Backoff(err)
-					sender.Reset()
-					continue
-				// Otherwise, if it's a permanent error, we shouldn't backoff this message,
-				// since the RFC specifies that running the same commands won't work next time.
-				// We should reset our sender and error this message out.
-				case te.Code >= 500 && te.Code <= 599:
-					m.Error(err)
-					sender.Reset()
-					continue
-				// If something else happened, let's just error out and reset the
-				// sender
-				default:
-					m.Error(err)
-					sender.Reset()
-					continue
-				}
-			} else {
-				m.Error(err)
-				sender.Reset()
-				continue
-			}
-		}
-		m.Success()
-	}
-}
@@ -4,10 +4,13 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net/textproto"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/suite"
 )
@@ -52,7 +55,7 @@ func (ms *MailerSuite) TestDialHost() {
 	defer cancel()
 	md := newMockDialer()
 	md.setDial(md.unreachableDial)
-	_, err := dialHost(ctx, md)
+	_, err := dialHost(ctx, md, MaxReconnectAttempts)
 	if err != ErrMaxConnectAttempts {
 		ms.T().Fatalf("Didn't receive expected ErrMaxConnectAttempts. Got: %s", err)
 	}
@@ -60,10 +63,43 @@ func (ms *MailerSuite) TestDialHost() {
 		ms.T().Fatalf("Unexpected number of reconnect attempts. Expected %d, Got %d", MaxReconnectAttempts, md.dialCount)
 	}
 	md.setDial(md.defaultDial)
-	_, err = dialHost(ctx, md)
+	_, err = dialHost(ctx, md, MaxReconnectAttempts)
 	if err != nil {
 		ms.T().Fatalf("Unexpected error when dialing the mock host: %s", err)
 	}
+
+	// Permanent errors aren't retried, even when wrapped by the Dialer
+	md = newMockDialer()
+	perr := &PermanentError{Op: "auth", Err: errors.New("invalid credentials")}
+	md.setDial(func() (Sender, error) {
+		return nil, fmt.Errorf("dialing mock host: %w", perr)
+	})
+	_, err = dialHost(ctx, md, MaxReconnectAttempts)
+	if !errors.Is(err, perr) || md.dialCount != 1 {
+		ms.T().Fatalf("Permanent error was retried. Got %d attempts and error %v", md.dialCount, err)
+	}
+}
+
+func (ms *MailerSuite) TestMaxReconnects() {
+	dialer := newMockDialer()
+	dialer.setDial(dialer.unreachableDial)
+	m := &reconnectMessage{
+		mockMessage:   newMockMessage("from@example.com", []string{"to@example.com"}, &bytes.Buffer{}),
+		maxReconnects: 2,
+	}
+	m.setDialer(func() (Dialer, error) { return dialer, nil })
+
+	mw := NewMailWorker()
+	mw.processBatch(context.Background(), []Mail{m})
+	if dialer.dialCount != 2 {
+		ms.T().Fatalf("Unexpected number of reconnect attempts. Expected %d, Got %d", 2, dialer.dialCount)
+	}
+
+	// Invalid values fall back to MaxReconnectAttempts
+	m.maxReconnects = -1
+	if maxReconnects(m) != MaxReconnectAttempts {
+		ms.T().Fatalf("Unexpected number of reconnect attempts. Expected %d, Got %d", MaxReconnectAttempts, maxReconnects(m))
+	}
 }
 
 func (ms *MailerSuite) TestMailWorkerStart() {
@@ -277,6 +313,1328 @@ func (ms *MailerSuite) TestUnknownError() {
 	}
 }
 
+func (ms *MailerSuite) TestProgress() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mw := NewMailWorker()
+	got := [][2]int{}
+	mw.OnProgress = func(sent, total int) {
+		got = append(got, [2]int{sent, total})
+	}
+	go func(ctx context.Context) {
+		mw.Start(ctx)
+	}(ctx)
+
+	expectedError := &textproto.Error{
+		Code: 400,
+		Msg:  "Temporary error",
+	}
+
+	sender := newMockErrorSender(expectedError)
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		return sender, nil
+	})
+
+	messages := generateMessages(dialer)
+	mw.Queue <- messages
+
+	for range sender.messageChan {
+	}
+
+	// The backed off message should still be reported as progress
+	expected := [][2]int{{1, 2}, {2, 2}}
+	if !reflect.DeepEqual(got, expected) {
+		ms.T().Fatalf("Unexpected progress reported. Expected %v, Got %v", expected, got)
+	}
+}
+
+func (ms *MailerSuite) TestSkipFiltered() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mw := NewMailWorker()
+	results := map[Mail]Result{}
+	mw.OnResult = func(m Mail, r Result) {
+		results[m] = r
+	}
+	go func(ctx context.Context) {
+		mw.Start(ctx)
+	}(ctx)
+
+	sender := newMockSender()
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		return sender, nil
+	})
+
+	messages := generateMessages(dialer)
+	skipped := messages[0].(*mockMessage)
+	skipped.skip = true
+	// The dialer is fetched from the first message that is actually sent
+	messages[1].(*mockMessage).setDialer(func() (Dialer, error) { return dialer, nil })
+
+	mw.Queue <- messages
+
+	got := []*mockMessage{}
+	for message := range sender.messageChan {
+		got = append(got, message)
+	}
+	if len(got) != 1 {
+		ms.T().Fatalf("Unexpected number of messages received. Expected %d Got %d", 1, len(got))
+	}
+	if got[0].from != messages[1].(*mockMessage).from {
+		ms.T().Fatalf("Invalid message received. Expected %s, Got %s", messages[1].(*mockMessage).from, got[0].from)
+	}
+	if skipped.finished {
+		ms.T().Fatalf("Skipped message was unexpectedly finished")
+	}
+	if results[skipped].Outcome != OutcomeSkipped {
+		ms.T().Fatalf("Unexpected outcome for skipped message. Expected %s, Got %s", OutcomeSkipped, results[skipped].Outcome)
+	}
+	if results[messages[1]].Outcome != OutcomeSuccess {
+		ms.T().Fatalf("Unexpected outcome for sent message. Expected %s, Got %s", OutcomeSuccess, results[messages[1]].Outcome)
+	}
+}
+
+func (ms *MailerSuite) TestCallbacksSerialized() {
+	mw := NewMailWorker()
+	group := &concurrencyGroup{}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		m := &concurrencyMessage{
+			mockMessage: newMockMessage("from@example.com", []string{"to@example.com"}, &bytes.Buffer{}),
+			group:       group,
+			running:     func() { time.Sleep(time.Millisecond) },
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mw.success(context.Background(), m, delivery{})
+		}()
+	}
+	wg.Wait()
+	if group.max != 1 {
+		ms.T().Fatalf("Callbacks for the same group ran concurrently. Got %d at once", group.max)
+	}
+}
+
+func (ms *MailerSuite) TestEnqueueSplitsBatches() {
+	mw := NewMailWorker()
+	mw.MaxBatchSize = 2
+
+	messages := []Mail{}
+	for i := 0; i < 5; i++ {
+		messages = append(messages, newMockMessage("from@example.com", []string{"to@example.com"}, &bytes.Buffer{}))
+	}
+
+	go func() {
+		err := mw.Enqueue(messages)
+		if err != nil {
+			ms.T().Errorf("Unexpected error when enqueueing: %s", err)
+		}
+	}()
+
+	expected := [][]Mail{messages[0:2], messages[2:4], messages[4:5]}
+	for _, batch := range expected {
+		got := (<-mw.batches).mails
+		if !reflect.DeepEqual(got, batch) {
+			ms.T().Fatalf("Unexpected batch received. Expected %v, Got %v", batch, got)
+		}
+	}
+}
+
+func (ms *MailerSuite) TestEncoder() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mw := NewMailWorker()
+	mw.Encoder = func(m Mail, msg io.WriterTo) io.WriterTo {
+		return bytes.NewBufferString("encoded by " + m.(*mockMessage).from)
+	}
+	go func(ctx context.Context) {
+		mw.Start(ctx)
+	}(ctx)
+
+	sender := newMockSender()
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		return sender, nil
+	})
+
+	messages := generateMessages(dialer)
+	mw.Queue <- messages
+
+	idx := 0
+	for message := range sender.messageChan {
+		original := messages[idx].(*mockMessage)
+		expected := "encoded by " + original.from
+		if string(message.message) != expected {
+			ms.T().Fatalf("Unexpected message contents. Expected %q, Got %q", expected, message.message)
+		}
+		// The envelope should still come from the generated message
+		if message.from != original.from {
+			ms.T().Fatalf("Invalid message received. Expected %s, Got %s", original.from, message.from)
+		}
+		idx++
+	}
+}
+
+func (ms *MailerSuite) TestHostStats() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mw := NewMailWorker()
+	go func(ctx context.Context) {
+		mw.Start(ctx)
+	}(ctx)
+
+	expectedError := &textproto.Error{
+		Code: 400,
+		Msg:  "Temporary error",
+	}
+
+	sender := newMockErrorSender(expectedError)
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		return sender, nil
+	})
+
+	mw.Queue <- generateMessages(dialer)
+	for range sender.messageChan {
+	}
+
+	stats := mw.HostStats(dialer.Address())
+	if stats.Sent != 1 || stats.Backoffs != 1 || stats.Errors != 0 {
+		ms.T().Fatalf("Unexpected host stats. Got %+v", stats)
+	}
+	if !reflect.DeepEqual(stats.LastError, expectedError) {
+		ms.T().Fatalf("Unexpected last error. Expected %#v, Got %#v", expectedError, stats.LastError)
+	}
+
+	if stats.Connections != 1 || stats.CompressedConnections != 0 {
+		ms.T().Fatalf("Unexpected connection stats. Got %+v", stats)
+	}
+
+	mw.ResetHostStats()
+	stats = mw.HostStats(dialer.Address())
+	if stats.Attempts() != 0 {
+		ms.T().Fatalf("Host stats weren't reset. Got %+v", stats)
+	}
+}
+
+func (ms *MailerSuite) TestFailFast() {
+	defer func(size int, delay time.Duration) {
+		MailChunkSize = size
+		MailDelayTime = delay
+	}(MailChunkSize, MailDelayTime)
+	MailChunkSize = 1
+	MailDelayTime = 0
+
+	mw := NewMailWorker()
+	mw.FailFast = true
+
+	dialer := newMockDialer()
+	dialer.setDial(dialer.unreachableDial)
+	messages := generateMessages(dialer)
+	messages[1].(*mockMessage).setDialer(func() (Dialer, error) { return dialer, nil })
+
+	mw.processBatch(context.Background(), messages)
+
+	// Only the first chunk should have tried connecting
+	if dialer.dialCount != MaxReconnectAttempts {
+		ms.T().Fatalf("Unexpected number of dial attempts. Expected %d, Got %d", MaxReconnectAttempts, dialer.dialCount)
+	}
+	for _, m := range messages {
+		if m.(*mockMessage).err != ErrMaxConnectAttempts {
+			ms.T().Fatalf("Didn't receive expected ErrMaxConnectAttempts. Got: %v", m.(*mockMessage).err)
+		}
+	}
+}
+
+func (ms *MailerSuite) TestOnBatchFailed() {
+	defer func(size int, delay time.Duration) {
+		MailChunkSize = size
+		MailDelayTime = delay
+	}(MailChunkSize, MailDelayTime)
+	MailChunkSize = 1
+	MailDelayTime = 0
+
+	mw := NewMailWorker()
+	var errs []error
+	var failed [][]Mail
+	mw.OnBatchFailed = func(err error, b BatchInfo) {
+		errs = append(errs, err)
+		failed = append(failed, b.Mail)
+	}
+
+	// Every chunk fails to connect
+	dialer := newMockDialer()
+	dialer.setDial(dialer.unreachableDial)
+	messages := generateMessages(dialer)
+	for _, m := range messages {
+		m.(*mockMessage).setDialer(func() (Dialer, error) { return dialer, nil })
+	}
+	mw.processBatch(context.Background(), messages)
+	if len(errs) != 1 || errs[0] != ErrMaxConnectAttempts {
+		ms.T().Fatalf("Expected a single call with ErrMaxConnectAttempts. Got %v", errs)
+	}
+	if len(failed[0]) != len(messages) {
+		ms.T().Fatalf("Unexpected number of failed mail. Expected %d, Got %d", len(messages), len(failed[0]))
+	}
+
+	// No chunk can get its Dialer
+	errs = nil
+	messages = generateMessages(dialer)
+	for _, m := range messages {
+		m.(*mockMessage).setDialer(m.(*mockMessage).errorDialer)
+	}
+	mw.processBatch(context.Background(), messages)
+	if len(errs) != 1 || errs[0] != errDialerUnavailable {
+		ms.T().Fatalf("Expected a single call with errDialerUnavailable. Got %v", errs)
+	}
+
+	// Only the last chunk fails, so the batch didn't fail as a whole
+	errs = nil
+	working := newMockDialer()
+	working.setDial(func() (Sender, error) {
+		sender := newMockSender()
+		sender.setSend(func(*mockMessage) error { return nil })
+		return sender, nil
+	})
+	messages = generateMessages(working)
+	messages[1].(*mockMessage).setDialer(func() (Dialer, error) { return dialer, nil })
+	mw.processBatch(context.Background(), messages)
+	if len(errs) != 0 {
+		ms.T().Fatalf("Unexpected calls to OnBatchFailed. Got %v", errs)
+	}
+}
+
+func (ms *MailerSuite) TestSlowSend() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mw := NewMailWorker()
+	mw.SlowSendThreshold = 5 * time.Millisecond
+	slow := []string{}
+	mw.OnSlowSend = func(m Mail, host string, to []string, elapsed time.Duration) {
+		slow = append(slow, m.(*mockMessage).from)
+		if !reflect.DeepEqual(to, []string{"to@example.com"}) {
+			ms.T().Errorf("Unexpected recipients for slow send. Got %v", to)
+		}
+	}
+	go func(ctx context.Context) {
+		mw.Start(ctx)
+	}(ctx)
+
+	sender := newMockSender()
+	// Only the first message is slow
+	sender.setSend(func(mm *mockMessage) error {
+		if len(sender.messages) == 1 {
+			time.Sleep(50 * time.Millisecond)
+		}
+		sender.messageChan <- mm
+		return nil
+	})
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		return sender, nil
+	})
+
+	messages := generateMessages(dialer)
+	mw.Queue <- messages
+	for range sender.messageChan {
+	}
+
+	expected := []string{messages[0].(*mockMessage).from}
+	if !reflect.DeepEqual(slow, expected) {
+		ms.T().Fatalf("Unexpected slow sends reported. Expected %v, Got %v", expected, slow)
+	}
+}
+
+type testContextKey struct{}
+
+func (ms *MailerSuite) TestEnqueueContext() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mw := NewMailWorker()
+	var resultCtx context.Context
+	mw.OnResult = func(m Mail, r Result) {
+		resultCtx = r.Context
+	}
+	go func(ctx context.Context) {
+		mw.Start(ctx)
+	}(ctx)
+
+	sender := newMockSender()
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		return sender, nil
+	})
+	m := &contextMessage{
+		mockMessage: newMockMessage("from@example.com", []string{"to@example.com"}, &bytes.Buffer{}),
+	}
+	m.setDialer(func() (Dialer, error) { return dialer, nil })
+
+	// The batch shouldn't be cancelled along with the context it was
+	// enqueued with.
+	bctx, bcancel := context.WithCancel(context.WithValue(context.Background(), testContextKey{}, "trace"))
+	bcancel()
+	err := mw.EnqueueContext(bctx, []Mail{m})
+	if err != nil {
+		ms.T().Fatalf("Unexpected error when enqueueing: %s", err)
+	}
+	for range sender.messageChan {
+	}
+
+	if v := m.ctx.Value(testContextKey{}); v != "trace" {
+		ms.T().Fatalf("Unexpected context value in GenerateContext. Expected %q, Got %v", "trace", v)
+	}
+	if v := resultCtx.Value(testContextKey{}); v != "trace" {
+		ms.T().Fatalf("Unexpected context value in OnResult. Expected %q, Got %v", "trace", v)
+	}
+	if !m.finished {
+		ms.T().Fatalf("Message enqueued with a cancelled context wasn't sent")
+	}
+}
+
+func (ms *MailerSuite) TestCompressionStats() {
+	mw := NewMailWorker()
+	sender := &compressedSender{newMockSender()}
+	mw.connected("mock.example.com:25", sender)
+	stats := mw.HostStats("mock.example.com:25")
+	if stats.Connections != 1 || stats.CompressedConnections != 1 {
+		ms.T().Fatalf("Unexpected connection stats. Got %+v", stats)
+	}
+}
+
+func (ms *MailerSuite) TestAuditFunc() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mw := NewMailWorker()
+	records := []AuditRecord{}
+	mw.AuditFunc = func(r AuditRecord) {
+		records = append(records, r)
+	}
+	go func(ctx context.Context) {
+		mw.Start(ctx)
+	}(ctx)
+
+	expectedError := &textproto.Error{
+		Code: 421,
+		Msg:  "Try again later",
+	}
+	sender := newMockErrorSender(expectedError)
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		return sender, nil
+	})
+
+	messages := generateMessages(dialer)
+	mw.Queue <- messages
+	for range sender.messageChan {
+	}
+
+	if len(records) != len(messages) {
+		ms.T().Fatalf("Unexpected number of audit records. Expected %d, Got %d", len(messages), len(records))
+	}
+	backoff := records[0]
+	if backoff.Outcome != OutcomeBackoff || backoff.Code != 421 || backoff.Response != "Try again later" {
+		ms.T().Fatalf("Unexpected audit record for backed off message. Got %+v", backoff)
+	}
+	if backoff.From != "first@example.com" || !reflect.DeepEqual(backoff.Recipients, []string{"to@example.com"}) {
+		ms.T().Fatalf("Unexpected envelope in audit record. Got %+v", backoff)
+	}
+	if records[1].Outcome != OutcomeSuccess || records[1].Attempt != 1 {
+		ms.T().Fatalf("Unexpected audit record for sent message. Got %+v", records[1])
+	}
+}
+
+func (ms *MailerSuite) TestEnqueueAt() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mw := NewMailWorker()
+	go func(ctx context.Context) {
+		mw.Start(ctx)
+	}(ctx)
+
+	sent := make(chan string, 2)
+	mw.OnResult = func(m Mail, r Result) {
+		sent <- m.(*mockMessage).from
+	}
+
+	now := time.Now()
+	later := newMockMessage("later@example.com", []string{"to@example.com"}, &bytes.Buffer{})
+	sooner := newMockMessage("sooner@example.com", []string{"to@example.com"}, &bytes.Buffer{})
+	for _, m := range []*mockMessage{later, sooner} {
+		sender := newMockSender()
+		sender.setSend(func(*mockMessage) error { return nil })
+		m.setDialer(func() (Dialer, error) {
+			dialer := newMockDialer()
+			dialer.setDial(func() (Sender, error) { return sender, nil })
+			return dialer, nil
+		})
+	}
+
+	mw.EnqueueAt(now.Add(100*time.Millisecond), []Mail{later})
+	mw.EnqueueAt(now.Add(50*time.Millisecond), []Mail{sooner})
+
+	first := <-sent
+	if time.Since(now) < 50*time.Millisecond {
+		ms.T().Fatalf("Scheduled batch was sent too early")
+	}
+	second := <-sent
+	if time.Since(now) < 100*time.Millisecond {
+		ms.T().Fatalf("Scheduled batch was sent too early")
+	}
+	if first != sooner.from || second != later.from {
+		ms.T().Fatalf("Scheduled batches sent out of order. Got %s then %s", first, second)
+	}
+}
+
+func (ms *MailerSuite) TestRedirectFunc() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mw := NewMailWorker()
+	mw.RedirectFunc = func(to []string) []string {
+		return []string{"test@example.com"}
+	}
+	mw.PreserveOriginalRecipients = true
+	go func(ctx context.Context) {
+		mw.Start(ctx)
+	}(ctx)
+
+	sender := newMockSender()
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		return sender, nil
+	})
+
+	mw.Queue <- generateMessages(dialer)
+	for message := range sender.messageChan {
+		if !reflect.DeepEqual(message.to, []string{"test@example.com"}) {
+			ms.T().Fatalf("Recipients weren't redirected. Got %v", message.to)
+		}
+		if !bytes.Contains(message.message, []byte("X-Original-To: to@example.com")) {
+			ms.T().Fatalf("Original recipients weren't preserved. Got %q", message.message)
+		}
+	}
+}
+
+func (ms *MailerSuite) TestConnectionLost() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mw := NewMailWorker()
+	go func(ctx context.Context) {
+		mw.Start(ctx)
+	}(ctx)
+
+	// The first connection is dropped before the first message is sent
+	dropped := newMockSender()
+	dropped.setSend(func(mm *mockMessage) error {
+		return io.EOF
+	})
+	sender := newMockSender()
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		if dialer.dialCount == 1 {
+			return dropped, nil
+		}
+		return sender, nil
+	})
+
+	messages := generateMessages(dialer)
+	mw.Queue <- messages
+
+	got := []*mockMessage{}
+	for message := range sender.messageChan {
+		got = append(got, message)
+	}
+	if len(got) != len(messages) {
+		ms.T().Fatalf("Unexpected number of messages received. Expected %d Got %d", len(messages), len(got))
+	}
+	if dialer.dialCount != 2 {
+		ms.T().Fatalf("Unexpected number of dials. Expected %d Got %d", 2, dialer.dialCount)
+	}
+	for _, m := range messages {
+		mm := m.(*mockMessage)
+		if mm.err != nil {
+			ms.T().Fatalf("Unexpected error for message %s: %s", mm.from, mm.err)
+		}
+	}
+}
+
+func (ms *MailerSuite) TestGenerateWorkers() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mw := NewMailWorker()
+	mw.GenerateWorkers = 4
+	go func(ctx context.Context) {
+		mw.Start(ctx)
+	}(ctx)
+
+	sender := newMockSender()
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		return sender, nil
+	})
+
+	messages := []Mail{}
+	for i := 0; i < 8; i++ {
+		from := fmt.Sprintf("sender%d@example.com", i)
+		// Every message gets its own recipients, since generating it
+		// encodes them in place while another message is being sent.
+		m := newMockMessage(from, []string{"to@example.com"}, bytes.NewBufferString(from))
+		m.setDialer(func() (Dialer, error) { return dialer, nil })
+		messages = append(messages, m)
+	}
+	mw.Queue <- messages
+
+	// Messages should be sent in the order they were enqueued
+	i := 0
+	for message := range sender.messageChan {
+		expected := messages[i].(*mockMessage).from
+		if message.from != expected {
+			ms.T().Fatalf("Unexpected message sent. Expected %s Got %s", expected, message.from)
+		}
+		i++
+	}
+	if i != len(messages) {
+		ms.T().Fatalf("Unexpected number of messages received. Expected %d Got %d", len(messages), i)
+	}
+}
+
+func (ms *MailerSuite) TestArchiveRecipient() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mw := NewMailWorker()
+	mw.ArchiveRecipient = "archive@example.com"
+	go func(ctx context.Context) {
+		mw.Start(ctx)
+	}(ctx)
+
+	archived := 0
+	sender := newMockSender()
+	sender.setSend(func(mm *mockMessage) error {
+		if reflect.DeepEqual(mm.to, []string{"archive@example.com"}) {
+			archived++
+			// Failing to archive shouldn't affect the original message
+			return errors.New("archive unavailable")
+		}
+		sender.messageChan <- mm
+		return nil
+	})
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		return sender, nil
+	})
+
+	messages := generateMessages(dialer)
+	mw.Queue <- messages
+	for range sender.messageChan {
+	}
+
+	if archived != len(messages) {
+		ms.T().Fatalf("Unexpected number of archived messages. Expected %d Got %d", len(messages), archived)
+	}
+	for _, m := range messages {
+		mm := m.(*mockMessage)
+		if mm.err != nil || !mm.finished {
+			ms.T().Fatalf("Message %s wasn't sent successfully. Got error: %v", mm.from, mm.err)
+		}
+	}
+	stats := mw.HostStats(dialer.Address())
+	if stats.Sent != len(messages) || stats.Errors != 0 {
+		ms.T().Fatalf("Archive copies were counted in the stats. Got %+v", stats)
+	}
+}
+
+func (ms *MailerSuite) TestFlushAndWait() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mw := NewMailWorker()
+	go func(ctx context.Context) {
+		mw.Start(ctx)
+	}(ctx)
+
+	// Each batch gets its own dialer since they're processed concurrently
+	slowDialer := func() Dialer {
+		dialer := newMockDialer()
+		dialer.setDial(func() (Sender, error) {
+			sender := newMockSender()
+			sender.setSend(func(mm *mockMessage) error {
+				time.Sleep(10 * time.Millisecond)
+				return nil
+			})
+			return sender, nil
+		})
+		return dialer
+	}
+
+	first := generateMessages(slowDialer())
+	second := generateMessages(slowDialer())
+	mw.Queue <- first
+	if err := mw.Enqueue(second); err != nil {
+		ms.T().Fatalf("Unexpected error when enqueueing: %s", err)
+	}
+	if err := mw.FlushAndWait(ctx); err != nil {
+		ms.T().Fatalf("Unexpected error when flushing: %s", err)
+	}
+	for _, m := range append(first, second...) {
+		if !m.(*mockMessage).finished {
+			ms.T().Fatalf("Message %s wasn't processed before FlushAndWait returned", m.(*mockMessage).from)
+		}
+	}
+
+	// The worker should still accept new batches
+	if err := mw.Enqueue(generateMessages(slowDialer())); err != nil {
+		ms.T().Fatalf("Unexpected error when enqueueing after flush: %s", err)
+	}
+	if err := mw.FlushAndWait(ctx); err != nil {
+		ms.T().Fatalf("Unexpected error when flushing: %s", err)
+	}
+}
+
+func (ms *MailerSuite) TestOnIdle() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	idle := make(chan struct{}, 10)
+	mw := NewMailWorker()
+	mw.MaxBatchSize = 1
+	mw.OnIdle = func() {
+		idle <- struct{}{}
+	}
+	go func(ctx context.Context) {
+		mw.Start(ctx)
+	}(ctx)
+
+	// Each part of the batch gets its own dialer since they're processed
+	// concurrently
+	var batch []Mail
+	for i := 0; i < 3; i++ {
+		dialer := newMockDialer()
+		dialer.setDial(func() (Sender, error) {
+			sender := newMockSender()
+			sender.setSend(func(mm *mockMessage) error {
+				time.Sleep(10 * time.Millisecond)
+				return nil
+			})
+			return sender, nil
+		})
+		batch = append(batch, generateMessages(dialer)[0])
+	}
+	if err := mw.Enqueue(batch); err != nil {
+		ms.T().Fatalf("Unexpected error when enqueueing: %s", err)
+	}
+	select {
+	case <-idle:
+	case <-time.After(time.Second):
+		ms.T().Fatalf("OnIdle wasn't called")
+	}
+	for _, m := range batch {
+		if !m.(*mockMessage).finished {
+			ms.T().Fatalf("Message %s wasn't processed before OnIdle was called", m.(*mockMessage).from)
+		}
+	}
+	// Nothing else was enqueued, so the worker should stay idle
+	select {
+	case <-idle:
+		ms.T().Fatalf("OnIdle was called more than once")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func (ms *MailerSuite) TestPerMessageDialers() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mw := NewMailWorker()
+	mw.PerMessageDialers = true
+	go func(ctx context.Context) {
+		mw.Start(ctx)
+	}(ctx)
+
+	newDialer := func() *mockDialer {
+		dialer := newMockDialer()
+		dialer.setDial(func() (Sender, error) {
+			sender := newMockSender()
+			sender.setSend(func(*mockMessage) error {
+				return nil
+			})
+			return sender, nil
+		})
+		return dialer
+	}
+	dialers := []*mockDialer{newDialer(), newDialer()}
+	var batch []Mail
+	for i := 0; i < 4; i++ {
+		dialer := dialers[i%2]
+		m := newMockMessage(fmt.Sprintf("from%d@example.com", i), []string{"to@example.com"}, bytes.NewBufferString("Email"))
+		m.setDialer(func() (Dialer, error) { return dialer, nil })
+		batch = append(batch, m)
+	}
+	if err := mw.Enqueue(batch); err != nil {
+		ms.T().Fatalf("Unexpected error when enqueueing: %s", err)
+	}
+	if err := mw.FlushAndWait(ctx); err != nil {
+		ms.T().Fatalf("Unexpected error when flushing: %s", err)
+	}
+	for i, dialer := range dialers {
+		if dialer.dialCount != 1 {
+			ms.T().Fatalf("Unexpected number of dials for dialer %d. Expected %d, Got %d", i, 1, dialer.dialCount)
+		}
+	}
+	for _, m := range batch {
+		mm := m.(*mockMessage)
+		if !mm.finished || mm.err != nil {
+			ms.T().Fatalf("Message %s wasn't sent", mm.from)
+		}
+	}
+}
+
+func (ms *MailerSuite) TestApprovalFunc() {
+	for _, backoff := range []bool{false, true} {
+		mw := NewMailWorker()
+		mw.BackoffUnapproved = backoff
+		rejected := errors.New("campaign rejected")
+		var sizes []int
+		mw.ApprovalFunc = func(ctx context.Context, b BatchInfo) error {
+			sizes = append(sizes, len(b.Mail))
+			return rejected
+		}
+		dialer := newMockDialer()
+		dialer.setDial(func() (Sender, error) {
+			ms.T().Fatalf("Unapproved batch was dialed")
+			return nil, nil
+		})
+		messages := generateMessages(dialer)
+		mw.processBatch(context.Background(), messages)
+
+		if !reflect.DeepEqual(sizes, []int{len(messages)}) {
+			ms.T().Fatalf("Unexpected approval requests. Got %v", sizes)
+		}
+		for _, m := range messages {
+			mm := m.(*mockMessage)
+			if backoff && mm.backoffCount != 1 {
+				ms.T().Fatalf("Unapproved message %s wasn't backed off", mm.from)
+			}
+			if !backoff && mm.err != rejected {
+				ms.T().Fatalf("Unexpected error for unapproved message %s. Expected %v Got %v", mm.from, rejected, mm.err)
+			}
+		}
+	}
+}
+
+func (ms *MailerSuite) TestExtraHeaders() {
+	for _, keep := range []bool{false, true} {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		mw := NewMailWorker()
+		mw.KeepGeneratedHeaders = keep
+		go func(ctx context.Context) {
+			mw.Start(ctx)
+		}(ctx)
+
+		sender := newMockSender()
+		dialer := newMockDialer()
+		dialer.setDial(func() (Sender, error) {
+			return sender, nil
+		})
+
+		m := &headerMessage{
+			mockMessage: newMockMessage("from@example.com", []string{"to@example.com"}, bytes.NewBufferString("Email")),
+			headers: map[string][]string{
+				"List-Unsubscribe": {"<https://example.com/unsubscribe?rid=1234>"},
+				"From":             {"override@example.com"},
+			},
+		}
+		m.setDialer(func() (Dialer, error) { return dialer, nil })
+		mw.Queue <- []Mail{m}
+
+		message := <-sender.messageChan
+		if !bytes.Contains(message.message, []byte("List-Unsubscribe: <https://example.com/unsubscribe?rid=1234>")) {
+			ms.T().Fatalf("Extra header wasn't set. Got %q", message.message)
+		}
+		expected := "override@example.com"
+		if keep {
+			expected = "from@example.com"
+		}
+		if message.from != expected {
+			ms.T().Fatalf("Unexpected sender with KeepGeneratedHeaders=%t. Expected %s Got %s", keep, expected, message.from)
+		}
+		cancel()
+	}
+}
+
+func (ms *MailerSuite) TestGetDialerRetries() {
+	mw := NewMailWorker()
+	mw.GetDialerRetries = 2
+	mw.GetDialerRetryDelay = time.Millisecond
+
+	sender := newMockSender()
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		return sender, nil
+	})
+	messages := generateMessages(dialer)
+	calls := 0
+	messages[0].(*mockMessage).setDialer(func() (Dialer, error) {
+		calls++
+		if calls <= 2 {
+			return nil, errDialerUnavailable
+		}
+		return dialer, nil
+	})
+	go mw.processBatch(context.Background(), messages)
+
+	received := 0
+	for range sender.messageChan {
+		received++
+	}
+	if received != len(messages) {
+		ms.T().Fatalf("Unexpected number of messages received. Expected %d Got %d", len(messages), received)
+	}
+	if calls != 3 {
+		ms.T().Fatalf("Unexpected number of calls to GetDialer. Expected %d Got %d", 3, calls)
+	}
+}
+
+func (ms *MailerSuite) TestBackoffOnDialerError() {
+	mw := NewMailWorker()
+	mw.BackoffOnDialerError = true
+
+	messages := generateMessages(newMockDialer())
+	messages[0].(*mockMessage).setDialer(messages[0].(*mockMessage).errorDialer)
+	mw.processBatch(context.Background(), messages)
+
+	for _, m := range messages {
+		mm := m.(*mockMessage)
+		if mm.err != nil {
+			ms.T().Fatalf("Message %s was errored out instead of backed off: %s", mm.from, mm.err)
+		}
+		if mm.backoffCount != 1 {
+			ms.T().Fatalf("Unexpected backoff count for message %s. Expected %d Got %d", mm.from, 1, mm.backoffCount)
+		}
+	}
+}
+
+func (ms *MailerSuite) TestMaxOpenConnections() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mw := NewMailWorker()
+	mw.MaxOpenConnections = 1
+	go func(ctx context.Context) {
+		mw.Start(ctx)
+	}(ctx)
+
+	var mu sync.Mutex
+	open, maxOpen := 0, 0
+	newDialer := func() Dialer {
+		dialer := newMockDialer()
+		dialer.setDial(func() (Sender, error) {
+			mu.Lock()
+			open++
+			if open > maxOpen {
+				maxOpen = open
+			}
+			mu.Unlock()
+			sender := newMockSender()
+			sender.setSend(func(mm *mockMessage) error {
+				time.Sleep(5 * time.Millisecond)
+				return nil
+			})
+			return &closeNotifySender{
+				mockSender: sender,
+				onClose: func() {
+					mu.Lock()
+					open--
+					mu.Unlock()
+				},
+			}, nil
+		})
+		return dialer
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := mw.Enqueue(generateMessages(newDialer())); err != nil {
+			ms.T().Fatalf("Unexpected error when enqueueing: %s", err)
+		}
+	}
+	if err := mw.FlushAndWait(ctx); err != nil {
+		ms.T().Fatalf("Unexpected error when flushing: %s", err)
+	}
+	if maxOpen != 1 {
+		ms.T().Fatalf("Unexpected number of concurrent connections. Expected %d Got %d", 1, maxOpen)
+	}
+}
+
+func (ms *MailerSuite) TestFlushSender() {
+	sender := &flushSender{mockSender: newMockSender()}
+	sender.setSend(func(mm *mockMessage) error {
+		if len(sender.messages) == 2 {
+			sender.err = errors.New("disk full")
+		}
+		return nil
+	})
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		return sender, nil
+	})
+
+	messages := generateMessages(dialer)
+	NewMailWorker().processBatch(context.Background(), messages)
+
+	if sender.flushes != len(messages) {
+		ms.T().Fatalf("Unexpected number of flushes. Expected %d Got %d", len(messages), sender.flushes)
+	}
+	if err := messages[0].(*mockMessage).err; err != nil {
+		ms.T().Fatalf("Unexpected error for the first message: %s", err)
+	}
+	// A message which couldn't be flushed wasn't sent
+	if err := messages[1].(*mockMessage).err; err != sender.err {
+		ms.T().Fatalf("Didn't receive expected flush error. Expected %v Got %v", sender.err, err)
+	}
+}
+
+func (ms *MailerSuite) TestFlushBeforeSuccess() {
+	sender := &flushSender{mockSender: newMockSender()}
+	sender.setSend(func(mm *mockMessage) error {
+		return nil
+	})
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		return sender, nil
+	})
+
+	mw := NewMailWorker()
+	mw.ArchiveRecipient = "archive@example.com"
+	var flushed []int
+	mw.OnResult = func(m Mail, r Result) {
+		flushed = append(flushed, sender.flushes)
+	}
+	mw.processBatch(context.Background(), generateMessages(dialer))
+
+	// Both the message and its archived copy are flushed before success is
+	// reported
+	expected := []int{2, 4}
+	if !reflect.DeepEqual(flushed, expected) {
+		ms.T().Fatalf("Unexpected flushes when reporting success. Expected %v Got %v", expected, flushed)
+	}
+}
+
+func (ms *MailerSuite) TestOnReset() {
+	tests := []struct {
+		err      error
+		expected ResetReason
+	}{
+		{&textproto.Error{Code: 421, Msg: "Temporary error"}, ResetTemporaryError},
+		{&textproto.Error{Code: 550, Msg: "Permanent error"}, ResetPermanentError},
+		{errors.New("Unexpected error"), ResetUnknown},
+	}
+	for _, test := range tests {
+		mw := NewMailWorker()
+		var reasons []ResetReason
+		var resetErr error
+		mw.OnReset = func(reason ResetReason, err error) {
+			reasons = append(reasons, reason)
+			resetErr = err
+		}
+
+		sender := newMockErrorSender(test.err)
+		dialer := newMockDialer()
+		dialer.setDial(func() (Sender, error) {
+			return sender, nil
+		})
+		go mw.processBatch(context.Background(), generateMessages(dialer))
+		for range sender.messageChan {
+		}
+
+		if !reflect.DeepEqual(reasons, []ResetReason{test.expected}) {
+			ms.T().Fatalf("Unexpected reset reasons for %v. Expected %v Got %v", test.err, []ResetReason{test.expected}, reasons)
+		}
+		if resetErr != nil {
+			ms.T().Fatalf("Unexpected error when resetting: %s", resetErr)
+		}
+	}
+}
+
+func (ms *MailerSuite) TestMaxConnectionAge() {
+	mw := NewMailWorker()
+	mw.MaxConnectionAge = 5 * time.Millisecond
+
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		sender := newMockSender()
+		sender.setSend(func(mm *mockMessage) error {
+			time.Sleep(10 * time.Millisecond)
+			return nil
+		})
+		return sender, nil
+	})
+	messages := generateMessages(dialer)
+	mw.processBatch(context.Background(), messages)
+
+	// The first connection expires while sending the first message
+	if dialer.dialCount != 2 {
+		ms.T().Fatalf("Unexpected number of dials. Expected %d Got %d", 2, dialer.dialCount)
+	}
+	for _, m := range messages {
+		mm := m.(*mockMessage)
+		if mm.err != nil || !mm.finished {
+			ms.T().Fatalf("Message %s wasn't sent successfully. Got error: %v", mm.from, mm.err)
+		}
+	}
+}
+
+func (ms *MailerSuite) TestNoRecipients() {
+	mw := NewMailWorker()
+	results := map[Mail]Result{}
+	mw.OnResult = func(m Mail, r Result) {
+		results[m] = r
+	}
+	// Every recipient of the second message is suppressed
+	mw.RedirectFunc = func(to []string) []string {
+		return nil
+	}
+
+	sender := newMockSender()
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		return sender, nil
+	})
+	m1 := newMockMessage("first@example.com", nil, bytes.NewBufferString("First email"))
+	m1.setDialer(func() (Dialer, error) { return dialer, nil })
+	m2 := newMockMessage("second@example.com", []string{"to@example.com"}, bytes.NewBufferString("Second email"))
+	messages := []Mail{m1, m2}
+	mw.processBatch(context.Background(), messages)
+
+	if len(sender.messages) != 0 {
+		ms.T().Fatalf("Messages without recipients were sent. Got %d", len(sender.messages))
+	}
+	for _, m := range messages {
+		mm := m.(*mockMessage)
+		if mm.finished || mm.backoffCount != 0 {
+			ms.T().Fatalf("Callbacks were called for message %s without recipients", mm.from)
+		}
+		r := results[m]
+		if r.Outcome != OutcomeSkipped || r.Err != ErrNoRecipients {
+			ms.T().Fatalf("Unexpected result for message %s. Expected %s with %v, Got %s with %v", mm.from, OutcomeSkipped, ErrNoRecipients, r.Outcome, r.Err)
+		}
+	}
+	if sender.resetCount != 0 {
+		ms.T().Fatalf("Unexpected connection resets. Got %d", sender.resetCount)
+	}
+}
+
+func (ms *MailerSuite) TestEnqueueValidation() {
+	mw := NewMailWorker()
+	err := mw.Enqueue([]Mail{})
+	if err != ErrEmptyBatch {
+		ms.T().Fatalf("Didn't receive expected ErrEmptyBatch. Got: %v", err)
+	}
+
+	messages := generateMessages(newMockDialer())
+	err = mw.Enqueue([]Mail{messages[0], nil})
+	if !errors.Is(err, ErrNilMail) {
+		ms.T().Fatalf("Didn't receive expected ErrNilMail. Got: %v", err)
+	}
+
+	other := &mockMessage{}
+	other.setDialer(func() (Dialer, error) {
+		return &SMTPDialer{Host: "other.example.com", Port: 25}, nil
+	})
+	mw.ValidateDialers = true
+	err = mw.Enqueue([]Mail{messages[0], other})
+	if !errors.Is(err, ErrMixedDialers) {
+		ms.T().Fatalf("Didn't receive expected ErrMixedDialers. Got: %v", err)
+	}
+}
+
+func (ms *MailerSuite) TestCancelledBatch() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	mw := NewMailWorker()
+	dialer := newMockDialer()
+	messages := generateMessages(dialer)
+	mw.processBatch(ctx, messages)
+
+	if dialer.dialCount != 0 {
+		ms.T().Fatalf("Unexpected dial for a cancelled batch. Got %d dials", dialer.dialCount)
+	}
+	for _, m := range messages {
+		mm := m.(*mockMessage)
+		if mm.backoffCount != 1 {
+			ms.T().Fatalf("Message %s wasn't backed off. Got %d backoffs", mm.from, mm.backoffCount)
+		}
+	}
+
+	mw.IgnoreCancelledBatches = true
+	messages = generateMessages(dialer)
+	mw.processBatch(ctx, messages)
+	for _, m := range messages {
+		mm := m.(*mockMessage)
+		if mm.backoffCount != 0 || mm.finished {
+			ms.T().Fatalf("Message %s of an ignored batch was modified", mm.from)
+		}
+	}
+}
+
+func (ms *MailerSuite) TestEnqueueAfterShutdown() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	mw := NewMailWorker()
+	stopped := make(chan struct{})
+	go func(ctx context.Context) {
+		mw.Start(ctx)
+		close(stopped)
+	}(ctx)
+
+	cancel()
+	<-stopped
+
+	// A producer blocked on the queue should be released once the worker
+	// has stopped.
+	err := mw.Enqueue(generateMessages(newMockDialer()))
+	if err != ErrShutdown {
+		ms.T().Fatalf("Didn't receive expected ErrShutdown. Got: %v", err)
+	}
+}
+
+func (ms *MailerSuite) TestCancelHost() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	reasons := make(map[Mail]error)
+	mw := NewMailWorker()
+	mw.OnResult = func(m Mail, r Result) {
+		mu.Lock()
+		defer mu.Unlock()
+		reasons[m] = r.Err
+	}
+	go func(ctx context.Context) {
+		mw.Start(ctx)
+	}(ctx)
+
+	sending := make(chan struct{})
+	release := make(chan struct{})
+	sender := newMockSender()
+	sender.setSend(func(mm *mockMessage) error {
+		sending <- struct{}{}
+		<-release
+		return nil
+	})
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		return sender, nil
+	})
+	other := &addressDialer{mockDialer: newMockDialer(), address: "other.example.com:25"}
+
+	newMessage := func(d Dialer) *mockMessage {
+		m := newMockMessage("from@example.com", []string{"to@example.com"}, bytes.NewBufferString("Email"))
+		m.setDialer(func() (Dialer, error) { return d, nil })
+		return m
+	}
+	inflight := []*mockMessage{newMessage(dialer), newMessage(dialer)}
+	scheduled := newMessage(dialer)
+	unaffected := newMessage(other)
+	later := time.Now().Add(time.Hour)
+	if err := mw.EnqueueAt(later, []Mail{scheduled}); err != nil {
+		ms.T().Fatalf("Unexpected error when enqueueing: %s", err)
+	}
+	if err := mw.EnqueueAt(later, []Mail{unaffected}); err != nil {
+		ms.T().Fatalf("Unexpected error when enqueueing: %s", err)
+	}
+	if err := mw.Enqueue([]Mail{inflight[0], inflight[1]}); err != nil {
+		ms.T().Fatalf("Unexpected error when enqueueing: %s", err)
+	}
+	<-sending
+	if err := mw.CancelHost(dialer.Address()); err != nil {
+		ms.T().Fatalf("Unexpected error when cancelling the host: %s", err)
+	}
+	close(release)
+	if err := mw.FlushAndWait(ctx); err != nil {
+		ms.T().Fatalf("Unexpected error when flushing: %s", err)
+	}
+
+	if !inflight[0].finished || inflight[0].err != nil {
+		ms.T().Fatalf("Message being sent wasn't finished. Got error: %v", inflight[0].err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, m := range []*mockMessage{inflight[1], scheduled} {
+		if m.backoffCount != 1 || reasons[m] != ErrHostCancelled {
+			ms.T().Fatalf("Unexpected backoff. Expected 1 with %v, Got %d with %v", ErrHostCancelled, m.backoffCount, reasons[m])
+		}
+	}
+	if unaffected.backoffCount != 0 || unaffected.finished {
+		ms.T().Fatalf("Message for another host was processed")
+	}
+}
+
+func (ms *MailerSuite) TestEnqueueStreaming() {
+	defer func(size int, delay time.Duration) {
+		MailChunkSize = size
+		MailDelayTime = delay
+	}(MailChunkSize, MailDelayTime)
+	MailChunkSize = 2
+	MailDelayTime = 0
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mw := NewMailWorker()
+	go func(ctx context.Context) {
+		mw.Start(ctx)
+	}(ctx)
+
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		sender := newMockSender()
+		sender.setSend(func(*mockMessage) error { return nil })
+		return sender, nil
+	})
+	var messages []Mail
+	for i := 0; i < 4; i++ {
+		m := newMockMessage("from@example.com", []string{"to@example.com"}, bytes.NewBufferString("Email"))
+		m.setDialer(func() (Dialer, error) { return dialer, nil })
+		messages = append(messages, m)
+	}
+	messages[0].(*mockMessage).skip = true
+
+	results, err := mw.EnqueueStreaming(messages)
+	if err != nil {
+		ms.T().Fatalf("Unexpected error when enqueueing: %s", err)
+	}
+	var chunks []BatchStats
+	var reported []Mail
+	for cr := range results {
+		chunks = append(chunks, cr.Stats)
+		for _, r := range cr.Results {
+			reported = append(reported, r.Mail)
+		}
+	}
+	// The skipped message is delivered along with the first chunk
+	expected := []BatchStats{{Sent: 2, Skipped: 1}, {Sent: 1}}
+	if !reflect.DeepEqual(chunks, expected) {
+		ms.T().Fatalf("Unexpected chunk results. Expected %+v, Got %+v", expected, chunks)
+	}
+	if !reflect.DeepEqual(reported, messages) {
+		ms.T().Fatalf("Unexpected results. Expected every message in order, Got %v", reported)
+	}
+}
+
 func TestMailerSuite(t *testing.T) {
 	suite.Run(t, new(MailerSuite))
 }
@@ -0,0 +1,179 @@
+// Package mailertest provides Dialers and Senders for testing how the mailer
+// copes with misbehaving servers, without having to run one.
+package mailertest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/textproto"
+	"sync"
+	"time"
+
+	"github.com/gophish/gophish/mailer"
+)
+
+// ErrDialFailed is the error returned by ChaosDialer when a dial is made to
+// fail.
+var ErrDialFailed = errors.New("chaos: dial failed")
+
+// Operations of a Sender which can be slowed down with ChaosDialer's
+// OperationLatency.
+const (
+	OpDial  = "dial"
+	OpSend  = "send"
+	OpReset = "reset"
+	OpClose = "close"
+)
+
+// ChaosDialer wraps a Dialer, injecting latency and failures into the
+// connections it makes, to exercise the worker's backoff, reset and re-dial
+// logic under controlled conditions. It implements the same interfaces as the
+// Dialers the worker uses, so it can be dropped into any Mail's GetDialer.
+//
+// Settings must not be changed while the dialer is in use.
+type ChaosDialer struct {
+	mailer.Dialer
+	// Latency is added to every operation, as listed by the Op constants,
+	// along with a random duration of up to Jitter.
+	Latency time.Duration
+	Jitter  time.Duration
+	// OperationLatency adds latency to specific operations on top of
+	// Latency, for example to simulate a server which is slow to accept
+	// the message data.
+	OperationLatency map[string]time.Duration
+	// DialErrorRate is the probability, between 0 and 1, of a dial failing
+	// with ErrDialFailed.
+	DialErrorRate float64
+	// ErrorRate is the probability, between 0 and 1, of a Send failing with
+	// a reply using one of ErrorCodes, picked at random. ErrorCodes
+	// defaults to 421, a temporary error.
+	ErrorRate  float64
+	ErrorCodes []int
+	// DropAfter, if non-zero, makes every connection behave as if it was
+	// lost after sending that many messages: Send and Reset then fail with
+	// io.EOF.
+	DropAfter int
+	// Seed seeds the random decisions, so that a failing run can be
+	// reproduced. If zero, a seed based on the current time is used.
+	Seed int64
+
+	once sync.Once
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// Address returns the address of the wrapped Dialer, if it reports one.
+func (d *ChaosDialer) Address() string {
+	if hd, ok := d.Dialer.(mailer.HostDialer); ok {
+		return hd.Address()
+	}
+	return ""
+}
+
+// Dial connects with the wrapped Dialer unless the dial is made to fail.
+func (d *ChaosDialer) Dial() (mailer.Sender, error) {
+	d.delay(OpDial)
+	if d.chance(d.DialErrorRate) {
+		return nil, ErrDialFailed
+	}
+	s, err := d.Dialer.Dial()
+	if err != nil {
+		return nil, err
+	}
+	return &ChaosSender{Sender: s, dialer: d}, nil
+}
+
+// delay sleeps for the latency of the operation.
+func (d *ChaosDialer) delay(op string) {
+	latency := d.Latency + d.OperationLatency[op]
+	if d.Jitter > 0 {
+		d.mu.Lock()
+		latency += time.Duration(d.random().Int63n(int64(d.Jitter)))
+		d.mu.Unlock()
+	}
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+}
+
+// chance returns true with the given probability.
+func (d *ChaosDialer) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.random().Float64() < p
+}
+
+// replyError returns the error for a failed Send.
+func (d *ChaosDialer) replyError() error {
+	code := 421
+	if len(d.ErrorCodes) > 0 {
+		d.mu.Lock()
+		code = d.ErrorCodes[d.random().Intn(len(d.ErrorCodes))]
+		d.mu.Unlock()
+	}
+	return &textproto.Error{Code: code, Msg: fmt.Sprintf("chaos: injected %d reply", code)}
+}
+
+// random returns the dialer's source of randomness. The caller must hold the
+// lock.
+func (d *ChaosDialer) random() *rand.Rand {
+	d.once.Do(func() {
+		seed := d.Seed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		d.rand = rand.New(rand.NewSource(seed))
+	})
+	return d.rand
+}
+
+// ChaosSender is the Sender returned by ChaosDialer, wrapping the Sender of
+// the underlying Dialer.
+type ChaosSender struct {
+	mailer.Sender
+	dialer *ChaosDialer
+	sent   int
+}
+
+// Send sends the message with the wrapped Sender, unless the connection was
+// dropped or the send is made to fail. Failed sends don't reach the wrapped
+// Sender.
+func (s *ChaosSender) Send(from string, to []string, msg io.WriterTo) error {
+	s.dialer.delay(OpSend)
+	if s.dropped() {
+		return io.EOF
+	}
+	if s.dialer.chance(s.dialer.ErrorRate) {
+		return s.dialer.replyError()
+	}
+	if err := s.Sender.Send(from, to, msg); err != nil {
+		return err
+	}
+	s.sent++
+	return nil
+}
+
+// Reset resets the wrapped Sender, unless the connection was dropped.
+func (s *ChaosSender) Reset() error {
+	s.dialer.delay(OpReset)
+	if s.dropped() {
+		return io.EOF
+	}
+	return s.Sender.Reset()
+}
+
+// Close closes the wrapped Sender.
+func (s *ChaosSender) Close() error {
+	s.dialer.delay(OpClose)
+	return s.Sender.Close()
+}
+
+// dropped returns whether the connection is to be treated as lost.
+func (s *ChaosSender) dropped() bool {
+	return s.dialer.DropAfter > 0 && s.sent >= s.dialer.DropAfter
+}
@@ -0,0 +1,147 @@
+package mailertest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/gophish/gomail"
+	"github.com/gophish/gophish/mailer"
+)
+
+// recordingDialer is a Dialer whose Senders record the messages they send.
+type recordingDialer struct {
+	dials int
+	sent  int
+}
+
+func (d *recordingDialer) Dial() (mailer.Sender, error) {
+	d.dials++
+	return &recordingSender{dialer: d}, nil
+}
+
+type recordingSender struct {
+	dialer *recordingDialer
+}
+
+func (s *recordingSender) Send(from string, to []string, msg io.WriterTo) error {
+	if _, err := msg.WriteTo(io.Discard); err != nil {
+		return err
+	}
+	s.dialer.sent++
+	return nil
+}
+
+func (s *recordingSender) Close() error { return nil }
+func (s *recordingSender) Reset() error { return nil }
+
+// testMail is a Mail sent with the given Dialer, recording its outcome.
+type testMail struct {
+	dialer   mailer.Dialer
+	backoffs int
+	err      error
+	sent     bool
+}
+
+func (m *testMail) Backoff(reason error) error {
+	m.backoffs++
+	return nil
+}
+
+func (m *testMail) Error(err error) error {
+	m.err = err
+	return nil
+}
+
+func (m *testMail) Success() error {
+	m.sent = true
+	return nil
+}
+
+func (m *testMail) Generate(msg *gomail.Message) error {
+	msg.SetHeader("From", "from@example.com")
+	msg.SetHeader("To", "to@example.com")
+	msg.SetBody("text/plain", "Email")
+	return nil
+}
+
+func (m *testMail) GetDialer() (mailer.Dialer, error) {
+	return m.dialer, nil
+}
+
+func newTestMail(d mailer.Dialer, n int) ([]mailer.Mail, []*testMail) {
+	ms := make([]mailer.Mail, n)
+	tms := make([]*testMail, n)
+	for i := range ms {
+		tms[i] = &testMail{dialer: d}
+		ms[i] = tms[i]
+	}
+	return ms, tms
+}
+
+func TestDropAfter(t *testing.T) {
+	rd := &recordingDialer{}
+	d := &ChaosDialer{Dialer: rd, DropAfter: 2}
+	ms, tms := newTestMail(d, 5)
+	stats := (&mailer.Processor{}).ProcessChunk(context.Background(), d, ms)
+	if stats.Sent != 5 {
+		t.Fatalf("Unexpected stats. Expected every message to be sent, Got %+v", stats)
+	}
+	// Every dropped connection is dialed again
+	if rd.dials != 3 {
+		t.Fatalf("Unexpected number of dials. Expected %d, Got %d", 3, rd.dials)
+	}
+	for i, m := range tms {
+		if !m.sent {
+			t.Fatalf("Message %d wasn't sent", i)
+		}
+	}
+}
+
+func TestErrorRate(t *testing.T) {
+	rd := &recordingDialer{}
+	d := &ChaosDialer{Dialer: rd, ErrorRate: 1, ErrorCodes: []int{550}}
+	ms, tms := newTestMail(d, 3)
+	stats := (&mailer.Processor{}).ProcessChunk(context.Background(), d, ms)
+	if stats.Errors != 3 {
+		t.Fatalf("Unexpected stats. Expected every message to fail, Got %+v", stats)
+	}
+	if rd.sent != 0 {
+		t.Fatalf("Failed messages reached the wrapped Sender")
+	}
+	for i, m := range tms {
+		if m.err == nil {
+			t.Fatalf("Message %d wasn't errored out", i)
+		}
+	}
+}
+
+func TestDialErrorRate(t *testing.T) {
+	d := &ChaosDialer{Dialer: &recordingDialer{}, DialErrorRate: 1}
+	if _, err := d.Dial(); err != ErrDialFailed {
+		t.Fatalf("Unexpected error. Expected %v, Got %v", ErrDialFailed, err)
+	}
+}
+
+func TestSeed(t *testing.T) {
+	outcomes := func() []byte {
+		d := &ChaosDialer{Dialer: &recordingDialer{}, ErrorRate: 0.5, Seed: 42}
+		s, err := d.Dial()
+		if err != nil {
+			t.Fatalf("Unexpected error when dialing: %s", err)
+		}
+		var b bytes.Buffer
+		for i := 0; i < 20; i++ {
+			if s.Send("from@example.com", []string{"to@example.com"}, &bytes.Buffer{}) != nil {
+				b.WriteByte('x')
+			} else {
+				b.WriteByte('.')
+			}
+		}
+		return b.Bytes()
+	}
+	if first, second := outcomes(), outcomes(); !bytes.Equal(first, second) {
+		t.Fatalf("Runs with the same seed differ: %s and %s", first, second)
+	}
+}
@@ -2,8 +2,10 @@ package mailer
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
+	"sync"
 	"time"
 
 	"github.com/gophish/gomail"
@@ -49,6 +51,11 @@ func (md *mockDialer) Dial() (Sender, error) {
 	return md.dial()
 }
 
+// Address returns the address of the mock host
+func (md *mockDialer) Address() string {
+	return "mock.example.com:25"
+}
+
 // setDial sets the Dial function for the mockDialer
 func (md *mockDialer) setDial(dial func() (Sender, error)) {
 	md.dial = dial
@@ -83,7 +90,11 @@ func (ms *mockSender) defaultSend(mm *mockMessage) error {
 
 // Send just appends the provided message record to the internal slice
 func (ms *mockSender) Send(from string, to []string, msg io.WriterTo) error {
-	mm := newMockMessage(from, to, msg)
+	buff := &bytes.Buffer{}
+	if _, err := msg.WriteTo(buff); err != nil {
+		return err
+	}
+	mm := newMockMessage(from, to, buff)
 	ms.messages = append(ms.messages, mm)
 	ms.status = "sent"
 	return ms.send(mm)
@@ -104,6 +115,16 @@ func (ms *mockSender) Reset() error {
 	return nil
 }
 
+// compressedSender is a mockSender which reports that its connection
+// negotiated compression.
+type compressedSender struct {
+	*mockSender
+}
+
+func (cs *compressedSender) Compression() (string, bool) {
+	return "DEFLATE", true
+}
+
 // mockMessage holds the information sent via a call to MockClient.Send()
 type mockMessage struct {
 	from         string
@@ -114,6 +135,7 @@ type mockMessage struct {
 	getdialer    func() (Dialer, error)
 	err          error
 	finished     bool
+	skip         bool
 }
 
 func newMockMessage(from string, to []string, msg io.WriterTo) *mockMessage {
@@ -170,7 +192,225 @@ func (mm *mockMessage) Generate(message *gomail.Message) error {
 	return nil
 }
 
+// ShouldSend reports whether the message has been marked to be skipped
+func (mm *mockMessage) ShouldSend() bool {
+	return !mm.skip
+}
+
 func (mm *mockMessage) Success() error {
 	mm.finished = true
 	return nil
 }
+
+// concurrencyMessage is a mockMessage which records the maximum number of
+// its callbacks, or those of other messages sharing its group, that were
+// running at once.
+type concurrencyMessage struct {
+	*mockMessage
+	group   *concurrencyGroup
+	running func()
+}
+
+// concurrencyGroup tracks the callbacks running for a set of
+// concurrencyMessages.
+type concurrencyGroup struct {
+	mu      sync.Mutex
+	running int
+	max     int
+}
+
+func (cg *concurrencyGroup) enter() {
+	cg.mu.Lock()
+	cg.running++
+	if cg.running > cg.max {
+		cg.max = cg.running
+	}
+	cg.mu.Unlock()
+}
+
+func (cg *concurrencyGroup) exit() {
+	cg.mu.Lock()
+	cg.running--
+	cg.mu.Unlock()
+}
+
+func (cm *concurrencyMessage) CallbackGroup() interface{} {
+	return cm.group
+}
+
+func (cm *concurrencyMessage) Success() error {
+	cm.group.enter()
+	defer cm.group.exit()
+	cm.running()
+	return nil
+}
+
+// contextMessage is a mockMessage which records the context it was generated
+// with.
+type contextMessage struct {
+	*mockMessage
+	ctx context.Context
+}
+
+func (cm *contextMessage) GenerateContext(ctx context.Context, message *gomail.Message) error {
+	cm.ctx = ctx
+	return cm.mockMessage.Generate(message)
+}
+
+// reconnectMessage is a mockMessage which overrides the number of connection
+// attempts for its batch.
+type reconnectMessage struct {
+	*mockMessage
+	maxReconnects int
+}
+
+func (rm *reconnectMessage) MaxReconnects() int {
+	return rm.maxReconnects
+}
+
+// headerMessage is a mockMessage which provides extra headers for its
+// message.
+type headerMessage struct {
+	*mockMessage
+	headers map[string][]string
+}
+
+func (hm *headerMessage) ExtraHeaders() map[string][]string {
+	return hm.headers
+}
+
+// closeNotifySender is a mockSender which calls onClose when closed.
+type closeNotifySender struct {
+	*mockSender
+	onClose func()
+}
+
+func (cs *closeNotifySender) Close() error {
+	cs.onClose()
+	return cs.mockSender.Close()
+}
+
+// closeErrorSender is a mockSender whose Close returns closeErr.
+type closeErrorSender struct {
+	*mockSender
+	closeErr error
+}
+
+func (cs *closeErrorSender) Close() error {
+	cs.mockSender.Close()
+	return cs.closeErr
+}
+
+// flushSender is a mockSender which counts calls to Flush, returning err.
+type flushSender struct {
+	*mockSender
+	flushes int
+	err     error
+}
+
+func (fs *flushSender) Flush() error {
+	fs.flushes++
+	return fs.err
+}
+
+// keyedMessage is a mockMessage whose connection may be kept open between
+// batches.
+type keyedMessage struct {
+	*mockMessage
+	key string
+}
+
+func (km *keyedMessage) ConnectionKey() string {
+	return km.key
+}
+
+// resetErrorSender is a mockSender whose Reset fails with err.
+type resetErrorSender struct {
+	*mockSender
+	err error
+}
+
+func (rs *resetErrorSender) Reset() error {
+	rs.mockSender.Reset()
+	return rs.err
+}
+
+// labeledMessage is a mockMessage with labels.
+type labeledMessage struct {
+	*mockMessage
+	labels map[string]string
+}
+
+func (lm *labeledMessage) Labels() map[string]string {
+	return lm.labels
+}
+
+// fingerprintDialer is a mockDialer with a fingerprint.
+type fingerprintDialer struct {
+	*mockDialer
+	fingerprint string
+}
+
+func (fd *fingerprintDialer) Fingerprint() string {
+	return fd.fingerprint
+}
+
+// addressDialer is a mockDialer for a different host.
+type addressDialer struct {
+	*mockDialer
+	address string
+}
+
+func (ad *addressDialer) Address() string {
+	return ad.address
+}
+
+// generateMessage is a mockMessage which records the maximum number of Generate
+// calls of its group running at once.
+type generateMessage struct {
+	*mockMessage
+	group *concurrencyGroup
+}
+
+func (gm *generateMessage) Generate(message *gomail.Message) error {
+	gm.group.enter()
+	defer gm.group.exit()
+	time.Sleep(10 * time.Millisecond)
+	return gm.mockMessage.Generate(message)
+}
+
+// generateErrorMessage is a mockMessage which fails to generate with
+// generateErr.
+type generateErrorMessage struct {
+	*mockMessage
+	generateErr error
+}
+
+func (gm *generateErrorMessage) Generate(message *gomail.Message) error {
+	return gm.generateErr
+}
+
+// noopSender is a mockSender which counts calls to Noop, failing them once
+// fail is set.
+type noopSender struct {
+	*mockSender
+	mu    sync.Mutex
+	noops int
+	fail  bool
+}
+
+func (ns *noopSender) Noop() error {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	ns.noops++
+	if ns.fail {
+		return errHostUnreachable
+	}
+	return nil
+}
+
+func (ns *noopSender) noopCount() int {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	return ns.noops
+}
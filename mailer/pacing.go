@@ -0,0 +1,47 @@
+package mailer
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultPacingWait is how long the worker waits before consulting a
+// PacingFunc again when it doesn't permit sending and gives no hint.
+var DefaultPacingWait = time.Second
+
+// PacingFunc decides whether a message may be sent now, given how many of
+// the messages of the batch have been processed so far and its size, so that
+// sending can follow an arbitrary curve over time, such as front-loading a
+// campaign or only sending during the recipients' working hours. When it
+// doesn't permit a send, the worker waits for waitHint, or DefaultPacingWait
+// if it isn't positive, and consults it again.
+//
+// Messages count as processed whether they were sent, backed off or
+// errored. When a Processor is used directly through ProcessChunk, the counts
+// are those of the chunk.
+type PacingFunc func(now time.Time, sentSoFar, total int) (permitNow bool, waitHint time.Duration)
+
+// pace waits until the PacingFunc permits sending the next message of the
+// chunk of the given size. It returns the context's error if it is cancelled
+// while waiting, in which case the rest of the chunk is left untouched.
+func (p *Processor) pace(ctx context.Context, t *tally, chunk int) error {
+	if p.PacingFunc == nil {
+		return nil
+	}
+	sent, total := t.stats.Total(), chunk
+	if t.prog != nil {
+		sent, total = t.prog.processed, t.prog.total
+	}
+	for {
+		permit, wait := p.PacingFunc(time.Now(), sent, total)
+		if permit {
+			return nil
+		}
+		if wait <= 0 {
+			wait = DefaultPacingWait
+		}
+		if err := waitRetry(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+func (ms *MailerSuite) TestPacingFunc() {
+	defer func(size int, delay time.Duration) {
+		MailChunkSize = size
+		MailDelayTime = delay
+	}(MailChunkSize, MailDelayTime)
+	MailChunkSize = 2
+	MailDelayTime = 0
+
+	mw := NewMailWorker()
+	var calls [][2]int
+	denied := false
+	mw.PacingFunc = func(now time.Time, sent, total int) (bool, time.Duration) {
+		calls = append(calls, [2]int{sent, total})
+		// Hold back the second message once
+		if sent == 1 && !denied {
+			denied = true
+			return false, time.Millisecond
+		}
+		return true, 0
+	}
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		sender := newMockSender()
+		sender.setSend(func(*mockMessage) error { return nil })
+		return sender, nil
+	})
+	var messages []Mail
+	for i := 0; i < 3; i++ {
+		m := newMockMessage(fmt.Sprintf("%d@example.com", i), []string{"to@example.com"}, bytes.NewBufferString("Email"))
+		m.setDialer(func() (Dialer, error) { return dialer, nil })
+		messages = append(messages, m)
+	}
+	mw.processBatch(context.Background(), messages)
+
+	// The counts span the chunks of the batch
+	expected := [][2]int{{0, 3}, {1, 3}, {1, 3}, {2, 3}}
+	if !reflect.DeepEqual(calls, expected) {
+		ms.T().Fatalf("Unexpected PacingFunc calls. Expected %v, Got %v", expected, calls)
+	}
+	for _, m := range messages {
+		if !m.(*mockMessage).finished {
+			ms.T().Fatalf("Message %s wasn't sent", m.(*mockMessage).from)
+		}
+	}
+}
+
+func (ms *MailerSuite) TestPacingFuncCancelled() {
+	p := &Processor{}
+	p.PacingFunc = func(now time.Time, sent, total int) (bool, time.Duration) {
+		return false, time.Hour
+	}
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		return newMockSender(), nil
+	})
+	messages := generateMessages(dialer)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	stats := p.ProcessChunk(ctx, dialer, messages)
+
+	// Messages held back when the context is cancelled are left untouched
+	if stats.Total() != 0 {
+		ms.T().Fatalf("Unexpected stats while held back. Got %+v", stats)
+	}
+	for _, m := range messages {
+		if mm := m.(*mockMessage); mm.finished || mm.backoffCount != 0 {
+			ms.T().Fatalf("Message %s held back was modified", mm.from)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package mailer
+
+import (
+	"context"
+	"time"
+)
+
+// ProbeResult describes the connection Probe made to a host.
+type ProbeResult struct {
+	// Address is the address of the host, if the Dialer reports it.
+	Address string
+	// ConnectTime is how long it took to get a Sender from the Dialer,
+	// including the handshake and authentication for SMTPDialer.
+	ConnectTime time.Duration
+	// Compression is the compression algorithm the connection negotiated,
+	// if any.
+	Compression string
+	// ChunkingAdvertised is set if the server advertised the CHUNKING
+	// extension, and Chunking if the connection would use it.
+	ChunkingAdvertised bool
+	Chunking           bool
+	// SMTPUTF8 is set if the server advertised the SMTPUTF8 extension.
+	SMTPUTF8 bool
+	// Noop is set if the Sender implements NoopSender and the server
+	// accepted the NOOP command.
+	Noop bool
+	// Capabilities are the extensions the server advertised, if the
+	// Sender implements ExtensionSender.
+	Capabilities Capabilities
+}
+
+// Probe connects to the host of the Dialer the way the worker would before
+// sending a batch, reports what the connection supports and closes it
+// without sending any mail. If the Sender implements NoopSender, a NOOP is
+// sent as well to make sure the server answers commands once connected.
+//
+// This lets callers check that a sending profile can reach and authenticate
+// to its server before launching a campaign. The returned error is the one
+// which would have failed the batch, or the one returned by the NOOP or when
+// closing the connection. If the context is cancelled before a connection is
+// made, its error is returned.
+func Probe(ctx context.Context, dialer Dialer) (ProbeResult, error) {
+	result := ProbeResult{Address: dialerAddress(dialer)}
+	start := time.Now()
+	sender, err := dialHost(ctx, dialer, MaxReconnectAttempts)
+	if err != nil {
+		return result, err
+	}
+	if sender == nil {
+		return result, ctx.Err()
+	}
+	result.ConnectTime = time.Since(start)
+	result.Capabilities = capabilitiesOf(sender)
+	if cs, ok := sender.(CompressionSender); ok {
+		if algorithm, compressed := cs.Compression(); compressed {
+			result.Compression = algorithm
+		}
+	}
+	if cs, ok := sender.(ChunkingSender); ok {
+		result.ChunkingAdvertised, result.Chunking = cs.Chunking()
+	}
+	if us, ok := sender.(UTF8Sender); ok {
+		result.SMTPUTF8 = us.SMTPUTF8()
+	}
+	if ns, ok := sender.(NoopSender); ok {
+		if err := ns.Noop(); err != nil {
+			sender.Close()
+			return result, err
+		}
+		result.Noop = true
+	}
+	return result, sender.Close()
+}
@@ -0,0 +1,50 @@
+package mailer
+
+import (
+	"context"
+)
+
+func (ms *MailerSuite) TestProbe() {
+	server := newFakeSMTPServer()
+	defer server.Close()
+	server.extensions = append(server.extensions, "CHUNKING", "SMTPUTF8")
+
+	d := server.dialer()
+	result, err := Probe(context.Background(), d)
+	if err != nil {
+		ms.T().Fatalf("Unexpected error when probing: %s", err)
+	}
+	if result.Address != d.Address() {
+		ms.T().Fatalf("Unexpected address. Expected %s, Got %s", d.Address(), result.Address)
+	}
+	if !result.ChunkingAdvertised || result.Chunking {
+		ms.T().Fatalf("Unexpected chunking state. Expected advertised and disabled, Got %t and %t", result.ChunkingAdvertised, result.Chunking)
+	}
+	if !result.SMTPUTF8 {
+		ms.T().Fatalf("Expected SMTPUTF8 to be reported")
+	}
+	if !result.Noop || result.ConnectTime <= 0 {
+		ms.T().Fatalf("Unexpected probe result: %+v", result)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.noops != 1 {
+		ms.T().Fatalf("Unexpected number of NOOP commands. Expected %d, Got %d", 1, server.noops)
+	}
+	if len(server.mails) != 0 {
+		ms.T().Fatalf("Expected no mail to be sent, Got %d MAIL commands", len(server.mails))
+	}
+}
+
+func (ms *MailerSuite) TestProbeUnreachable() {
+	md := newMockDialer()
+	md.setDial(md.unreachableDial)
+	_, err := Probe(context.Background(), md)
+	if err != ErrMaxConnectAttempts {
+		ms.T().Fatalf("Unexpected error. Expected %s, Got %v", ErrMaxConnectAttempts, err)
+	}
+	if md.dialCount != MaxReconnectAttempts {
+		ms.T().Fatalf("Unexpected number of dial attempts. Expected %d, Got %d", MaxReconnectAttempts, md.dialCount)
+	}
+}
@@ -0,0 +1,1017 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gophish/gomail"
+)
+
+// Processor sends chunks of Mail instances over a single connection, handling
+// the outcome of every message: classifying send errors, backing off or
+// erroring out Mail, resetting and re-dialing the connection. MailWorker
+// delegates to a Processor for every chunk of the batches it receives, and
+// alternative schedulers can use a Processor of their own to send the chunks
+// they pick with the same logic.
+//
+// The zero value is ready to use. A Processor's settings must not be changed
+// while chunks are being sent.
+type Processor struct {
+	// OnResult, if set, is called once for every Mail instance the Processor
+	// is finished with, after the corresponding Success, Backoff or Error
+	// method has been called. Skipped Mail is reported even though none of
+	// those methods are called.
+	OnResult func(m Mail, r Result)
+	// MessageSettings are applied to the gomail.Message each Mail instance is
+	// generated into, such as gomail.SetEncoding to choose the default
+	// Content-Transfer-Encoding or gomail.SetCharset. Mail instances needing
+	// a specific encoding for a part can use gomail.SetPartEncoding in
+	// Generate.
+	MessageSettings []gomail.MessageSetting
+	// Encoder, if set, is given each generated message and returns what is
+	// written to the server in its place. Since gomail handles the MIME
+	// encoding itself, this is the integration point for deployments needing
+	// full control over the bytes on the wire. The envelope is still taken
+	// from the generated message's headers.
+	Encoder func(m Mail, msg io.WriterTo) io.WriterTo
+	// SlowSendThreshold, if non-zero, is the time after which a single send
+	// is considered slow. Slow sends are logged along with the host and the
+	// recipients, and reported to OnSlowSend if set.
+	SlowSendThreshold time.Duration
+	OnSlowSend        func(m Mail, host string, to []string, elapsed time.Duration)
+	// AuditFunc, if set, is called with an AuditRecord for every attempt at
+	// sending a message, including those which are backed off. Unlike
+	// OnResult, it may be called more than once for the same Mail. It is
+	// called synchronously from the sending goroutine, so implementations
+	// which may be slow should hand the record off rather than block.
+	AuditFunc func(record AuditRecord)
+	// RedirectFunc, if set, rewrites the envelope recipients of every
+	// message before it is sent, for example to deliver all mail to a test
+	// mailbox in staging environments. The headers of the message are left
+	// untouched. If PreserveOriginalRecipients is set, the original
+	// recipients are added to the message in an X-Original-To header.
+	RedirectFunc               func(to []string) []string
+	PreserveOriginalRecipients bool
+	// DedupeRecipients makes the worker remove duplicate envelope
+	// recipients of a message, once redirected, so the same address isn't
+	// sent more than one copy of it. Addresses are compared ignoring case
+	// and surrounding whitespace, and the first occurrence is kept. The
+	// number of recipients removed is counted in the host's
+	// DuplicateRecipients stats.
+	DedupeRecipients bool
+	// GenerateWorkers, if greater than 1, is the number of goroutines used
+	// to generate the messages of a chunk ahead of sending them, so that
+	// expensive Generate calls overlap with the transmission of earlier
+	// messages. Messages are still sent in order. Generate may then be
+	// called concurrently for different Mail instances.
+	GenerateWorkers int
+	// ArchiveRecipient, if set, is sent a copy of every message accepted by
+	// the server. The copy is sent separately over the same connection with
+	// only the archive address in the envelope, so the original recipients
+	// never see it. Failing to archive a message is logged but doesn't
+	// affect the outcome of the Mail, nor the Processor's statistics.
+	ArchiveRecipient string
+	// KeepGeneratedHeaders makes headers set by Generate take precedence
+	// over those returned by a HeaderProvider's ExtraHeaders. By default,
+	// the extra headers override them.
+	KeepGeneratedHeaders bool
+	// AdaptiveRate, if set, paces the messages sent to each host, slowing
+	// down when the host defers messages and speeding up again as it
+	// accepts them. See AdaptiveRate for details.
+	AdaptiveRate *AdaptiveRate
+	// AdaptiveConcurrency, if set, limits how many chunks are sent to each
+	// host at the same time, lowering the limit while the host returns
+	// errors. See AdaptiveConcurrency for details.
+	AdaptiveConcurrency *AdaptiveConcurrency
+	// MaxOpenConnections, if greater than zero, is the maximum number of
+	// connections the Processor keeps open at once, across every chunk
+	// and host. Chunks wait for a connection to be closed before dialing once
+	// the limit is reached. It must be set before the first chunk is sent.
+	MaxOpenConnections int
+	// OnReset, if set, is called every time the Processor resets a connection,
+	// with the reason for the reset and the error returned by the Sender's
+	// Reset method, if any. Reset errors are also logged.
+	OnReset func(reason ResetReason, err error)
+	// OnConnect, if set, is called with the Capabilities of every new
+	// connection, including those made to replace a lost one, once it is
+	// ready to send.
+	OnConnect func(host string, caps Capabilities)
+	// OnNewConnection, if set, is called with the Sender of every new
+	// connection, including those made to replace a lost one, right after
+	// OnConnect and before anything is sent on it. Unlike OnConnect it
+	// gives access to the Sender itself, so that connection-scoped state
+	// can be inspected or prepared. It must not send on or close the
+	// Sender.
+	OnNewConnection func(sender Sender, host string)
+	// OnConnectionClose, if set, is called every time the Processor closes
+	// a connection, including idle ones, with the error returned by the
+	// Sender's Close method, if any. Close errors are also logged.
+	OnConnectionClose func(host string, err error)
+	// ConnectionPolicy determines how long connections are used, and when
+	// they are reset or replaced. Its fields can be set on the Processor
+	// directly.
+	ConnectionPolicy
+	// ConnectionRate, if greater than zero, limits how many connection
+	// attempts are made per second, across every chunk and host, allowing
+	// bursts of up to ConnectionBurst attempts. This is independent of the
+	// rate at which messages are sent, and avoids tripping firewalls which
+	// limit the rate of new connections.
+	ConnectionRate  float64
+	ConnectionBurst int
+	// RetryPolicy, if set, decides whether a message which failed to send
+	// is retried, backed off or errored out. It defaults to
+	// DefaultRetryPolicy. Messages are retried in place, before the rest of
+	// the chunk is sent, so retries don't change the order the messages of
+	// a batch are sent in.
+	RetryPolicy RetryPolicy
+	// OnRetryTransform, if set, is called before a message is retried
+	// because RetryPolicy returned ActionRetry, ahead of the retry delay,
+	// with the attempt which failed. It may adjust the Mail, for example to
+	// fall back to a plaintext body after repeated failures, and the
+	// message is generated again afterwards so the changes take effect.
+	OnRetryTransform func(m Mail, attempt int)
+	// GenerateErrorClassifier, if set, decides what happens to a message
+	// which failed to generate, so that transient failures such as the
+	// template data being momentarily unavailable can be backed off and
+	// retried later. Messages are errored out unless it returns
+	// ActionBackoff, which is also what happens when it isn't set.
+	GenerateErrorClassifier func(err error) Action
+	// MaxConcurrentPerDomain, if greater than zero, limits how many
+	// messages are sent at the same time to each recipient domain, across
+	// every chunk and connection. Messages wait for a slot for each of
+	// their recipients' domains before being sent. It must be set before
+	// the first chunk is sent.
+	MaxConcurrentPerDomain int
+	// MaxBytesPerSecond, if at least 1, limits how fast messages are
+	// written to the connections of every chunk, combined, so that sending
+	// doesn't saturate a constrained uplink. Bytes are counted as
+	// serialized, after the Encoder, with short bursts of up to a second
+	// worth of bytes.
+	MaxBytesPerSecond float64
+	// PacingFunc, if set, is consulted before every message is sent, and
+	// holds it back until it permits the send. The connection is kept open
+	// while waiting, so long waits are best combined with small chunks.
+	PacingFunc PacingFunc
+	// CancelGrace, if non-zero, lets a message which is being sent when the
+	// context is cancelled keep going for up to CancelGrace before it is
+	// abandoned and backed off, so that a nearly complete send isn't
+	// wasted on shutdown. This covers the waits which are part of a send,
+	// such as those imposed by MaxBytesPerSecond and
+	// MaxConcurrentPerDomain. By default they are abandoned right away. A
+	// Sender blocked in Send can't be interrupted either way. The rest of
+	// the chunk is never started once the context is cancelled.
+	CancelGrace time.Duration
+	// AutoSplitOnRecipientLimit makes the Processor recover when the server
+	// refuses a transaction for having too many recipients (a 452 reply
+	// with an enhanced status of 4.5.3, or mentioning too many
+	// recipients). Rather than backing the message off, it is sent again in
+	// smaller transactions over the same connection: the recipients are
+	// split in two when the whole transaction is refused, and those refused
+	// by a RecipientSender after others were accepted are sent on their
+	// own. The message is otherwise reported as usual, as a partial
+	// delivery if some of its recipients are still rejected in the end.
+	AutoSplitOnRecipientLimit bool
+	// AtomicChunks makes the Processor back off the rest of a chunk, with
+	// ErrChunkBackedOff, as soon as one of its messages is backed off, so
+	// that the messages which haven't been sent yet are retried together.
+	// Messages of the chunk which were already sent are left alone, so
+	// they aren't sent twice. Chunks are made of the messages of a batch in
+	// order, up to MailChunkSize at a time.
+	AtomicChunks bool
+	// Tracking, if set, records the Message-Id of every message sent.
+	// Messages generated without a Message-Id header are given a random
+	// one.
+	Tracking TrackingStore
+	// PreSendAckFunc, if set, is called immediately before every attempt at
+	// sending a message, so the application can durably record that it is
+	// about to be sent, for example to detect duplicates after a crash. It
+	// is called once the message has waited for AdaptiveRate and
+	// MaxConcurrentPerDomain, been generated and had its recipients
+	// redirected, right before the Sender's Send. MaxBytesPerSecond paces
+	// the Send itself, so it applies afterwards. If PreSendAckFunc returns
+	// an error, the Mail is backed off with it without being sent.
+	// Together with Tracking, which records messages once they are sent,
+	// it brackets the send.
+	PreSendAckFunc func(m Mail) error
+	// MaxConcurrentGenerate, if greater than zero, limits how many messages
+	// are generated at the same time, across every chunk and including
+	// those generated ahead by GenerateWorkers, so rendering heavy
+	// templates doesn't saturate the CPU regardless of how many chunks are
+	// being sent. It must be set before the first chunk is sent.
+	MaxConcurrentGenerate int
+	// Failures, if set, retains the most recent Mail instances which were
+	// errored out, along with the error, for inspection.
+	Failures *FailureBuffer
+	// OnSpamRejection, if set, is called with the server's reply for every
+	// message it rejects as spam, once the Mail has been backed off or
+	// errored out as usual, so the application can react, for example by
+	// pausing the campaign to protect the sender's reputation. Replies are
+	// recognized by SpamRejectionFunc, which defaults to
+	// DefaultSpamRejection.
+	OnSpamRejection   func(m Mail, err *textproto.Error)
+	SpamRejectionFunc func(err *textproto.Error) bool
+	// RecipientCooldown, if non-zero, is the minimum time between two
+	// messages sent to the same recipient, across every chunk, so that
+	// concurrent campaigns don't mail the same person twice in quick
+	// succession. Addresses are compared ignoring case and surrounding
+	// whitespace, once redirected. A message to a recipient sent to more
+	// recently is backed off with ErrRecipientCooldown, or skipped if
+	// SkipCooldownRecipients is set. Messages count from the moment they
+	// start being sent, unless they end up not being sent to the recipient.
+	// At most MaxCooldownRecipients recipients are remembered, defaulting to
+	// DefaultMaxCooldownRecipients, the oldest being forgotten first.
+	RecipientCooldown      time.Duration
+	SkipCooldownRecipients bool
+	MaxCooldownRecipients  int
+
+	callbacks   keyedMutex
+	hosts       hostStats
+	rates       rateControllers
+	concurrency concurrencyControllers
+	domains     keyedSemaphore
+	written     tokenBucket
+	idle        idleConnections
+	cooldowns   recipientCooldowns
+
+	connSlots     chan struct{}
+	connSlotsOnce sync.Once
+	genSlots      chan struct{}
+	genSlotsOnce  sync.Once
+	dials         tokenBucket
+}
+
+// BatchStats summarises how the Mail instances of a chunk were processed.
+type BatchStats struct {
+	Sent     int `json:"sent"`
+	Partial  int `json:"partial"`
+	Backoffs int `json:"backoffs"`
+	Errors   int `json:"errors"`
+	Skipped  int `json:"skipped"`
+	// Err is the error which stopped the chunk from being sent, such as
+	// failing to connect to the host. The Mail instances which weren't sent
+	// because of it are counted in Errors.
+	Err error `json:"-"`
+}
+
+// Total returns the number of Mail instances processed.
+func (bs BatchStats) Total() int {
+	return bs.Sent + bs.Partial + bs.Backoffs + bs.Errors + bs.Skipped
+}
+
+// add counts n Mail instances with the given outcome.
+func (bs *BatchStats) add(o Outcome, n int) {
+	switch o {
+	case OutcomeSuccess:
+		bs.Sent += n
+	case OutcomeBackoff:
+		bs.Backoffs += n
+	case OutcomeError:
+		bs.Errors += n
+	case OutcomeSkipped:
+		bs.Skipped += n
+	case OutcomePartial:
+		bs.Partial += n
+	}
+}
+
+// tally accumulates the BatchStats of a chunk while reporting the progress of
+// the batch it belongs to.
+type tally struct {
+	stats BatchStats
+	prog  *progress
+}
+
+// add counts n Mail instances with the given outcome.
+func (t *tally) add(o Outcome, n int) {
+	t.stats.add(o, n)
+	t.prog.add(n)
+}
+
+// ProcessChunk sends the Mail instances over a single connection made with the
+// dialer, calling the Success, Backoff or Error method of each depending on
+// the outcome. The number of connection attempts follows the first Mail, as
+// described by ReconnectLimiter.
+//
+// If the context is cancelled before all of the mail are sent, ProcessChunk
+// returns and does not modify the remaining Mail instances.
+func (p *Processor) ProcessChunk(ctx context.Context, dialer Dialer, ms []Mail) BatchStats {
+	if len(ms) == 0 {
+		return BatchStats{}
+	}
+	return p.processChunk(ctx, dialer, ms, maxReconnects(ms[0]), nil)
+}
+
+// DumpMessage generates the message for the Mail instance and returns the
+// bytes which would be written to the server, after applying the
+// MessageSettings, any extra headers and the Encoder. Nothing is sent and none
+// of the Mail's Success, Backoff or Error methods are called, which makes it
+// safe to use for debugging live campaigns.
+func (p *Processor) DumpMessage(m Mail) ([]byte, error) {
+	message := gomail.NewMessage(p.MessageSettings...)
+	if err := p.generate(context.Background(), message, m); err != nil {
+		return nil, err
+	}
+	var msg io.WriterTo = message
+	if p.Encoder != nil {
+		msg = p.Encoder(m, msg)
+	}
+	buf := &bytes.Buffer{}
+	if _, err := msg.WriteTo(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// errorMail is a helper to handle erroring out a slice of Mail instances
+// in the case that an unrecoverable error occurs.
+func (p *Processor) errorMail(ctx context.Context, err error, ms []Mail) {
+	for _, m := range ms {
+		p.fail(ctx, m, err)
+	}
+}
+
+// success marks the Mail as successfully sent, with what the Sender reported
+// about the delivery.
+func (p *Processor) success(ctx context.Context, m Mail, d delivery) {
+	defer p.lockCallbacks(m)()
+	m.Success()
+	p.report(m, Result{Context: ctx, Outcome: OutcomeSuccess, Response: d.response, Timings: d.timings})
+}
+
+// partial marks the Mail as sent to the accepted recipients only.
+func (p *Processor) partial(ctx context.Context, m Mail, d delivery) {
+	defer p.lockCallbacks(m)()
+	m.Success()
+	p.report(m, Result{
+		Context:  ctx,
+		Outcome:  OutcomePartial,
+		Accepted: d.accepted(),
+		Rejected: d.rejected,
+		Response: d.response,
+		Timings:  d.timings,
+	})
+}
+
+// backoff backs off the Mail after a temporary error.
+func (p *Processor) backoff(ctx context.Context, m Mail, reason error) {
+	defer p.lockCallbacks(m)()
+	m.Backoff(reason)
+	p.report(m, Result{Context: ctx, Outcome: OutcomeBackoff, Err: reason})
+}
+
+// fail errors out the Mail after a permanent error.
+func (p *Processor) fail(ctx context.Context, m Mail, err error) {
+	defer p.lockCallbacks(m)()
+	m.Error(err)
+	p.recordFailure(m, err)
+	p.report(m, Result{Context: ctx, Outcome: OutcomeError, Err: err})
+}
+
+// generateFailed backs off or errors out the Mail after it failed to
+// generate, as decided by the GenerateErrorClassifier, returning the outcome.
+func (p *Processor) generateFailed(ctx context.Context, m Mail, err error) Outcome {
+	if p.GenerateErrorClassifier != nil && p.GenerateErrorClassifier(err) == ActionBackoff {
+		p.backoff(ctx, m, err)
+		return OutcomeBackoff
+	}
+	p.fail(ctx, m, err)
+	return OutcomeError
+}
+
+// skip reports that the Mail was not attempted.
+func (p *Processor) skip(ctx context.Context, m Mail, reason error) {
+	defer p.lockCallbacks(m)()
+	p.report(m, Result{Context: ctx, Outcome: OutcomeSkipped, Err: reason})
+}
+
+// lockCallbacks acquires the lock serializing the callbacks for the Mail,
+// returning the function to release it. Mail instances are grouped by their
+// CallbackGroup if they implement CallbackGrouper, and by identity otherwise.
+func (p *Processor) lockCallbacks(m Mail) func() {
+	var key interface{} = m
+	if g, ok := m.(CallbackGrouper); ok {
+		key = g.CallbackGroup()
+	}
+	return p.callbacks.lock(key)
+}
+
+// report passes the Result for the Mail to the OnResult hook, if set, and to
+// SendOneResult or EnqueueStreaming if they are waiting for it.
+func (p *Processor) report(m Mail, r Result) {
+	r.Labels = mailLabels(m)
+	observeResult(m, r)
+	if p.OnResult != nil {
+		p.OnResult(m, r)
+	}
+}
+
+// processChunk sends the Mail instances over a single connection, making at
+// most attempts attempts to connect, and reports their progress to prog.
+// If we fail to connect to the host, the Mail instances are errored out and
+// the connection error is returned in the BatchStats.
+func (p *Processor) processChunk(ctx context.Context, dialer Dialer, ms []Mail, attempts int, prog *progress) BatchStats {
+	t := &tally{prog: prog}
+	host := dialerAddress(dialer)
+	// If we're cancelled while waiting for our turn, the chunk is left
+	// untouched.
+	release, err := p.acquireHost(ctx, host)
+	if err != nil {
+		return t.stats
+	}
+	defer release()
+	key, persistent := p.persistentKey(ms[0], dialer, host)
+	var conn *connection
+	if persistent {
+		conn = p.idle.take(key)
+	}
+	if conn != nil {
+		// If the connection died while idle, sending the first message
+		// fails and the retry policy re-dials with this chunk's settings.
+		conn.dialer, conn.attempts = dialer, attempts
+	} else {
+		conn = &connection{
+			host:     host,
+			dialer:   dialer,
+			attempts: attempts,
+		}
+		err := p.dial(ctx, conn)
+		if err != nil {
+			p.errorMail(ctx, err, ms)
+			t.add(OutcomeError, len(ms))
+			t.stats.Err = err
+			return t.stats
+		}
+	}
+	defer func() {
+		if persistent && conn.sender != nil && ctx.Err() == nil {
+			p.idle.put(key, conn, p.IdleConnectionTimeout, p.IdleKeepAlive)
+			return
+		}
+		conn.close()
+	}()
+	if p.GenerateWorkers > 1 {
+		p.sendPipelined(ctx, conn, ms, t)
+		return t.stats
+	}
+	message := gomail.NewMessage(p.MessageSettings...)
+	for i, m := range ms {
+		// If we're cancelled, possibly while waiting to send, the rest of
+		// the chunk is left untouched.
+		if ctx.Err() != nil || p.pace(ctx, t, len(ms)) != nil || p.acquireSend(ctx, conn.host) != nil {
+			return t.stats
+		}
+		if err := p.generate(ctx, message, m); err != nil {
+			if ctx.Err() != nil {
+				return t.stats
+			}
+			t.add(p.generateFailed(ctx, m, err), 1)
+			continue
+		}
+		if !p.send(ctx, conn, message, m, ms[i+1:], t) {
+			return t.stats
+		}
+	}
+	return t.stats
+}
+
+// send sends a generated Mail instance, counting its outcome. If we lost the
+// connection and couldn't get it back, there's no point trying to send the
+// rest of the chunk: the remaining Mail instances are errored out and send
+// returns false. With AtomicChunks, the rest of the chunk is backed off
+// after a backoff.
+func (p *Processor) send(ctx context.Context, conn *connection, message *gomail.Message, m Mail, rest []Mail, t *tally) bool {
+	o, err := p.sendMessage(ctx, conn, message, m)
+	t.add(o, 1)
+	if err != nil {
+		p.errorMail(ctx, err, rest)
+		t.add(OutcomeError, len(rest))
+		t.stats.Err = err
+		return false
+	}
+	if o == OutcomeBackoff && p.AtomicChunks {
+		for _, r := range rest {
+			p.backoff(ctx, r, ErrChunkBackedOff)
+		}
+		t.add(OutcomeBackoff, len(rest))
+		return false
+	}
+	return true
+}
+
+// connected records telemetry about a freshly dialed connection to the host.
+func (p *Processor) connected(host string, sender Sender) {
+	compressed := false
+	if cs, ok := sender.(CompressionSender); ok {
+		var algorithm string
+		algorithm, compressed = cs.Compression()
+		if compressed {
+			Logger.Printf("Connection to %s negotiated %s compression\n", host, algorithm)
+		} else {
+			Logger.Printf("Connection to %s is not compressed\n", host)
+		}
+	}
+	chunking := false
+	if cs, ok := sender.(ChunkingSender); ok {
+		var advertised bool
+		advertised, chunking = cs.Chunking()
+		switch {
+		case chunking:
+			Logger.Printf("Connection to %s sends messages with BDAT\n", host)
+		case advertised:
+			Logger.Printf("Connection to %s supports CHUNKING, but it is disabled\n", host)
+		}
+	}
+	p.hosts.recordConnection(host, compressed, chunking)
+}
+
+// generate resets the message and has the Mail instance fill it in.
+func (p *Processor) generate(ctx context.Context, message *gomail.Message, m Mail) error {
+	release, err := p.acquireGenerate(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	message.Reset()
+	if g, ok := m.(ContextGenerator); ok {
+		err = g.GenerateContext(ctx, message)
+	} else {
+		err = m.Generate(message)
+	}
+	if err != nil {
+		return err
+	}
+	if hp, ok := m.(HeaderProvider); ok {
+		p.setExtraHeaders(message, hp.ExtraHeaders())
+	}
+	return p.setMessageID(message)
+}
+
+// acquireGenerate waits for a slot to generate a message if
+// MaxConcurrentGenerate is set, returning the function used to free it. It
+// returns the context's error if it is cancelled while waiting.
+func (p *Processor) acquireGenerate(ctx context.Context) (func(), error) {
+	if p.MaxConcurrentGenerate <= 0 {
+		return func() {}, nil
+	}
+	p.genSlotsOnce.Do(func() {
+		p.genSlots = make(chan struct{}, p.MaxConcurrentGenerate)
+	})
+	select {
+	case p.genSlots <- struct{}{}:
+		return func() { <-p.genSlots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// setExtraHeaders sets the headers returned by a HeaderProvider on the
+// message, following the worker's KeepGeneratedHeaders policy.
+func (p *Processor) setExtraHeaders(message *gomail.Message, headers map[string][]string) {
+	for field, values := range headers {
+		if p.KeepGeneratedHeaders && len(message.GetHeader(field)) > 0 {
+			continue
+		}
+		message.SetHeader(field, values...)
+	}
+}
+
+// sendMessage sends a single generated Mail instance over the provided
+// connection, calling the appropriate Success, Backoff or Error method
+// depending on the outcome.
+//
+// If the ConnectionPolicy says the connection should be replaced, for example
+// because it is older than MaxConnectionAge, we reconnect before sending. If
+// the connection turns out to have been lost, we reconnect and try sending the
+// message once more. If we can't reconnect, the message is errored out and the
+// connection error is returned.
+func (p *Processor) sendMessage(ctx context.Context, conn *connection, message *gomail.Message, m Mail) (Outcome, error) {
+	if reason := p.replacement(conn); reason != "" {
+		Logger.Printf("Connection to %s %s, reconnecting\n", conn.host, reason)
+		if err := p.redial(ctx, conn); err != nil {
+			p.fail(ctx, m, err)
+			return OutcomeError, err
+		}
+	}
+	if err := p.probeIdle(ctx, conn); err != nil {
+		p.fail(ctx, m, err)
+		return OutcomeError, err
+	}
+	var d delivery
+	action := ActionRetry
+	for attempt := 1; action == ActionRetry; attempt++ {
+		sendCtx, stop := p.graceContext(ctx)
+		d = p.transmit(sendCtx, conn, message, m, attempt)
+		stop()
+		if d.interrupted || d.unacked {
+			p.backoff(ctx, m, d.err)
+			return OutcomeBackoff, nil
+		}
+		if d.cooling {
+			if p.SkipCooldownRecipients {
+				p.skip(ctx, m, d.err)
+				return OutcomeSkipped, nil
+			}
+			p.backoff(ctx, m, d.err)
+			return OutcomeBackoff, nil
+		}
+		if d.err == nil || d.err == ErrNoRecipients || errors.Is(d.err, ErrUnsupportedRecipient) {
+			break
+		}
+		var delay time.Duration
+		action, delay = p.retryPolicy()(ctx, m, attempt, d.err)
+		if action != ActionRetry {
+			break
+		}
+		if p.OnRetryTransform != nil {
+			p.OnRetryTransform(m, attempt)
+			if err := p.generate(ctx, message, m); err != nil {
+				if ctx.Err() != nil {
+					p.backoff(ctx, m, err)
+					return OutcomeBackoff, nil
+				}
+				return p.generateFailed(ctx, m, err), nil
+			}
+		}
+		if err := waitRetry(ctx, delay); err != nil {
+			p.backoff(ctx, m, err)
+			return OutcomeBackoff, nil
+		}
+		if !isConnectionLost(d.err) {
+			if err := p.reset(ctx, conn, resetReason(d.err)); err != nil {
+				p.fail(ctx, m, err)
+				return OutcomeError, err
+			}
+			continue
+		}
+		Logger.Printf("Lost connection to %s, reconnecting: %s\n", conn.host, d.err)
+		if err := p.redial(ctx, conn); err != nil {
+			p.fail(ctx, m, err)
+			return OutcomeError, err
+		}
+	}
+	err := d.err
+	if err == ErrNoRecipients {
+		p.skip(ctx, m, err)
+		return OutcomeSkipped, nil
+	}
+	// The connection wasn't used, so there's no need to reset it
+	if errors.Is(err, ErrUnsupportedRecipient) {
+		p.fail(ctx, m, err)
+		return OutcomeError, nil
+	}
+	outcome := d.outcome()
+	if err != nil {
+		outcome = OutcomeError
+		if action == ActionBackoff {
+			outcome = OutcomeBackoff
+		}
+	}
+	// The connection is only unusable for the rest of the chunk if it
+	// couldn't be reset or re-dialed.
+	var connErr error
+	conn.messages++
+	conn.used = time.Now()
+	switch outcome {
+	case OutcomeBackoff:
+		p.backoff(ctx, m, err)
+		p.spamRejected(m, err)
+		conn.failures++
+		connErr = p.reset(ctx, conn, resetReason(err))
+	case OutcomeError:
+		p.fail(ctx, m, err)
+		p.spamRejected(m, err)
+		conn.failures++
+		connErr = p.reset(ctx, conn, resetReason(err))
+	case OutcomePartial:
+		conn.failures = 0
+		connErr = p.archive(ctx, conn, message, m)
+		p.track(message, m)
+		p.partial(ctx, m, d)
+	default:
+		conn.failures = 0
+		connErr = p.archive(ctx, conn, message, m)
+		p.track(message, m)
+		p.success(ctx, m, d)
+	}
+	if connErr == nil && (outcome == OutcomeSuccess || outcome == OutcomePartial) && p.resetDue(conn) {
+		connErr = p.reset(ctx, conn, ResetProactive)
+	}
+	return outcome, connErr
+}
+
+// graceContext returns the context to send a message with, which is only
+// cancelled CancelGrace after ctx, and the function to call once the send is
+// done.
+func (p *Processor) graceContext(ctx context.Context) (context.Context, func()) {
+	if p.CancelGrace <= 0 {
+		return ctx, func() {}
+	}
+	graceCtx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-ctx.Done():
+			t := time.NewTimer(p.CancelGrace)
+			defer t.Stop()
+			select {
+			case <-t.C:
+			case <-graceCtx.Done():
+			}
+		case <-graceCtx.Done():
+		}
+		cancel()
+	}()
+	return batchContext{Context: graceCtx, values: ctx}, cancel
+}
+
+// reset resets the connection, reporting the reason and the outcome to
+// OnReset. If the reset fails the connection is re-dialed, unless
+// KeepConnectionOnResetFailure is set, and an error is only returned if
+// that fails too.
+func (p *Processor) reset(ctx context.Context, conn *connection, reason ResetReason) error {
+	err := conn.sender.Reset()
+	if err != nil {
+		Logger.Printf("Failed to reset connection to %s after %s: %s\n", conn.host, reason, err)
+	}
+	if p.OnReset != nil {
+		p.OnReset(reason, err)
+	}
+	if err == nil || p.KeepConnectionOnResetFailure {
+		return nil
+	}
+	Logger.Printf("Reconnecting to %s\n", conn.host)
+	return p.redial(ctx, conn)
+}
+
+// archive sends a copy of the message to the ArchiveRecipient, if set. It
+// only returns an error if the connection couldn't be recovered afterwards.
+func (p *Processor) archive(ctx context.Context, conn *connection, message *gomail.Message, m Mail) error {
+	if p.ArchiveRecipient == "" {
+		return nil
+	}
+	s := gomail.SendFunc(func(from string, to []string, msg io.WriterTo) error {
+		if p.Encoder != nil {
+			msg = p.Encoder(m, msg)
+		}
+		return conn.sender.Send(from, []string{p.ArchiveRecipient}, msg)
+	})
+	err := gomail.Send(s, message)
+	if fs, ok := conn.sender.(FlushSender); ok && err == nil {
+		err = fs.Flush()
+	}
+	if err != nil {
+		Logger.Printf("Failed to archive message to %s: %s\n", p.ArchiveRecipient, err)
+		return p.reset(ctx, conn, resetReason(err))
+	}
+	return nil
+}
+
+// delivery is the result of transmitting a message.
+type delivery struct {
+	recipients []string
+	// rejected holds the recipients rejected by a RecipientSender.
+	rejected map[string]error
+	// response is the server's reply reported by a ResponseSender, and
+	// timings the phase timings reported by a TimingSender.
+	response string
+	timings  SendTimings
+	// interrupted is set if the context was cancelled before the message
+	// could be sent, in which case err is the context's error.
+	interrupted bool
+	// unacked is set if PreSendAckFunc returned err, so the message wasn't
+	// sent.
+	unacked bool
+	// cooling is set if a recipient was sent to less than RecipientCooldown
+	// ago, so the message wasn't sent, and claimed once the recipients were
+	// recorded for RecipientCooldown.
+	cooling bool
+	claimed bool
+	err     error
+}
+
+// outcome returns the outcome of the delivery.
+func (d delivery) outcome() Outcome {
+	if d.err == nil && len(d.rejected) > 0 {
+		return OutcomePartial
+	}
+	return classifySendError(d.err)
+}
+
+// accepted returns the recipients which weren't rejected.
+func (d delivery) accepted() []string {
+	accepted := make([]string, 0, len(d.recipients))
+	for _, r := range d.recipients {
+		if _, ok := d.rejected[r]; !ok {
+			accepted = append(accepted, r)
+		}
+	}
+	return accepted
+}
+
+// transmit sends the generated message over the connection, recording the
+// attempt and returning what the Sender reported.
+func (p *Processor) transmit(ctx context.Context, conn *connection, message *gomail.Message, m Mail, attempt int) delivery {
+	sender := conn.sender
+	var from string
+	var d delivery
+	var start time.Time
+	s := gomail.SendFunc(func(f string, to []string, msg io.WriterTo) error {
+		if p.RedirectFunc != nil {
+			if p.PreserveOriginalRecipients {
+				message.SetHeader("X-Original-To", strings.Join(to, ", "))
+			}
+			to = p.RedirectFunc(to)
+		}
+		if p.DedupeRecipients {
+			unique := dedupeRecipients(to)
+			if n := len(to) - len(unique); n > 0 {
+				Logger.Printf("Removed %d duplicate recipients of message to %v%s\n", n, unique, formatLabels(mailLabels(m)))
+				p.hosts.recordDuplicates(conn.host, n)
+			}
+			to = unique
+		}
+		from, d.recipients = f, to
+		if len(to) == 0 {
+			return ErrNoRecipients
+		}
+		if err := checkSMTPUTF8(sender, f, to); err != nil {
+			return err
+		}
+		if err := p.claimRecipients(to); err != nil {
+			d.cooling = true
+			return err
+		}
+		d.claimed = p.RecipientCooldown > 0
+		release, err := p.acquireDomains(ctx, to)
+		if err != nil {
+			d.interrupted = true
+			return err
+		}
+		defer release()
+		if p.PreSendAckFunc != nil {
+			if err := p.PreSendAckFunc(m); err != nil {
+				d.unacked = true
+				return err
+			}
+		}
+		// Waiting for the domains isn't part of the send
+		start = time.Now()
+		if p.Encoder != nil {
+			msg = p.Encoder(m, msg)
+		}
+		msg = p.paceBytes(ctx, msg)
+		d.rejected, err = p.sendRecipients(sender, f, to, msg)
+		return err
+	})
+	start = time.Now()
+	d.err = gomail.Send(s, message)
+	defer func() { p.releaseRecipients(d) }()
+	// Being cancelled while pacing the message isn't the server's doing
+	if d.err != nil && ctx.Err() != nil && errors.Is(d.err, ctx.Err()) {
+		d.interrupted = true
+	}
+	if fs, ok := sender.(FlushSender); ok && d.err == nil {
+		d.err = fs.Flush()
+	}
+	if rs, ok := sender.(ResponseSender); ok && d.err == nil {
+		d.response = rs.LastResponse()
+	}
+	if ts, ok := sender.(TimingSender); ok {
+		d.timings = ts.LastTimings()
+	}
+	elapsed := time.Since(start)
+	// Nothing was sent, so there's nothing to record
+	if d.err == ErrNoRecipients || errors.Is(d.err, ErrUnsupportedRecipient) || d.interrupted || d.unacked || d.cooling {
+		return d
+	}
+	if p.SlowSendThreshold > 0 && elapsed > p.SlowSendThreshold {
+		Logger.Printf("Slow send to %v via %s took %s%s\n", d.recipients, conn.host, elapsed, formatLabels(mailLabels(m)))
+		if p.OnSlowSend != nil {
+			p.OnSlowSend(m, conn.host, d.recipients, elapsed)
+		}
+	}
+	outcome := d.outcome()
+	p.hosts.recordSend(conn.host, outcome, elapsed, d.err)
+	p.recordRate(conn.host, outcome)
+	p.recordConcurrency(conn.host, outcome)
+	if p.AuditFunc != nil {
+		r := newAuditRecord(start, conn.host, from, d.recipients, attempt, outcome, d.err)
+		if d.err == nil {
+			r.Response = d.response
+		}
+		r.Labels = mailLabels(m)
+		r.Timings = d.timings
+		p.AuditFunc(r)
+	}
+	return d
+}
+
+// dedupeRecipients returns the addresses without duplicates, comparing them
+// ignoring case and surrounding whitespace.
+func dedupeRecipients(to []string) []string {
+	seen := make(map[string]bool, len(to))
+	unique := make([]string, 0, len(to))
+	for _, addr := range to {
+		key := normalizeAddress(addr)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		unique = append(unique, addr)
+	}
+	return unique
+}
+
+// checkSMTPUTF8 returns an ErrUnsupportedRecipient error for the first
+// non-ASCII address if the Sender reports that the server doesn't support
+// SMTPUTF8.
+func checkSMTPUTF8(sender Sender, from string, to []string) error {
+	us, ok := sender.(UTF8Sender)
+	if !ok || us.SMTPUTF8() {
+		return nil
+	}
+	for _, addr := range append([]string{from}, to...) {
+		if !isASCII(addr) {
+			return fmt.Errorf("%w: %s", ErrUnsupportedRecipient, addr)
+		}
+	}
+	return nil
+}
+
+// isASCII returns whether s only contains ASCII characters.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// acquireDomains waits for a slot for each of the recipients' domains if
+// MaxConcurrentPerDomain is set, returning the function used to release them.
+func (p *Processor) acquireDomains(ctx context.Context, to []string) (func(), error) {
+	if p.MaxConcurrentPerDomain <= 0 {
+		return func() {}, nil
+	}
+	seen := make(map[string]bool)
+	var domains []string
+	for _, addr := range to {
+		domain := strings.ToLower(addr[strings.LastIndex(addr, "@")+1:])
+		if !seen[domain] {
+			seen[domain] = true
+			domains = append(domains, domain)
+		}
+	}
+	// Acquiring the slots in a consistent order prevents messages sent to
+	// the same domains from deadlocking each other.
+	sort.Strings(domains)
+	var releases []func()
+	release := func() {
+		for _, r := range releases {
+			r()
+		}
+	}
+	for _, domain := range domains {
+		r, err := p.domains.acquire(ctx, domain, p.MaxConcurrentPerDomain)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		releases = append(releases, r)
+	}
+	return release, nil
+}
+
+// classifySendError determines the outcome of a message given the error
+// returned when sending it.
+func classifySendError(err error) Outcome {
+	if err == nil {
+		return OutcomeSuccess
+	}
+	if te, ok := err.(*textproto.Error); ok {
+		switch {
+		// If it's a temporary error, we should backoff and try again later.
+		// We'll reset the connection so future messages don't incur a
+		// different error (see https://github.com/gophish/gophish/issues/787).
+		case te.Code >= 400 && te.Code <= 499:
+			return OutcomeBackoff
+		// Otherwise, if it's a permanent error, we shouldn't backoff this message,
+		// since the RFC specifies that running the same commands won't work next time.
+		// We should reset our sender and error this message out.
+		case te.Code >= 500 && te.Code <= 599:
+			return OutcomeError
+		}
+	}
+	// If something else happened, let's just error out and reset the
+	// sender
+	return OutcomeError
+}
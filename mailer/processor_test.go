@@ -0,0 +1,654 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+func (ms *MailerSuite) TestProcessChunk() {
+	p := &Processor{}
+	sender := newMockErrorSender(&textproto.Error{Code: 421, Msg: "Temporary error"})
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		return sender, nil
+	})
+	go func() {
+		for range sender.messageChan {
+		}
+	}()
+
+	stats := p.ProcessChunk(context.Background(), dialer, generateMessages(dialer))
+	expected := BatchStats{Sent: 1, Backoffs: 1}
+	if stats != expected {
+		ms.T().Fatalf("Unexpected stats. Expected %+v, Got %+v", expected, stats)
+	}
+	if p.HostStats(dialer.Address()).Sent != 1 {
+		ms.T().Fatalf("Unexpected host stats. Got %+v", p.HostStats(dialer.Address()))
+	}
+}
+
+func (ms *MailerSuite) TestProcessChunkDialError() {
+	dialer := newMockDialer()
+	dialer.setDial(dialer.unreachableDial)
+
+	stats := (&Processor{}).ProcessChunk(context.Background(), dialer, generateMessages(dialer))
+	expected := BatchStats{Errors: 2, Err: ErrMaxConnectAttempts}
+	if stats != expected {
+		ms.T().Fatalf("Unexpected stats. Expected %+v, Got %+v", expected, stats)
+	}
+}
+
+func (ms *MailerSuite) TestDumpMessage() {
+	m := &headerMessage{
+		mockMessage: newMockMessage("from@example.com", []string{"to@example.com"}, bytes.NewBufferString("Email body")),
+		headers:     map[string][]string{"X-Campaign": {"1"}},
+	}
+	m.setDialer(func() (Dialer, error) {
+		ms.T().Fatalf("DumpMessage shouldn't get a dialer")
+		return nil, nil
+	})
+
+	dump, err := (&Processor{}).DumpMessage(m)
+	if err != nil {
+		ms.T().Fatalf("Unexpected error when dumping the message: %s", err)
+	}
+	for _, expected := range []string{"From: from@example.com", "X-Campaign: 1", "Email body"} {
+		if !bytes.Contains(dump, []byte(expected)) {
+			ms.T().Fatalf("Message dump doesn't contain %q. Got %q", expected, dump)
+		}
+	}
+	if m.finished {
+		ms.T().Fatalf("Callbacks were called when dumping the message")
+	}
+}
+
+func (ms *MailerSuite) TestRetryPolicy() {
+	sender := newMockSender()
+	sends := 0
+	sender.setSend(func(*mockMessage) error {
+		sends++
+		if sends == 1 {
+			return &textproto.Error{Code: 421, Msg: "Try again"}
+		}
+		return nil
+	})
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		return sender, nil
+	})
+
+	var attempts []int
+	p := &Processor{
+		RetryPolicy: func(ctx context.Context, m Mail, attempt int, err error) (Action, time.Duration) {
+			attempts = append(attempts, attempt)
+			return ActionRetry, time.Millisecond
+		},
+	}
+	m := newMockMessage("from@example.com", []string{"to@example.com"}, bytes.NewBufferString("Email"))
+	m.setDialer(func() (Dialer, error) { return dialer, nil })
+	stats := p.ProcessChunk(context.Background(), dialer, []Mail{m})
+
+	if stats != (BatchStats{Sent: 1}) {
+		ms.T().Fatalf("Unexpected stats. Expected a successful send, Got %+v", stats)
+	}
+	if len(attempts) != 1 || attempts[0] != 1 {
+		ms.T().Fatalf("Unexpected attempts passed to the policy. Got %v", attempts)
+	}
+	if sender.resetCount != 1 {
+		ms.T().Fatalf("Connection wasn't reset before retrying. Got %d resets", sender.resetCount)
+	}
+	if !m.finished || m.err != nil || m.backoffCount != 0 {
+		ms.T().Fatalf("Message wasn't sent after retrying")
+	}
+}
+
+func (ms *MailerSuite) TestRetryPreservesOrder() {
+	sender := newMockSender()
+	failed := false
+	sender.setSend(func(mm *mockMessage) error {
+		if mm.to[0] == "1@example.com" && !failed {
+			failed = true
+			return &textproto.Error{Code: 421, Msg: "Try again"}
+		}
+		return nil
+	})
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		return sender, nil
+	})
+	p := &Processor{
+		RetryPolicy: func(ctx context.Context, m Mail, attempt int, err error) (Action, time.Duration) {
+			return ActionRetry, time.Millisecond
+		},
+	}
+	var messages []Mail
+	for i := 0; i < 3; i++ {
+		messages = append(messages, newMockMessage("from@example.com", []string{fmt.Sprintf("%d@example.com", i)}, bytes.NewBufferString("Email")))
+	}
+	stats := p.ProcessChunk(context.Background(), dialer, messages)
+
+	if stats != (BatchStats{Sent: 3}) {
+		ms.T().Fatalf("Unexpected stats. Expected every message to be sent, Got %+v", stats)
+	}
+	var got []string
+	for _, mm := range sender.messages {
+		got = append(got, mm.to[0])
+	}
+	expected := []string{"0@example.com", "1@example.com", "1@example.com", "2@example.com"}
+	if !reflect.DeepEqual(got, expected) {
+		ms.T().Fatalf("Unexpected send order. Expected %v, Got %v", expected, got)
+	}
+}
+
+func (ms *MailerSuite) TestOnRetryTransform() {
+	sender := newMockSender()
+	var sent []string
+	sender.setSend(func(mm *mockMessage) error {
+		sent = append(sent, string(mm.message))
+		if len(sent) == 1 {
+			return &textproto.Error{Code: 421, Msg: "Try again"}
+		}
+		return nil
+	})
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		return sender, nil
+	})
+
+	m := newMockMessage("from@example.com", []string{"to@example.com"}, bytes.NewBufferString("HTML"))
+	m.setDialer(func() (Dialer, error) { return dialer, nil })
+	var attempts []int
+	p := &Processor{
+		RetryPolicy: func(ctx context.Context, m Mail, attempt int, err error) (Action, time.Duration) {
+			return ActionRetry, 0
+		},
+		OnRetryTransform: func(mail Mail, attempt int) {
+			attempts = append(attempts, attempt)
+			mail.(*mockMessage).message = []byte("Plaintext")
+		},
+	}
+	stats := p.ProcessChunk(context.Background(), dialer, []Mail{m})
+
+	if stats != (BatchStats{Sent: 1}) {
+		ms.T().Fatalf("Unexpected stats. Expected a successful send, Got %+v", stats)
+	}
+	if len(attempts) != 1 || attempts[0] != 1 {
+		ms.T().Fatalf("Unexpected attempts passed to the transform. Got %v", attempts)
+	}
+	if len(sent) != 2 || !strings.Contains(sent[0], "HTML") || !strings.Contains(sent[1], "Plaintext") {
+		ms.T().Fatalf("Retried message wasn't regenerated. Got %q", sent)
+	}
+}
+
+func (ms *MailerSuite) TestDefaultRetryPolicy() {
+	tests := []struct {
+		err     error
+		attempt int
+		action  Action
+	}{
+		{io.EOF, 1, ActionRetry},
+		{io.EOF, 2, ActionError},
+		{&textproto.Error{Code: 421}, 1, ActionBackoff},
+		{&textproto.Error{Code: 550}, 1, ActionError},
+		{errors.New("unknown"), 1, ActionError},
+	}
+	for _, test := range tests {
+		action, _ := DefaultRetryPolicy(context.Background(), nil, test.attempt, test.err)
+		if action != test.action {
+			ms.T().Fatalf("Unexpected action for %v on attempt %d. Expected %s, Got %s", test.err, test.attempt, test.action, action)
+		}
+	}
+}
+
+func (ms *MailerSuite) TestMaxConcurrentPerDomain() {
+	p := &Processor{MaxConcurrentPerDomain: 1}
+	var mu sync.Mutex
+	active, maxActive := 0, 0
+	send := func(*mockMessage) error {
+		mu.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		active--
+		mu.Unlock()
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		sender := newMockSender()
+		sender.setSend(send)
+		dialer := newMockDialer()
+		dialer.setDial(func() (Sender, error) {
+			return sender, nil
+		})
+		var batch []Mail
+		for j := 0; j < 2; j++ {
+			m := newMockMessage("from@example.com", []string{fmt.Sprintf("user%d@Example.com", j)}, bytes.NewBufferString("Email"))
+			m.setDialer(func() (Dialer, error) { return dialer, nil })
+			batch = append(batch, m)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.ProcessChunk(context.Background(), dialer, batch)
+		}()
+	}
+	wg.Wait()
+	if maxActive != 1 {
+		ms.T().Fatalf("Unexpected number of concurrent sends to the domain. Expected %d, Got %d", 1, maxActive)
+	}
+	if len(p.domains.slots) != 0 {
+		ms.T().Fatalf("Domains weren't forgotten once unused. Got %d", len(p.domains.slots))
+	}
+}
+
+func (ms *MailerSuite) TestIdleConnectionTimeout() {
+	closed := make(chan struct{})
+	sender := &closeNotifySender{mockSender: newMockSender(), onClose: func() { close(closed) }}
+	sender.setSend(func(*mockMessage) error {
+		return nil
+	})
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		return sender, nil
+	})
+	newBatch := func() []Mail {
+		m := newMockMessage("from@example.com", []string{"to@example.com"}, bytes.NewBufferString("Email"))
+		m.setDialer(func() (Dialer, error) { return dialer, nil })
+		return []Mail{&keyedMessage{mockMessage: m, key: "campaign"}}
+	}
+
+	p := &Processor{ConnectionPolicy: ConnectionPolicy{IdleConnectionTimeout: 20 * time.Millisecond}}
+	for i := 0; i < 2; i++ {
+		if stats := p.ProcessChunk(context.Background(), dialer, newBatch()); stats != (BatchStats{Sent: 1}) {
+			ms.T().Fatalf("Unexpected stats. Expected a successful send, Got %+v", stats)
+		}
+	}
+	if dialer.dialCount != 1 {
+		ms.T().Fatalf("Connection wasn't reused. Expected %d dial, Got %d", 1, dialer.dialCount)
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		ms.T().Fatalf("Idle connection wasn't closed")
+	}
+}
+
+func (ms *MailerSuite) TestResetFailure() {
+	for _, keep := range []bool{false, true} {
+		// The first connection rejects the second message and then fails to
+		// reset.
+		first := &resetErrorSender{mockSender: newMockSender(), err: errors.New("reset failed")}
+		first.setSend(func(*mockMessage) error {
+			if len(first.messages) == 2 {
+				return &textproto.Error{Code: 550, Msg: "Permanent error"}
+			}
+			return nil
+		})
+		second := newMockSender()
+		second.setSend(func(*mockMessage) error {
+			return nil
+		})
+		dialer := newMockDialer()
+		dialer.setDial(func() (Sender, error) {
+			if dialer.dialCount == 1 {
+				return first, nil
+			}
+			return second, nil
+		})
+		var batch []Mail
+		for i := 0; i < 4; i++ {
+			m := newMockMessage(fmt.Sprintf("from%d@example.com", i), []string{"to@example.com"}, bytes.NewBufferString("Email"))
+			m.setDialer(func() (Dialer, error) { return dialer, nil })
+			batch = append(batch, m)
+		}
+
+		p := &Processor{ConnectionPolicy: ConnectionPolicy{KeepConnectionOnResetFailure: keep}}
+		stats := p.ProcessChunk(context.Background(), dialer, batch)
+		if stats != (BatchStats{Sent: 3, Errors: 1}) {
+			ms.T().Fatalf("Unexpected stats. Expected %+v, Got %+v", BatchStats{Sent: 3, Errors: 1}, stats)
+		}
+		expected := 2
+		if keep {
+			expected = 0
+		}
+		if len(second.messages) != expected {
+			ms.T().Fatalf("Unexpected number of messages sent on a fresh connection with keep %t. Expected %d, Got %d", keep, expected, len(second.messages))
+		}
+	}
+}
+
+func (ms *MailerSuite) TestLabels() {
+	sender := newMockSender()
+	sender.setSend(func(*mockMessage) error {
+		return nil
+	})
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		return sender, nil
+	})
+	labels := map[string]string{"campaign": "1", "variant": "b"}
+	m := &labeledMessage{
+		mockMessage: newMockMessage("from@example.com", []string{"to@example.com"}, bytes.NewBufferString("Email")),
+		labels:      labels,
+	}
+
+	var result Result
+	var record AuditRecord
+	p := &Processor{
+		OnResult: func(m Mail, r Result) {
+			result = r
+		},
+		AuditFunc: func(r AuditRecord) {
+			record = r
+		},
+	}
+	p.ProcessChunk(context.Background(), dialer, []Mail{m})
+	if !reflect.DeepEqual(result.Labels, labels) {
+		ms.T().Fatalf("Unexpected result labels. Expected %v, Got %v", labels, result.Labels)
+	}
+	if !reflect.DeepEqual(record.Labels, labels) {
+		ms.T().Fatalf("Unexpected audit labels. Expected %v, Got %v", labels, record.Labels)
+	}
+	if got := formatLabels(labels); got != " [campaign=1 variant=b]" {
+		ms.T().Fatalf("Unexpected formatted labels. Got %q", got)
+	}
+}
+
+func (ms *MailerSuite) TestFingerprintDialer() {
+	sender := newMockSender()
+	sender.setSend(func(*mockMessage) error {
+		return nil
+	})
+	newDialer := func() *fingerprintDialer {
+		dialer := &fingerprintDialer{mockDialer: newMockDialer(), fingerprint: "mock"}
+		dialer.setDial(func() (Sender, error) {
+			return sender, nil
+		})
+		return dialer
+	}
+	dialers := []*fingerprintDialer{newDialer(), newDialer()}
+
+	p := &Processor{ConnectionPolicy: ConnectionPolicy{IdleConnectionTimeout: time.Minute}}
+	defer p.CloseIdleConnections()
+	for _, dialer := range dialers {
+		m := newMockMessage("from@example.com", []string{"to@example.com"}, bytes.NewBufferString("Email"))
+		if stats := p.ProcessChunk(context.Background(), dialer, []Mail{m}); stats != (BatchStats{Sent: 1}) {
+			ms.T().Fatalf("Unexpected stats. Expected a successful send, Got %+v", stats)
+		}
+	}
+	if dialers[0].dialCount != 1 || dialers[1].dialCount != 0 {
+		ms.T().Fatalf("Connection wasn't shared. Got %d and %d dials", dialers[0].dialCount, dialers[1].dialCount)
+	}
+}
+
+func (ms *MailerSuite) TestAtomicChunks() {
+	sender := newMockSender()
+	sender.setSend(func(*mockMessage) error {
+		if len(sender.messages) == 2 {
+			return &textproto.Error{Code: 421, Msg: "Try again"}
+		}
+		return nil
+	})
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		return sender, nil
+	})
+	var batch []Mail
+	for i := 0; i < 4; i++ {
+		m := newMockMessage(fmt.Sprintf("from%d@example.com", i), []string{"to@example.com"}, bytes.NewBufferString("Email"))
+		batch = append(batch, m)
+	}
+
+	reasons := make(map[Mail]error)
+	p := &Processor{
+		AtomicChunks: true,
+		OnResult: func(m Mail, r Result) {
+			reasons[m] = r.Err
+		},
+	}
+	stats := p.ProcessChunk(context.Background(), dialer, batch)
+	if stats != (BatchStats{Sent: 1, Backoffs: 3}) {
+		ms.T().Fatalf("Unexpected stats. Expected %+v, Got %+v", BatchStats{Sent: 1, Backoffs: 3}, stats)
+	}
+	if len(sender.messages) != 2 {
+		ms.T().Fatalf("Messages were sent after the chunk was backed off. Got %d sends", len(sender.messages))
+	}
+	for _, m := range batch[2:] {
+		if mm := m.(*mockMessage); mm.backoffCount != 1 || reasons[m] != ErrChunkBackedOff {
+			ms.T().Fatalf("Message %s wasn't backed off with the chunk. Got %v", mm.from, reasons[m])
+		}
+	}
+}
+
+func (ms *MailerSuite) TestDedupeRecipients() {
+	for _, dedupe := range []bool{false, true} {
+		p := &Processor{DedupeRecipients: dedupe}
+		sender := newMockSender()
+		dialer := newMockDialer()
+		dialer.setDial(func() (Sender, error) {
+			return sender, nil
+		})
+		go func() {
+			for range sender.messageChan {
+			}
+		}()
+		to := []string{"to@example.com", "To@Example.com", "other@example.com"}
+		m := newMockMessage("from@example.com", to, bytes.NewBufferString("Email"))
+		p.ProcessChunk(context.Background(), dialer, []Mail{m})
+
+		expected, duplicates := to, 0
+		if dedupe {
+			expected, duplicates = []string{"to@example.com", "other@example.com"}, 1
+		}
+		if !reflect.DeepEqual(sender.messages[0].to, expected) {
+			ms.T().Fatalf("Unexpected recipients. Expected %v, Got %v", expected, sender.messages[0].to)
+		}
+		if got := p.HostStats(dialer.Address()).DuplicateRecipients; got != duplicates {
+			ms.T().Fatalf("Unexpected duplicate recipients. Expected %d, Got %d", duplicates, got)
+		}
+	}
+}
+
+func (ms *MailerSuite) TestPreSendAckFunc() {
+	ackErr := errors.New("couldn't persist state")
+	var acked []Mail
+	p := &Processor{
+		PreSendAckFunc: func(m Mail) error {
+			acked = append(acked, m)
+			if len(acked) == 2 {
+				return ackErr
+			}
+			return nil
+		},
+	}
+	sender := newMockSender()
+	sender.setSend(func(*mockMessage) error { return nil })
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		return sender, nil
+	})
+	messages := generateMessages(dialer)
+	stats := p.ProcessChunk(context.Background(), dialer, messages)
+
+	expected := BatchStats{Sent: 1, Backoffs: 1}
+	if stats != expected {
+		ms.T().Fatalf("Unexpected stats. Expected %+v, Got %+v", expected, stats)
+	}
+	if len(acked) != 2 || acked[0] != messages[0] || acked[1] != messages[1] {
+		ms.T().Fatalf("Unexpected acknowledged messages. Got %v", acked)
+	}
+	if len(sender.messages) != 1 || sender.messages[0].from != "first@example.com" {
+		ms.T().Fatalf("Unacknowledged message was sent")
+	}
+	if messages[1].(*mockMessage).backoffCount != 1 {
+		ms.T().Fatalf("Unacknowledged message wasn't backed off")
+	}
+}
+
+func (ms *MailerSuite) TestOnSpamRejection() {
+	var rejected []Mail
+	var replies []*textproto.Error
+	p := &Processor{
+		OnSpamRejection: func(m Mail, err *textproto.Error) {
+			rejected = append(rejected, m)
+			replies = append(replies, err)
+		},
+	}
+	spam := &textproto.Error{Code: 550, Msg: "5.7.1 Message rejected as SPAM"}
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		sender := newMockSender()
+		sender.setSend(func(mm *mockMessage) error {
+			if mm.from == "first@example.com" {
+				return spam
+			}
+			return &textproto.Error{Code: 550, Msg: "5.1.1 Mailbox unavailable"}
+		})
+		return sender, nil
+	})
+	messages := generateMessages(dialer)
+	stats := p.ProcessChunk(context.Background(), dialer, messages)
+
+	if stats.Errors != 2 {
+		ms.T().Fatalf("Unexpected number of errors. Expected %d, Got %d", 2, stats.Errors)
+	}
+	if len(rejected) != 1 || rejected[0] != messages[0] || replies[0] != spam {
+		ms.T().Fatalf("Unexpected spam rejections. Got %v", replies)
+	}
+	if messages[0].(*mockMessage).err != spam {
+		ms.T().Fatalf("Spam rejection wasn't errored out. Got %v", messages[0].(*mockMessage).err)
+	}
+
+	// The heuristics can be overridden
+	rejected = nil
+	p.SpamRejectionFunc = func(err *textproto.Error) bool {
+		return strings.Contains(err.Msg, "Mailbox")
+	}
+	messages = generateMessages(dialer)
+	p.ProcessChunk(context.Background(), dialer, messages)
+	if len(rejected) != 1 || rejected[0] != messages[1] {
+		ms.T().Fatalf("Expected only the second message to be reported as spam. Got %v", rejected)
+	}
+}
+
+func (ms *MailerSuite) TestMaxConsecutiveFailuresPerConnection() {
+	p := &Processor{ConnectionPolicy: ConnectionPolicy{MaxConsecutiveFailuresPerConnection: 2}}
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		sender := newMockSender()
+		sender.setSend(func(mm *mockMessage) error {
+			if mm.from == "ok@example.com" {
+				return nil
+			}
+			return &textproto.Error{Code: 550, Msg: "Rejected"}
+		})
+		return sender, nil
+	})
+	var messages []Mail
+	for _, from := range []string{"1@example.com", "ok@example.com", "2@example.com", "3@example.com", "4@example.com", "5@example.com"} {
+		m := newMockMessage(from, []string{"to@example.com"}, bytes.NewBufferString("Email"))
+		messages = append(messages, m)
+	}
+	stats := p.ProcessChunk(context.Background(), dialer, messages)
+
+	expected := BatchStats{Sent: 1, Errors: 5}
+	if stats != expected {
+		ms.T().Fatalf("Unexpected stats. Expected %+v, Got %+v", expected, stats)
+	}
+	// The successful message restarts the count, so the connection is only
+	// replaced before the fifth message.
+	if dialer.dialCount != 2 {
+		ms.T().Fatalf("Unexpected number of dials. Expected %d, Got %d", 2, dialer.dialCount)
+	}
+}
+
+func (ms *MailerSuite) TestMaxConcurrentGenerate() {
+	p := &Processor{GenerateWorkers: 4, MaxConcurrentGenerate: 2}
+	group := &concurrencyGroup{}
+	var wg sync.WaitGroup
+	for c := 0; c < 2; c++ {
+		dialer := newMockDialer()
+		dialer.setDial(func() (Sender, error) {
+			sender := newMockSender()
+			sender.setSend(func(*mockMessage) error { return nil })
+			return sender, nil
+		})
+		var chunk []Mail
+		for i := 0; i < 4; i++ {
+			m := newMockMessage("from@example.com", []string{"to@example.com"}, bytes.NewBufferString("Email"))
+			chunk = append(chunk, &generateMessage{mockMessage: m, group: group})
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stats := p.ProcessChunk(context.Background(), dialer, chunk)
+			if stats.Sent != len(chunk) {
+				ms.T().Errorf("Unexpected stats. Expected every message to be sent, Got %+v", stats)
+			}
+		}()
+	}
+	wg.Wait()
+	if group.max > p.MaxConcurrentGenerate {
+		ms.T().Fatalf("Too many concurrent Generate calls. Expected at most %d, Got %d", p.MaxConcurrentGenerate, group.max)
+	}
+}
+
+func (ms *MailerSuite) TestGenerateErrorClassifier() {
+	errTransient := errors.New("template data unavailable")
+	errPermanent := errors.New("template is invalid")
+	newMessages := func() []*generateErrorMessage {
+		var messages []*generateErrorMessage
+		for _, err := range []error{errTransient, errPermanent} {
+			m := newMockMessage("from@example.com", []string{"to@example.com"}, bytes.NewBufferString("Email"))
+			messages = append(messages, &generateErrorMessage{mockMessage: m, generateErr: err})
+		}
+		return messages
+	}
+	classifier := func(err error) Action {
+		if errors.Is(err, errTransient) {
+			return ActionBackoff
+		}
+		return ActionError
+	}
+	tests := []struct {
+		p        *Processor
+		expected BatchStats
+	}{
+		// By default, every failure to generate errors the message out
+		{&Processor{}, BatchStats{Errors: 2}},
+		{&Processor{GenerateErrorClassifier: classifier}, BatchStats{Backoffs: 1, Errors: 1}},
+		{&Processor{GenerateErrorClassifier: classifier, GenerateWorkers: 2}, BatchStats{Backoffs: 1, Errors: 1}},
+	}
+	for _, test := range tests {
+		dialer := newMockDialer()
+		dialer.setDial(func() (Sender, error) {
+			return newMockSender(), nil
+		})
+		messages := newMessages()
+		stats := test.p.ProcessChunk(context.Background(), dialer, []Mail{messages[0], messages[1]})
+		if stats != test.expected {
+			ms.T().Fatalf("Unexpected stats. Expected %+v, Got %+v", test.expected, stats)
+		}
+		transient, permanent := messages[0], messages[1]
+		if test.expected.Backoffs == 1 && (transient.backoffCount != 1 || transient.err != nil) {
+			ms.T().Fatalf("Message with a transient error wasn't backed off. Got %d backoffs and error %v", transient.backoffCount, transient.err)
+		}
+		if permanent.backoffCount != 0 || permanent.err != errPermanent {
+			ms.T().Fatalf("Message with a permanent error wasn't errored out. Got %d backoffs and error %v", permanent.backoffCount, permanent.err)
+		}
+	}
+}
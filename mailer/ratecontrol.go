@@ -0,0 +1,417 @@
+package mailer
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// AdaptiveRate configures additive-increase/multiplicative-decrease rate
+// control of the messages sent to each host. Sending starts at MaxRate. Every
+// message accepted by the host raises the rate by Increase, and every message
+// backed off because of a temporary error multiplies it by Decrease. The rate
+// always stays within MinRate and MaxRate.
+type AdaptiveRate struct {
+	// MinRate and MaxRate are the bounds of the rate, in messages per
+	// second.
+	MinRate float64
+	MaxRate float64
+	// Increase is added to the rate after every success. Defaults to 1.
+	Increase float64
+	// Decrease is the factor the rate is multiplied by after every backoff.
+	// Defaults to 0.5.
+	Decrease float64
+}
+
+func (ar *AdaptiveRate) increase() float64 {
+	if ar.Increase <= 0 {
+		return 1
+	}
+	return ar.Increase
+}
+
+func (ar *AdaptiveRate) decrease() float64 {
+	if ar.Decrease <= 0 || ar.Decrease >= 1 {
+		return 0.5
+	}
+	return ar.Decrease
+}
+
+// rateController paces the messages sent to a single host.
+type rateController struct {
+	rate float64
+	// next is the earliest time the next message may be sent.
+	next time.Time
+}
+
+// rateControllers is a concurrency-safe registry of rateControllers keyed by
+// host address.
+type rateControllers struct {
+	mu    sync.Mutex
+	hosts map[string]*rateController
+}
+
+// get returns the rateController for the host, creating it if needed. The
+// caller must hold the lock.
+func (rc *rateControllers) get(host string, cfg *AdaptiveRate) *rateController {
+	if rc.hosts == nil {
+		rc.hosts = make(map[string]*rateController)
+	}
+	c, ok := rc.hosts[host]
+	if !ok {
+		c = &rateController{rate: cfg.MaxRate}
+		rc.hosts[host] = c
+	}
+	return c
+}
+
+// reserve reserves the next send slot for the host if it is free, returning
+// zero. Otherwise nothing is reserved, and it returns how long the caller
+// must wait before trying again, so that callers giving up while waiting
+// don't hold back those after them.
+func (rc *rateControllers) reserve(host string, cfg *AdaptiveRate) time.Duration {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	c := rc.get(host, cfg)
+	now := time.Now()
+	if wait := c.next.Sub(now); wait > 0 {
+		return wait
+	}
+	c.next = now
+	if c.rate > 0 {
+		c.next = c.next.Add(time.Duration(float64(time.Second) / c.rate))
+	}
+	return 0
+}
+
+// record adjusts the rate for the host according to the outcome of a send.
+func (rc *rateControllers) record(host string, cfg *AdaptiveRate, o Outcome) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	c := rc.get(host, cfg)
+	switch o {
+	case OutcomeSuccess, OutcomePartial:
+		c.rate += cfg.increase()
+	case OutcomeBackoff:
+		c.rate *= cfg.decrease()
+	default:
+		return
+	}
+	if c.rate > cfg.MaxRate {
+		c.rate = cfg.MaxRate
+	}
+	if c.rate < cfg.MinRate {
+		c.rate = cfg.MinRate
+	}
+}
+
+// acquireSend waits until the Processor's AdaptiveRate allows sending another
+// message to the host. It returns the context's error if it is cancelled
+// while waiting.
+func (p *Processor) acquireSend(ctx context.Context, host string) error {
+	if p.AdaptiveRate == nil {
+		return nil
+	}
+	for {
+		wait := p.rates.reserve(host, p.AdaptiveRate)
+		if wait <= 0 {
+			return nil
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// recordRate feeds the outcome of a send to the host's rate controller.
+func (p *Processor) recordRate(host string, o Outcome) {
+	if p.AdaptiveRate == nil {
+		return
+	}
+	p.rates.record(host, p.AdaptiveRate, o)
+}
+
+// SendRate returns the current rate, in messages per second, at which the
+// Processor sends to the host. It returns 0 if AdaptiveRate isn't set or
+// nothing has been sent to the host yet.
+func (p *Processor) SendRate(host string) float64 {
+	p.rates.mu.Lock()
+	defer p.rates.mu.Unlock()
+	if c, ok := p.rates.hosts[host]; ok {
+		return c.rate
+	}
+	return 0
+}
+
+// AdaptiveConcurrency configures how many chunks are sent to each host at the
+// same time, each over its own connection, so that concurrent batches don't
+// amplify an outage by hammering a failing host with connections. Sending
+// starts with up to MaxConnections chunks per host. Whenever at least
+// ErrorThreshold of the last Window messages sent to a host were backed off or
+// errored out, the limit is halved, down to a single chunk at a time. After
+// every Window messages sent with fewer errors, it is raised by one again, up
+// to MaxConnections. Chunks over the limit wait for another chunk to the host
+// to finish before dialing.
+type AdaptiveConcurrency struct {
+	// MaxConnections is the limit while the host is healthy. Values less
+	// than 1 are treated as 1.
+	MaxConnections int
+	// ErrorThreshold is the fraction of errors, between 0 and 1, which
+	// lowers the limit. Defaults to 0.5.
+	ErrorThreshold float64
+	// Window is the number of messages the error rate is measured over.
+	// Defaults to 20.
+	Window int
+}
+
+func (ac *AdaptiveConcurrency) max() int {
+	if ac.MaxConnections < 1 {
+		return 1
+	}
+	return ac.MaxConnections
+}
+
+func (ac *AdaptiveConcurrency) threshold() float64 {
+	if ac.ErrorThreshold <= 0 || ac.ErrorThreshold > 1 {
+		return 0.5
+	}
+	return ac.ErrorThreshold
+}
+
+func (ac *AdaptiveConcurrency) window() int {
+	if ac.Window <= 0 {
+		return 20
+	}
+	return ac.Window
+}
+
+// concurrencyController limits the chunks sent to a single host at once.
+type concurrencyController struct {
+	limit  int
+	active int
+	// sends and errors count the messages of the current window.
+	sends  int
+	errors int
+	// wake is closed when a chunk may be able to start.
+	wake chan struct{}
+}
+
+// notify wakes up the chunks waiting to start.
+func (c *concurrencyController) notify() {
+	close(c.wake)
+	c.wake = make(chan struct{})
+}
+
+// concurrencyControllers is a concurrency-safe registry of
+// concurrencyControllers keyed by host address.
+type concurrencyControllers struct {
+	mu    sync.Mutex
+	hosts map[string]*concurrencyController
+}
+
+// get returns the concurrencyController for the host, creating it if needed.
+// The caller must hold the lock.
+func (cc *concurrencyControllers) get(host string, cfg *AdaptiveConcurrency) *concurrencyController {
+	if cc.hosts == nil {
+		cc.hosts = make(map[string]*concurrencyController)
+	}
+	c, ok := cc.hosts[host]
+	if !ok {
+		c = &concurrencyController{limit: cfg.max(), wake: make(chan struct{})}
+		cc.hosts[host] = c
+	}
+	return c
+}
+
+// acquire waits until fewer chunks than the limit are being sent to the
+// host, returning the function used to release the slot, or until the
+// context is cancelled.
+func (cc *concurrencyControllers) acquire(ctx context.Context, host string, cfg *AdaptiveConcurrency) (func(), error) {
+	for {
+		cc.mu.Lock()
+		c := cc.get(host, cfg)
+		if c.active < c.limit {
+			c.active++
+			cc.mu.Unlock()
+			return func() {
+				cc.mu.Lock()
+				defer cc.mu.Unlock()
+				c.active--
+				c.notify()
+			}, nil
+		}
+		wake := c.wake
+		cc.mu.Unlock()
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// record adjusts the limit for the host according to the outcome of a send.
+func (cc *concurrencyControllers) record(host string, cfg *AdaptiveConcurrency, o Outcome) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	c := cc.get(host, cfg)
+	switch o {
+	case OutcomeSuccess, OutcomePartial:
+	case OutcomeBackoff, OutcomeError:
+		c.errors++
+	default:
+		return
+	}
+	c.sends++
+	if c.sends < cfg.window() {
+		return
+	}
+	limit := c.limit
+	if float64(c.errors) >= cfg.threshold()*float64(c.sends) {
+		limit = c.limit / 2
+		if limit < 1 {
+			limit = 1
+		}
+	} else if c.limit < cfg.max() {
+		limit = c.limit + 1
+	}
+	if limit != c.limit {
+		Logger.Printf("Changing the concurrency limit for %s from %d to %d after %d errors in %d sends\n", host, c.limit, limit, c.errors, c.sends)
+		c.limit = limit
+		c.notify()
+	}
+	c.sends, c.errors = 0, 0
+}
+
+// acquireHost waits until the Processor's AdaptiveConcurrency allows sending
+// another chunk to the host, returning the function used to release the slot
+// once the chunk is sent. It returns the context's error if it is cancelled
+// while waiting.
+func (p *Processor) acquireHost(ctx context.Context, host string) (func(), error) {
+	if p.AdaptiveConcurrency == nil {
+		return func() {}, nil
+	}
+	return p.concurrency.acquire(ctx, host, p.AdaptiveConcurrency)
+}
+
+// recordConcurrency feeds the outcome of a send to the host's concurrency
+// controller.
+func (p *Processor) recordConcurrency(host string, o Outcome) {
+	if p.AdaptiveConcurrency == nil {
+		return
+	}
+	p.concurrency.record(host, p.AdaptiveConcurrency, o)
+}
+
+// ConcurrencyLimit returns how many chunks the Processor currently sends to
+// the host at once. It returns 0 if AdaptiveConcurrency isn't set or nothing
+// has been sent to the host yet.
+func (p *Processor) ConcurrencyLimit(host string) int {
+	p.concurrency.mu.Lock()
+	defer p.concurrency.mu.Unlock()
+	if c, ok := p.concurrency.hosts[host]; ok {
+		return c.limit
+	}
+	return 0
+}
+
+// tokenBucket is a concurrency-safe token bucket rate limiter. The zero value
+// is a full bucket.
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// reserve takes a token from a bucket refilled at rate tokens per second and
+// holding at most burst tokens, returning how long the caller must wait for
+// the token to be available.
+func (tb *tokenBucket) reserve(rate float64, burst int) time.Duration {
+	return tb.reserveN(rate, burst, 1)
+}
+
+// reserveN is like reserve, but takes n tokens at once.
+func (tb *tokenBucket) reserveN(rate float64, burst, n int) time.Duration {
+	if burst < 1 {
+		burst = 1
+	}
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	now := time.Now()
+	if tb.last.IsZero() {
+		tb.tokens = float64(burst)
+	} else {
+		tb.tokens += now.Sub(tb.last).Seconds() * rate
+		if tb.tokens > float64(burst) {
+			tb.tokens = float64(burst)
+		}
+	}
+	tb.last = now
+	tb.tokens -= float64(n)
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / rate * float64(time.Second))
+}
+
+// pacedMessage is a message whose bytes are written no faster than the
+// Processor's MaxBytesPerSecond.
+type pacedMessage struct {
+	ctx context.Context
+	msg io.WriterTo
+	p   *Processor
+}
+
+func (pm *pacedMessage) WriteTo(w io.Writer) (int64, error) {
+	return pm.msg.WriteTo(&pacedWriter{ctx: pm.ctx, w: w, p: pm.p})
+}
+
+// pacedWriter waits for the Processor's byte budget to allow every write.
+type pacedWriter struct {
+	ctx context.Context
+	w   io.Writer
+	p   *Processor
+}
+
+func (pw *pacedWriter) Write(b []byte) (int, error) {
+	// The bucket holds a second worth of bytes, so larger writes are paced
+	// in pieces.
+	burst := int(pw.p.MaxBytesPerSecond)
+	n := 0
+	for len(b) > 0 {
+		piece := b
+		if len(piece) > burst {
+			piece = b[:burst]
+		}
+		if wait := pw.p.written.reserveN(pw.p.MaxBytesPerSecond, burst, len(piece)); wait > 0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-pw.ctx.Done():
+				t.Stop()
+				return n, pw.ctx.Err()
+			case <-t.C:
+			}
+		}
+		written, err := pw.w.Write(piece)
+		n += written
+		if err != nil {
+			return n, err
+		}
+		b = b[len(piece):]
+	}
+	return n, nil
+}
+
+// paceBytes returns the message to send so that the Processor's sends follow
+// MaxBytesPerSecond.
+func (p *Processor) paceBytes(ctx context.Context, msg io.WriterTo) io.WriterTo {
+	if p.MaxBytesPerSecond < 1 {
+		return msg
+	}
+	return &pacedMessage{ctx: ctx, msg: msg, p: p}
+}
@@ -0,0 +1,201 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"time"
+)
+
+func (ms *MailerSuite) TestAdaptiveRate() {
+	cfg := &AdaptiveRate{MinRate: 1, MaxRate: 10}
+	rc := &rateControllers{}
+	host := "mail.example.com:25"
+
+	// Sending starts at the maximum rate
+	if wait := rc.reserve(host, cfg); wait != 0 {
+		ms.T().Fatalf("Unexpected wait for the first send. Expected 0, Got %s", wait)
+	}
+	if wait := rc.reserve(host, cfg); wait <= 0 || wait > 100*time.Millisecond {
+		ms.T().Fatalf("Unexpected wait for the second send. Expected at most %s, Got %s", 100*time.Millisecond, wait)
+	}
+
+	tests := []struct {
+		outcome  Outcome
+		expected float64
+	}{
+		{OutcomeSuccess, 10},
+		{OutcomeBackoff, 5},
+		{OutcomeBackoff, 2.5},
+		{OutcomeError, 2.5},
+		{OutcomeBackoff, 1.25},
+		{OutcomeBackoff, 1},
+		{OutcomeSuccess, 2},
+	}
+	for _, test := range tests {
+		rc.record(host, cfg, test.outcome)
+		got := rc.hosts[host].rate
+		if got != test.expected {
+			ms.T().Fatalf("Unexpected rate after %s. Expected %v, Got %v", test.outcome, test.expected, got)
+		}
+	}
+}
+
+func (ms *MailerSuite) TestAcquireSendCancelled() {
+	p := &Processor{AdaptiveRate: &AdaptiveRate{MinRate: 1, MaxRate: 10}}
+	host := "mail.example.com:25"
+	if err := p.acquireSend(context.Background(), host); err != nil {
+		ms.T().Fatalf("Unexpected error acquiring the first send: %s", err)
+	}
+	next := p.rates.hosts[host].next
+
+	// Senders giving up while waiting don't hold back the next one
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		err := p.acquireSend(ctx, host)
+		cancel()
+		if err != context.DeadlineExceeded {
+			ms.T().Fatalf("Unexpected error. Expected %v, Got %v", context.DeadlineExceeded, err)
+		}
+	}
+	if got := p.rates.hosts[host].next; !got.Equal(next) {
+		ms.T().Fatalf("Cancelled sends reserved a slot. Expected the next slot at %s, Got %s", next, got)
+	}
+	if err := p.acquireSend(context.Background(), host); err != nil {
+		ms.T().Fatalf("Unexpected error acquiring the next send: %s", err)
+	}
+	if time.Now().Before(next) {
+		ms.T().Fatalf("Send was acquired before its slot")
+	}
+}
+
+func (ms *MailerSuite) TestAdaptiveConcurrency() {
+	cfg := &AdaptiveConcurrency{MaxConnections: 4, ErrorThreshold: 0.5, Window: 4}
+	cc := &concurrencyControllers{}
+	host := "mail.example.com:25"
+
+	tests := []struct {
+		outcomes []Outcome
+		expected int
+	}{
+		{[]Outcome{OutcomeSuccess, OutcomeBackoff, OutcomeError, OutcomeSuccess}, 2},
+		{[]Outcome{OutcomeBackoff, OutcomeBackoff, OutcomeBackoff, OutcomeBackoff}, 1},
+		{[]Outcome{OutcomeError, OutcomeError, OutcomeError, OutcomeError}, 1},
+		// Skipped messages aren't sends
+		{[]Outcome{OutcomeSuccess, OutcomeSkipped, OutcomeSuccess, OutcomeBackoff, OutcomeSuccess}, 2},
+		{[]Outcome{OutcomeSuccess, OutcomeSuccess, OutcomeSuccess, OutcomeSuccess}, 3},
+	}
+	for i, test := range tests {
+		for _, o := range test.outcomes {
+			cc.record(host, cfg, o)
+		}
+		if got := cc.hosts[host].limit; got != test.expected {
+			ms.T().Fatalf("Unexpected limit after window %d. Expected %d, Got %d", i, test.expected, got)
+		}
+	}
+
+	// Chunks over the limit wait for a slot
+	cc.hosts[host].limit = 1
+	release, err := cc.acquire(context.Background(), host, cfg)
+	if err != nil {
+		ms.T().Fatalf("Unexpected error when acquiring: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := cc.acquire(ctx, host, cfg); err != context.DeadlineExceeded {
+		ms.T().Fatalf("Chunk over the limit didn't wait. Got %v", err)
+	}
+	acquired := make(chan struct{})
+	go func() {
+		next, err := cc.acquire(context.Background(), host, cfg)
+		if err == nil {
+			next()
+		}
+		close(acquired)
+	}()
+	release()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		ms.T().Fatalf("Waiting chunk didn't get the released slot")
+	}
+}
+
+func (ms *MailerSuite) TestTokenBucket() {
+	tb := &tokenBucket{}
+	// The bucket starts full
+	for i := 0; i < 3; i++ {
+		if wait := tb.reserve(10, 3); wait != 0 {
+			ms.T().Fatalf("Unexpected wait within the burst. Expected 0, Got %s", wait)
+		}
+	}
+	wait := tb.reserve(10, 3)
+	if wait <= 50*time.Millisecond || wait > 100*time.Millisecond {
+		ms.T().Fatalf("Unexpected wait after the burst. Expected about %s, Got %s", 100*time.Millisecond, wait)
+	}
+	// Waits accumulate for callers reserving before the bucket refills
+	wait = tb.reserve(10, 3)
+	if wait <= 150*time.Millisecond || wait > 200*time.Millisecond {
+		ms.T().Fatalf("Unexpected wait after the burst. Expected about %s, Got %s", 200*time.Millisecond, wait)
+	}
+}
+
+func (ms *MailerSuite) TestMaxBytesPerSecond() {
+	sender := newMockSender()
+	sender.setSend(func(*mockMessage) error {
+		return nil
+	})
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		return sender, nil
+	})
+	var batch []Mail
+	for i := 0; i < 3; i++ {
+		m := newMockMessage("from@example.com", []string{"to@example.com"}, bytes.NewBufferString(strings.Repeat("x", 5000)))
+		m.setDialer(func() (Dialer, error) { return dialer, nil })
+		batch = append(batch, m)
+	}
+
+	// The first second worth of bytes is sent right away, and the
+	// remaining ~5000 bytes take half a second
+	p := &Processor{MaxBytesPerSecond: 10000}
+	start := time.Now()
+	stats := p.ProcessChunk(context.Background(), dialer, batch)
+	elapsed := time.Since(start)
+	if stats.Sent != 3 {
+		ms.T().Fatalf("Unexpected stats. Expected %d sent, Got %+v", 3, stats)
+	}
+	if elapsed < 400*time.Millisecond {
+		ms.T().Fatalf("Sending wasn't paced. Took %s", elapsed)
+	}
+}
+
+func (ms *MailerSuite) TestCancelGrace() {
+	for _, grace := range []time.Duration{0, time.Second} {
+		sender := newMockSender()
+		sender.setSend(func(*mockMessage) error {
+			return nil
+		})
+		dialer := newMockDialer()
+		dialer.setDial(func() (Sender, error) {
+			return sender, nil
+		})
+		// Sending the message takes about half a second
+		m := newMockMessage("from@example.com", []string{"to@example.com"}, bytes.NewBufferString(strings.Repeat("x", 15000)))
+		m.setDialer(func() (Dialer, error) { return dialer, nil })
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		p := &Processor{MaxBytesPerSecond: 10000, CancelGrace: grace}
+		stats := p.ProcessChunk(ctx, dialer, []Mail{m})
+		cancel()
+
+		expected := BatchStats{Backoffs: 1}
+		if grace > 0 {
+			expected = BatchStats{Sent: 1}
+		}
+		if stats != expected {
+			ms.T().Fatalf("Unexpected stats with a grace of %s. Expected %+v, Got %+v", grace, expected, stats)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package mailer
+
+import (
+	"errors"
+	"io"
+	"net/textproto"
+	"strings"
+)
+
+// isTooManyRecipients returns whether the error is the server refusing more
+// recipients in the current transaction, which RFC 5321 section 4.5.3.1.10
+// says should be sent in another one, rather than rejecting the recipients
+// themselves.
+func isTooManyRecipients(err error) bool {
+	var te *textproto.Error
+	if err == nil || !errors.As(err, &te) {
+		return false
+	}
+	if te.Code != 452 && te.Code != 552 {
+		return false
+	}
+	msg := strings.ToLower(te.Msg)
+	return strings.HasPrefix(msg, "4.5.3") || strings.HasPrefix(msg, "5.5.3") || strings.Contains(msg, "too many recipients")
+}
+
+// sendRecipients sends the message to the recipients over the sender,
+// returning the recipients it rejected if it implements RecipientSender. If
+// AutoSplitOnRecipientLimit is set, recipients refused for exceeding the
+// server's limit are sent in further transactions on the same connection.
+func (p *Processor) sendRecipients(sender Sender, from string, to []string, msg io.WriterTo) (map[string]error, error) {
+	send := func(to []string) (map[string]error, error) {
+		if rs, ok := sender.(RecipientSender); ok {
+			return rs.SendRecipients(from, to, msg)
+		}
+		return nil, sender.Send(from, to, msg)
+	}
+	if !p.AutoSplitOnRecipientLimit {
+		return send(to)
+	}
+	return splitSend(sender, send, to)
+}
+
+// splitSend sends to the recipients with send, splitting the recipients in
+// two when the server refuses the whole transaction for having too many of
+// them, and sending those it refused after accepting others in a transaction
+// of their own. The recipients of a part which fails after others were sent
+// are reported as rejected with its error.
+func splitSend(sender Sender, send func(to []string) (map[string]error, error), to []string) (map[string]error, error) {
+	rejected, err := send(to)
+	if err != nil {
+		// The server may have refused the last RCPT of a transaction
+		// which isn't over, so it has to be reset first.
+		if !isTooManyRecipients(err) || len(to) < 2 || sender.Reset() != nil {
+			return nil, err
+		}
+		half := len(to) / 2
+		first, ferr := splitSend(sender, send, to[:half])
+		if ferr != nil && sender.Reset() != nil {
+			return nil, ferr
+		}
+		second, serr := splitSend(sender, send, to[half:])
+		switch {
+		case ferr != nil && serr != nil:
+			return nil, serr
+		case ferr != nil:
+			return mergeRejected(second, to[:half], ferr), nil
+		case serr != nil:
+			return mergeRejected(first, to[half:], serr), nil
+		}
+		for addr, rerr := range second {
+			if first == nil {
+				first = make(map[string]error)
+			}
+			first[addr] = rerr
+		}
+		return first, nil
+	}
+	var over []string
+	for _, addr := range to {
+		if isTooManyRecipients(rejected[addr]) {
+			over = append(over, addr)
+		}
+	}
+	if len(over) == 0 {
+		return rejected, nil
+	}
+	for _, addr := range over {
+		delete(rejected, addr)
+	}
+	more, err := splitSend(sender, send, over)
+	if err != nil {
+		return mergeRejected(rejected, over, err), nil
+	}
+	for addr, rerr := range more {
+		rejected[addr] = rerr
+	}
+	if len(rejected) == 0 {
+		return nil, nil
+	}
+	return rejected, nil
+}
+
+// mergeRejected adds the recipients to the rejected ones with err.
+func mergeRejected(rejected map[string]error, to []string, err error) map[string]error {
+	if rejected == nil {
+		rejected = make(map[string]error, len(to))
+	}
+	for _, addr := range to {
+		rejected[addr] = err
+	}
+	return rejected
+}
@@ -0,0 +1,71 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"net/textproto"
+)
+
+func (ms *MailerSuite) TestAutoSplitOnRecipientLimit() {
+	newSender := func() *mockSender {
+		sender := newMockSender()
+		sender.setSend(func(mm *mockMessage) error {
+			if len(mm.to) > 2 {
+				return &textproto.Error{Code: 452, Msg: "4.5.3 Too many recipients"}
+			}
+			return nil
+		})
+		return sender
+	}
+	to := []string{"a@example.com", "b@example.com", "c@example.com", "d@example.com", "e@example.com"}
+
+	// Without the option the refusal is a temporary failure of the message
+	sender := newSender()
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) { return sender, nil })
+	m := newMockMessage("from@example.com", to, bytes.NewBufferString("Email"))
+	m.setDialer(func() (Dialer, error) { return dialer, nil })
+	(&Processor{}).ProcessChunk(context.Background(), dialer, []Mail{m})
+	if m.finished || m.backoffCount != 1 {
+		ms.T().Fatalf("Message refused for too many recipients wasn't backed off")
+	}
+
+	sender = newSender()
+	dialer = newMockDialer()
+	dialer.setDial(func() (Sender, error) { return sender, nil })
+	var result Result
+	p := &Processor{
+		AutoSplitOnRecipientLimit: true,
+		OnResult:                  func(m Mail, r Result) { result = r },
+	}
+	m = newMockMessage("from@example.com", to, bytes.NewBufferString("Email"))
+	m.setDialer(func() (Dialer, error) { return dialer, nil })
+	stats := p.ProcessChunk(context.Background(), dialer, []Mail{m})
+
+	if stats != (BatchStats{Sent: 1}) {
+		ms.T().Fatalf("Unexpected stats. Expected a successful send, Got %+v", stats)
+	}
+	if !m.finished || m.err != nil {
+		ms.T().Fatalf("Message wasn't marked as sent. Got error: %v", m.err)
+	}
+	if result.Outcome != OutcomeSuccess || len(result.Rejected) != 0 {
+		ms.T().Fatalf("Unexpected result. Expected every recipient accepted, Got %+v", result)
+	}
+	var delivered []string
+	for _, mm := range sender.messages {
+		if len(mm.to) <= 2 {
+			delivered = append(delivered, mm.to...)
+		}
+	}
+	if len(delivered) != len(to) {
+		ms.T().Fatalf("Unexpected recipients delivered. Expected %v, Got %v", to, delivered)
+	}
+	for i := range to {
+		if delivered[i] != to[i] {
+			ms.T().Fatalf("Unexpected recipients delivered. Expected %v, Got %v", to, delivered)
+		}
+	}
+	if sender.resetCount == 0 {
+		ms.T().Fatalf("Connection wasn't reset after the refused transaction")
+	}
+}
@@ -0,0 +1,212 @@
+package mailer
+
+import (
+	"context"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Outcome describes how the worker finished processing a Mail instance.
+type Outcome int
+
+const (
+	// OutcomeSuccess means the message was accepted by the server.
+	OutcomeSuccess Outcome = iota
+	// OutcomeBackoff means the message hit a temporary error and was backed
+	// off so it can be retried later.
+	OutcomeBackoff
+	// OutcomeError means the message hit a permanent error.
+	OutcomeError
+	// OutcomeSkipped means the message was never attempted.
+	OutcomeSkipped
+	// OutcomePartial means the message was accepted by the server for some
+	// of its recipients but rejected for others.
+	OutcomePartial
+)
+
+// String returns a human readable name for the Outcome.
+func (o Outcome) String() string {
+	switch o {
+	case OutcomeSuccess:
+		return "success"
+	case OutcomeBackoff:
+		return "backoff"
+	case OutcomeError:
+		return "error"
+	case OutcomeSkipped:
+		return "skipped"
+	case OutcomePartial:
+		return "partial"
+	}
+	return "unknown"
+}
+
+// ResetReason describes why the worker reset a connection.
+type ResetReason int
+
+const (
+	// ResetTemporaryError means the server rejected a message with a 4xx
+	// reply.
+	ResetTemporaryError ResetReason = iota
+	// ResetPermanentError means the server rejected a message with a 5xx
+	// reply.
+	ResetPermanentError
+	// ResetUnknown means sending a message failed without an SMTP reply,
+	// for example because of a network error.
+	ResetUnknown
+	// ResetProactive means the connection was reset although no send
+	// failed.
+	ResetProactive
+)
+
+// String returns a human readable name for the ResetReason.
+func (r ResetReason) String() string {
+	switch r {
+	case ResetTemporaryError:
+		return "temporary error"
+	case ResetPermanentError:
+		return "permanent error"
+	case ResetUnknown:
+		return "unknown"
+	case ResetProactive:
+		return "proactive"
+	}
+	return "invalid"
+}
+
+// resetReason returns the ResetReason for a connection reset after the given
+// send error.
+func resetReason(err error) ResetReason {
+	if te, ok := err.(*textproto.Error); ok {
+		switch {
+		case te.Code >= 400 && te.Code <= 499:
+			return ResetTemporaryError
+		case te.Code >= 500 && te.Code <= 599:
+			return ResetPermanentError
+		}
+	}
+	return ResetUnknown
+}
+
+// Result is passed to the OnResult hook once the worker is finished with a
+// Mail instance.
+type Result struct {
+	// Context is the context the Mail's batch was processed with, carrying
+	// the values of the context passed to EnqueueContext.
+	Context context.Context
+	Outcome Outcome
+	// Err is the error which caused a backoff or error outcome.
+	Err error
+	// Accepted and Rejected are the recipients the server accepted and
+	// rejected, along with the reason, for a partial outcome.
+	Accepted []string
+	Rejected map[string]error
+	// Response is the reply the server sent after accepting the message,
+	// if the Sender implements ResponseSender.
+	Response string
+	// Labels are the labels of the Mail, if it implements Labeler.
+	Labels map[string]string
+	// Timings break down how long sending the message took, if the Sender
+	// implements TimingSender.
+	Timings SendTimings
+}
+
+// SendTimings breaks down the time spent sending a message, as measured by a
+// TimingSender. Phases the Sender doesn't measure are zero.
+type SendTimings struct {
+	// Connect, TLS and Auth are how long it took to connect to the server,
+	// negotiate TLS and authenticate. They are only reported for the first
+	// message sent over a connection, so they can be summed. With implicit
+	// TLS, TLS includes waiting for the server's greeting.
+	Connect time.Duration
+	TLS     time.Duration
+	Auth    time.Duration
+	// Envelope is how long the server took to accept the sender and
+	// recipients, Data how long it took to transmit the message and
+	// Response how long we waited for the server's reply once transmitted.
+	Envelope time.Duration
+	Data     time.Duration
+	Response time.Duration
+}
+
+// AuditRecord describes a single attempt at sending a message. It is passed
+// to the worker's AuditFunc.
+type AuditRecord struct {
+	Time       time.Time
+	Host       string
+	From       string
+	Recipients []string
+	// Attempt is the number of times the worker has tried sending the
+	// message, starting at 1.
+	Attempt int
+	Outcome Outcome
+	// Code and Response are the SMTP reply code and text returned by the
+	// server when the attempt failed. For successful attempts, Response
+	// is the server's reply if the Sender implements ResponseSender.
+	Code     int
+	Response string
+	Err      error
+	// Labels are the labels of the Mail, if it implements Labeler.
+	Labels map[string]string
+	// Timings break down how long the attempt took, if the Sender
+	// implements TimingSender.
+	Timings SendTimings
+}
+
+// newAuditRecord builds the AuditRecord for a send attempt which started at
+// the given time.
+func newAuditRecord(start time.Time, host, from string, to []string, attempt int, o Outcome, err error) AuditRecord {
+	r := AuditRecord{
+		Time:       start,
+		Host:       host,
+		From:       from,
+		Recipients: to,
+		Attempt:    attempt,
+		Outcome:    o,
+		Err:        err,
+	}
+	if te, ok := err.(*textproto.Error); ok {
+		r.Code = te.Code
+		r.Response = te.Msg
+	}
+	return r
+}
+
+// mailLabels returns the labels of the Mail, if any.
+func mailLabels(m Mail) map[string]string {
+	if l, ok := m.(Labeler); ok {
+		return l.Labels()
+	}
+	return nil
+}
+
+// formatLabels formats the labels for the logs, sorted by name, or returns
+// an empty string if there are none.
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + labels[name]
+	}
+	return " [" + strings.Join(pairs, " ") + "]"
+}
+
+// Filterer is implemented by Mail instances that may opt out of being sent.
+// ShouldSend is checked once when the batch containing the Mail starts
+// processing. Mail returning false is skipped without being generated or
+// sent, and none of its Success, Backoff or Error methods are called.
+//
+// This makes it possible to re-enqueue an entire campaign and only re-attempt
+// the messages that previously failed.
+type Filterer interface {
+	ShouldSend() bool
+}
@@ -0,0 +1,75 @@
+package mailer
+
+import (
+	"context"
+	"time"
+)
+
+// Action is the decision a RetryPolicy makes about a failed send.
+type Action int
+
+const (
+	// ActionError errors the message out.
+	ActionError Action = iota
+	// ActionBackoff backs the message off so it can be retried later.
+	ActionBackoff
+	// ActionRetry sends the message again on the same connection, once the
+	// returned delay has elapsed. The connection is re-established first if
+	// it was lost, and reset otherwise.
+	ActionRetry
+)
+
+// String returns a human readable name for the Action.
+func (a Action) String() string {
+	switch a {
+	case ActionError:
+		return "error"
+	case ActionBackoff:
+		return "backoff"
+	case ActionRetry:
+		return "retry"
+	}
+	return "unknown"
+}
+
+// RetryPolicy decides what to do with a message after the given attempt at
+// sending it failed with err. Attempts start at 1. The delay is only used
+// with ActionRetry.
+type RetryPolicy func(ctx context.Context, m Mail, attempt int, err error) (Action, time.Duration)
+
+// DefaultRetryPolicy is used when a Processor has no RetryPolicy. It retries
+// once right away if the connection was lost, backs off messages rejected with
+// a temporary error and errors out everything else.
+func DefaultRetryPolicy(ctx context.Context, m Mail, attempt int, err error) (Action, time.Duration) {
+	if isConnectionLost(err) && attempt == 1 {
+		return ActionRetry, 0
+	}
+	if classifySendError(err) == OutcomeBackoff {
+		return ActionBackoff, 0
+	}
+	return ActionError, 0
+}
+
+// retryPolicy returns the RetryPolicy consulted on failed sends.
+func (p *Processor) retryPolicy() RetryPolicy {
+	if p.RetryPolicy != nil {
+		return p.RetryPolicy
+	}
+	return DefaultRetryPolicy
+}
+
+// waitRetry waits for the delay before retrying a send, returning early with
+// the context's error if it is cancelled.
+func waitRetry(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,66 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrUnknownRoute is returned by Router when its RouteFunc returns the key of
+// a worker it doesn't have.
+var ErrUnknownRoute = errors.New("no worker for route")
+
+// RouteFunc returns the key of the worker a Mail instance should be sent
+// with, such as "transactional" or "bulk".
+type RouteFunc func(m Mail) string
+
+// Router enqueues Mail instances to one of several MailWorkers according to
+// its RouteFunc, so that producers don't need to know which worker handles
+// which class of message. The workers are started and stopped by the caller.
+type Router struct {
+	// Workers are the workers Mail instances are routed to, keyed by the
+	// values returned by RouteFunc.
+	Workers map[string]*MailWorker
+	// RouteFunc returns the key of the worker of every Mail instance.
+	RouteFunc RouteFunc
+}
+
+// Enqueue hands the Mail instances to their workers, as a single batch per
+// worker keeping the order they were provided in.
+func (r *Router) Enqueue(ms []Mail) error {
+	return r.EnqueueContext(context.Background(), ms)
+}
+
+// EnqueueContext is like Enqueue, enqueueing the batches with
+// MailWorker.EnqueueContext. Every Mail instance is routed before anything is
+// enqueued, so a Mail without a worker fails the whole call with
+// ErrUnknownRoute. Otherwise, if a worker fails to enqueue its batch, for
+// example because it was shut down, the error is returned and the batches of
+// the following workers aren't enqueued.
+func (r *Router) EnqueueContext(ctx context.Context, ms []Mail) error {
+	if len(ms) == 0 {
+		return ErrEmptyBatch
+	}
+	// Workers get their batches in the order their first Mail appears in.
+	var keys []string
+	batches := make(map[string][]Mail)
+	for i, m := range ms {
+		if m == nil {
+			return fmt.Errorf("%w at index %d", ErrNilMail, i)
+		}
+		key := r.RouteFunc(m)
+		if _, ok := r.Workers[key]; !ok {
+			return fmt.Errorf("%w %q for mail at index %d", ErrUnknownRoute, key, i)
+		}
+		if _, ok := batches[key]; !ok {
+			keys = append(keys, key)
+		}
+		batches[key] = append(batches[key], m)
+	}
+	for _, key := range keys {
+		if err := r.Workers[key].EnqueueContext(ctx, batches[key]); err != nil {
+			return fmt.Errorf("enqueueing to %q: %w", key, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+func (ms *MailerSuite) TestRouter() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	type send struct {
+		worker string
+		from   string
+	}
+	sends := make(chan send, 10)
+	router := &Router{Workers: make(map[string]*MailWorker)}
+	for _, key := range []string{"transactional", "bulk"} {
+		key := key
+		mw := NewMailWorker()
+		mw.OnResult = func(m Mail, r Result) {
+			sends <- send{key, m.(*mockMessage).from}
+		}
+		go mw.Start(ctx)
+		router.Workers[key] = mw
+	}
+	router.RouteFunc = func(m Mail) string {
+		if strings.HasPrefix(m.(*mockMessage).from, "reset") {
+			return "transactional"
+		}
+		return "bulk"
+	}
+
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		sender := newMockSender()
+		sender.setSend(func(*mockMessage) error { return nil })
+		return sender, nil
+	})
+	var messages []Mail
+	for _, from := range []string{"campaign1", "reset1", "campaign2"} {
+		m := newMockMessage(from, []string{"to@example.com"}, bytes.NewBufferString("Email"))
+		m.setDialer(func() (Dialer, error) { return dialer, nil })
+		messages = append(messages, m)
+	}
+	if err := router.Enqueue(messages); err != nil {
+		ms.T().Fatalf("Unexpected error when routing: %s", err)
+	}
+	got := make(map[string]string)
+	for range messages {
+		select {
+		case s := <-sends:
+			got[s.from] = s.worker
+		case <-time.After(time.Second):
+			ms.T().Fatalf("Timed out waiting for routed messages. Got %v", got)
+		}
+	}
+	expected := map[string]string{"campaign1": "bulk", "reset1": "transactional", "campaign2": "bulk"}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		ms.T().Fatalf("Unexpected routing. Expected %v, Got %v", expected, got)
+	}
+
+	// Nothing is enqueued if any Mail has no worker
+	router.RouteFunc = func(m Mail) string {
+		if m.(*mockMessage).from == "campaign2" {
+			return "unknown"
+		}
+		return "bulk"
+	}
+	err := router.Enqueue(messages)
+	if !errors.Is(err, ErrUnknownRoute) {
+		ms.T().Fatalf("Unexpected error. Expected %s, Got %v", ErrUnknownRoute, err)
+	}
+	select {
+	case s := <-sends:
+		ms.T().Fatalf("Unexpected send after a routing error: %+v", s)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,45 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"net/smtp"
+	"strings"
+)
+
+// ErrNoAcceptableAuth is wrapped by the *PermanentError SMTPDialer returns
+// when the server doesn't advertise any of its AuthMechanisms which are
+// allowed over the connection.
+var ErrNoAcceptableAuth = errors.New("no acceptable authentication mechanism")
+
+// SASLMechanism is one of the authentication mechanisms an SMTPDialer may
+// choose from.
+type SASLMechanism struct {
+	// Name is the mechanism as advertised by servers, such as
+	// "SCRAM-SHA-256" or "PLAIN".
+	Name string
+	// Auth implements the mechanism.
+	Auth smtp.Auth
+	// AllowCleartext allows the mechanism over connections which aren't
+	// encrypted with TLS. It should only be set for mechanisms which don't
+	// reveal the credentials, such as CRAM-MD5 or SCRAM.
+	AllowCleartext bool
+}
+
+// selectAuth returns the Auth of the first of the dialer's AuthMechanisms
+// that the server advertises, as listed in the parameter of its AUTH
+// extension, and that is allowed over the connection.
+func (d *SMTPDialer) selectAuth(advertised string, tls bool) (smtp.Auth, error) {
+	offered := strings.Fields(advertised)
+	for _, m := range d.AuthMechanisms {
+		if !tls && !m.AllowCleartext {
+			continue
+		}
+		for _, name := range offered {
+			if strings.EqualFold(name, m.Name) {
+				return m.Auth, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w: server offers %s", ErrNoAcceptableAuth, strings.Join(offered, ", "))
+}
@@ -0,0 +1,56 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"net/smtp"
+)
+
+func (ms *MailerSuite) TestSMTPDialerAuthMechanisms() {
+	server := newFakeSMTPServer()
+	defer server.Close()
+	var got string
+	server.auth = func(mechanism, response string) (int, string) {
+		got = mechanism
+		return 235, "Authentication successful"
+	}
+
+	// SCRAM isn't advertised and PLAIN isn't allowed in the clear, so
+	// CRAM-MD5 is used although it is the least preferred.
+	d := server.dialer()
+	d.AuthMechanisms = []SASLMechanism{
+		{Name: "SCRAM-SHA-256", Auth: smtp.CRAMMD5Auth("user", "secret"), AllowCleartext: true},
+		{Name: "PLAIN", Auth: smtp.PlainAuth("", "user", "secret", "127.0.0.1")},
+		{Name: "CRAM-MD5", Auth: smtp.CRAMMD5Auth("user", "secret"), AllowCleartext: true},
+	}
+	sender, err := d.Dial()
+	if err != nil {
+		ms.T().Fatalf("Unexpected error when dialing: %s", err)
+	}
+	sender.Close()
+	if got != "CRAM-MD5" {
+		ms.T().Fatalf("Unexpected auth mechanism. Expected %s, Got %s", "CRAM-MD5", got)
+	}
+}
+
+func (ms *MailerSuite) TestSMTPDialerAuthMechanismsNoneAcceptable() {
+	server := newFakeSMTPServer()
+	defer server.Close()
+
+	d := server.dialer()
+	d.AuthMechanisms = []SASLMechanism{
+		{Name: "SCRAM-SHA-256", Auth: smtp.CRAMMD5Auth("user", "secret"), AllowCleartext: true},
+		{Name: "PLAIN", Auth: smtp.PlainAuth("", "user", "secret", "127.0.0.1")},
+	}
+	_, err := dialHost(context.Background(), d, MaxReconnectAttempts)
+	pe, ok := err.(*PermanentError)
+	if !ok || !errors.Is(err, ErrNoAcceptableAuth) {
+		ms.T().Fatalf("Didn't receive expected *PermanentError wrapping ErrNoAcceptableAuth. Got: %#v", err)
+	}
+	if pe.Op != "auth" {
+		ms.T().Fatalf("Unexpected PermanentError op. Expected %s, Got %s", "auth", pe.Op)
+	}
+	if server.connCount() != 1 {
+		ms.T().Fatalf("Unexpected number of connection attempts. Expected %d, Got %d", 1, server.connCount())
+	}
+}
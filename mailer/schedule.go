@@ -0,0 +1,82 @@
+package mailer
+
+import (
+	"container/heap"
+	"time"
+)
+
+// batchHeap is a min-heap of batches ordered by the time they may be sent.
+type batchHeap []batch
+
+func (h batchHeap) Len() int            { return len(h) }
+func (h batchHeap) Less(i, j int) bool  { return h[i].notBefore.Before(h[j].notBefore) }
+func (h batchHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *batchHeap) Push(x interface{}) { *h = append(*h, x.(batch)) }
+func (h *batchHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	b := old[n-1]
+	*h = old[:n-1]
+	return b
+}
+
+// schedule holds the batches enqueued with EnqueueAt until they are due. It
+// is only used from the worker's Start loop.
+type schedule struct {
+	batches batchHeap
+	timer   *time.Timer
+}
+
+// add schedules the batch to be sent at its notBefore time.
+func (s *schedule) add(b batch) {
+	heap.Push(&s.batches, b)
+	s.reset()
+}
+
+// due removes and returns the batches which may be sent at the given time.
+func (s *schedule) due(now time.Time) []batch {
+	var due []batch
+	for len(s.batches) > 0 && !now.Before(s.batches[0].notBefore) {
+		due = append(due, heap.Pop(&s.batches).(batch))
+	}
+	s.reset()
+	return due
+}
+
+// drain removes and returns every scheduled batch.
+func (s *schedule) drain() []batch {
+	batches := s.batches
+	s.batches = nil
+	s.stop()
+	return batches
+}
+
+// len returns the number of scheduled batches.
+func (s *schedule) len() int {
+	return len(s.batches)
+}
+
+// C returns a channel which receives when the earliest batch is due, or nil
+// if nothing is scheduled.
+func (s *schedule) C() <-chan time.Time {
+	if s.timer == nil {
+		return nil
+	}
+	return s.timer.C
+}
+
+// reset points the timer at the earliest scheduled batch.
+func (s *schedule) reset() {
+	s.stop()
+	if len(s.batches) > 0 {
+		s.timer = time.NewTimer(time.Until(s.batches[0].notBefore))
+	}
+}
+
+// stop stops the timer.
+func (s *schedule) stop() {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+}
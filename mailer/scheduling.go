@@ -0,0 +1,109 @@
+package mailer
+
+import (
+	"sort"
+	"strings"
+)
+
+// SchedulingStrategy determines the order in which the Mail instances of a
+// batch get their turn to be sent. Order matters most when sending is rate
+// limited, for example by AdaptiveRate or MaxConcurrentPerDomain, since the
+// messages at the end of a batch wait the longest.
+type SchedulingStrategy int
+
+const (
+	// ScheduleFIFO sends the Mail instances in the order they were
+	// enqueued.
+	ScheduleFIFO SchedulingStrategy = iota
+	// SchedulePriority sends Mail instances with a higher Priority first
+	// (see Prioritizer), keeping the order they were enqueued in otherwise.
+	SchedulePriority
+	// ScheduleDomainFair interleaves the Mail instances of each recipient
+	// domain (see RecipientDomainer), so that a domain with many messages,
+	// or one which is slow to accept them, doesn't keep the others waiting.
+	// Messages for the same domain keep the order they were enqueued in.
+	ScheduleDomainFair
+)
+
+// String returns a human readable name for the SchedulingStrategy.
+func (s SchedulingStrategy) String() string {
+	switch s {
+	case ScheduleFIFO:
+		return "fifo"
+	case SchedulePriority:
+		return "priority"
+	case ScheduleDomainFair:
+		return "domain fair"
+	default:
+		return "unknown"
+	}
+}
+
+// Prioritizer is implemented by Mail instances which should be sent ahead
+// of others, such as password resets queued alongside a campaign. Mail
+// instances which don't implement it have priority 0.
+type Prioritizer interface {
+	Priority() int
+}
+
+// RecipientDomainer is implemented by Mail instances which can report the
+// domain of their recipient before being generated, so that ScheduleDomainFair
+// can interleave them. Mail instances which don't implement it are scheduled
+// as if they all shared a domain.
+type RecipientDomainer interface {
+	RecipientDomain() string
+}
+
+// mailPriority returns the priority of the Mail instance.
+func mailPriority(m Mail) int {
+	if pm, ok := m.(Prioritizer); ok {
+		return pm.Priority()
+	}
+	return 0
+}
+
+// mailDomain returns the recipient domain of the Mail instance, in lower
+// case.
+func mailDomain(m Mail) string {
+	if dm, ok := m.(RecipientDomainer); ok {
+		return strings.ToLower(dm.RecipientDomain())
+	}
+	return ""
+}
+
+// schedule returns the Mail instances in the order the worker's Scheduling
+// strategy sends them. The slice passed in is left untouched.
+func (mw *MailWorker) schedule(ms []Mail) []Mail {
+	switch mw.Scheduling {
+	case SchedulePriority:
+		scheduled := make([]Mail, len(ms))
+		copy(scheduled, ms)
+		sort.SliceStable(scheduled, func(i, j int) bool {
+			return mailPriority(scheduled[i]) > mailPriority(scheduled[j])
+		})
+		return scheduled
+	case ScheduleDomainFair:
+		// Domains take turns in the order they first appear in.
+		var domains []string
+		queues := make(map[string][]Mail)
+		for _, m := range ms {
+			domain := mailDomain(m)
+			if _, ok := queues[domain]; !ok {
+				domains = append(domains, domain)
+			}
+			queues[domain] = append(queues[domain], m)
+		}
+		scheduled := make([]Mail, 0, len(ms))
+		for len(scheduled) < len(ms) {
+			for _, domain := range domains {
+				if q := queues[domain]; len(q) > 0 {
+					scheduled = append(scheduled, q[0])
+					queues[domain] = q[1:]
+				}
+			}
+		}
+		return scheduled
+	default:
+		return ms
+	}
+}
@@ -0,0 +1,94 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"time"
+)
+
+// scheduledMessage is a mockMessage with a priority and recipient domain.
+type scheduledMessage struct {
+	*mockMessage
+	priority int
+	domain   string
+}
+
+func (sm *scheduledMessage) Priority() int { return sm.priority }
+
+func (sm *scheduledMessage) RecipientDomain() string { return sm.domain }
+
+func (ms *MailerSuite) TestSchedule() {
+	newMessage := func(from, domain string, priority int) Mail {
+		m := newMockMessage(from, []string{"to@" + domain}, bytes.NewBufferString("Email"))
+		return &scheduledMessage{mockMessage: m, priority: priority, domain: domain}
+	}
+	messages := []Mail{
+		newMessage("a1", "a.example.com", 0),
+		newMessage("a2", "a.example.com", 1),
+		newMessage("a3", "A.example.com", 0),
+		newMessage("b1", "b.example.com", 2),
+		newMessage("c1", "c.example.com", 0),
+		newMessage("b2", "b.example.com", 0),
+	}
+	order := func(ms []Mail) []string {
+		var from []string
+		for _, m := range ms {
+			from = append(from, m.(*scheduledMessage).from)
+		}
+		return from
+	}
+	tests := []struct {
+		strategy SchedulingStrategy
+		expected []string
+	}{
+		{ScheduleFIFO, []string{"a1", "a2", "a3", "b1", "c1", "b2"}},
+		{SchedulePriority, []string{"b1", "a2", "a1", "a3", "c1", "b2"}},
+		{ScheduleDomainFair, []string{"a1", "b1", "c1", "a2", "b2", "a3"}},
+	}
+	for _, test := range tests {
+		mw := &MailWorker{Scheduling: test.strategy}
+		got := order(mw.schedule(messages))
+		if !reflect.DeepEqual(got, test.expected) {
+			ms.T().Fatalf("Unexpected order for %s. Expected %v, Got %v", test.strategy, test.expected, got)
+		}
+	}
+	if got := order(messages); !reflect.DeepEqual(got, tests[0].expected) {
+		ms.T().Fatalf("Scheduling modified the batch. Got %v", got)
+	}
+}
+
+func (ms *MailerSuite) TestSchedulingStrategy() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mw := NewMailWorker()
+	mw.Scheduling = SchedulePriority
+	go func(ctx context.Context) {
+		mw.Start(ctx)
+	}(ctx)
+
+	sender := newMockSender()
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		return sender, nil
+	})
+	var messages []Mail
+	for i, from := range []string{"low@example.com", "high@example.com"} {
+		m := newMockMessage(from, []string{"to@example.com"}, bytes.NewBufferString("Email"))
+		m.setDialer(func() (Dialer, error) { return dialer, nil })
+		messages = append(messages, &scheduledMessage{mockMessage: m, priority: i})
+	}
+	if err := mw.Enqueue(messages); err != nil {
+		ms.T().Fatalf("Unexpected error when enqueueing: %s", err)
+	}
+	for _, expected := range []string{"high@example.com", "low@example.com"} {
+		select {
+		case mm := <-sender.messageChan:
+			if mm.from != expected {
+				ms.T().Fatalf("Unexpected message sent. Expected %s, Got %s", expected, mm.from)
+			}
+		case <-time.After(time.Second):
+			ms.T().Fatalf("Timed out waiting for %s to be sent", expected)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package mailer
+
+import (
+	"context"
+	"net/textproto"
+)
+
+// SendStatus describes how SendOneResult finished with a message.
+type SendStatus struct {
+	Result
+	// Code is the SMTP reply code the server rejected the message with, if
+	// any.
+	Code int
+	// ConnectError is set if the message wasn't sent because we couldn't
+	// connect to the host.
+	ConnectError bool
+}
+
+// resultObserverKey is the context key of the function SendOneResult uses to
+// observe the Result of its message.
+type resultObserverKey struct{}
+
+// SendOneResult synchronously sends a single Mail over a connection of its
+// own, calling its Success, Backoff or Error method as usual, and returns
+// how it went. The returned error is the one which caused a backoff or error
+// outcome, and is nil if the message was sent, even to only some of its
+// recipients. If the context is cancelled before the message is sent, the
+// Mail is left untouched and the context's error is returned.
+//
+// This lets callers sending transactional messages react to the specific
+// failure, for example telling an invalid address apart from a temporarily
+// unavailable server.
+func (p *Processor) SendOneResult(ctx context.Context, m Mail) (SendStatus, error) {
+	var status SendStatus
+	reported := false
+	ctx = context.WithValue(ctx, resultObserverKey{}, func(r Result) {
+		status.Result, reported = r, true
+	})
+	dialer, err := m.GetDialer()
+	if err != nil {
+		p.errorMail(ctx, err, []Mail{m})
+		return status, err
+	}
+	stats := p.ProcessChunk(ctx, dialer, []Mail{m})
+	if !reported {
+		return status, ctx.Err()
+	}
+	status.ConnectError = stats.Err != nil
+	if te, ok := status.Err.(*textproto.Error); ok {
+		status.Code = te.Code
+	}
+	return status, status.Err
+}
+
+// observeResult passes the Result to the observer SendOneResult set in its
+// context, if any, to the stream of the batch if it was enqueued with
+// EnqueueStreaming, and to the summary of the batch if it is being collected.
+func observeResult(m Mail, r Result) {
+	if r.Context == nil {
+		return
+	}
+	if observe, ok := r.Context.Value(resultObserverKey{}).(func(Result)); ok {
+		observe(r)
+	}
+	if sp, ok := r.Context.Value(streamKey{}).(*streamPart); ok {
+		sp.add(m, r)
+	}
+	if bs, ok := r.Context.Value(summaryKey{}).(*batchSummary); ok {
+		bs.add(r)
+	}
+}
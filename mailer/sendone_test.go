@@ -0,0 +1,63 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"net/textproto"
+)
+
+func (ms *MailerSuite) TestSendOneResult() {
+	rejected := &textproto.Error{Code: 550, Msg: "No such user"}
+	tests := []struct {
+		name    string
+		dial    func() (Sender, error)
+		outcome Outcome
+		code    int
+		connect bool
+	}{
+		{
+			name: "success",
+			dial: func() (Sender, error) {
+				sender := newMockSender()
+				sender.setSend(func(*mockMessage) error { return nil })
+				return sender, nil
+			},
+			outcome: OutcomeSuccess,
+		},
+		{
+			name: "rejected",
+			dial: func() (Sender, error) {
+				sender := newMockSender()
+				sender.setSend(func(*mockMessage) error { return rejected })
+				return sender, nil
+			},
+			outcome: OutcomeError,
+			code:    550,
+		},
+		{
+			name: "unreachable",
+			dial: func() (Sender, error) {
+				return nil, errHostUnreachable
+			},
+			outcome: OutcomeError,
+			connect: true,
+		},
+	}
+	for _, test := range tests {
+		dialer := newMockDialer()
+		dialer.setDial(test.dial)
+		m := newMockMessage("from@example.com", []string{"to@example.com"}, bytes.NewBufferString("Email"))
+		m.setDialer(func() (Dialer, error) { return dialer, nil })
+
+		status, err := (&Processor{}).SendOneResult(context.Background(), m)
+		if status.Outcome != test.outcome || status.Code != test.code || status.ConnectError != test.connect {
+			ms.T().Fatalf("Unexpected status for %s. Got %+v", test.name, status)
+		}
+		if (err != nil) != (test.outcome != OutcomeSuccess) || err != status.Err {
+			ms.T().Fatalf("Unexpected error for %s. Got %v", test.name, err)
+		}
+		if !m.finished {
+			ms.T().Fatalf("Message callbacks weren't called for %s", test.name)
+		}
+	}
+}
@@ -0,0 +1,661 @@
+package mailer
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"time"
+)
+
+// DefaultDialTimeout is the timeout used by SMTPDialer when no Timeout is set.
+var DefaultDialTimeout = 10 * time.Second
+
+// PermanentError is returned by a Dialer when connecting failed in a way that
+// retrying won't fix, such as the server rejecting our credentials. dialHost
+// returns a PermanentError immediately instead of reconnecting.
+type PermanentError struct {
+	// Op is the step of the connection which failed, such as "auth".
+	Op  string
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return fmt.Sprintf("smtp %s: %s", e.Op, e.Err)
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// ErrTLSPolicy is wrapped in the *PermanentError returned by SMTPDialer when
+// the server can't satisfy its MinTLSVersion or CipherSuites.
+var ErrTLSPolicy = errors.New("server doesn't satisfy the TLS policy")
+
+// ErrGreetingTimeout is returned by SMTPDialer when the server accepts the
+// connection but doesn't send its greeting within the GreetingTimeout. It is
+// a temporary error, so the worker dials again.
+var ErrGreetingTimeout = errors.New("timed out waiting for the server's greeting")
+
+// isPermanent returns whether the error returned by a Dialer shouldn't be
+// retried, including a *PermanentError wrapped by the Dialer.
+func isPermanent(err error) bool {
+	var pe *PermanentError
+	return errors.As(err, &pe)
+}
+
+// SMTPDialer is a Dialer which connects to an SMTP server using net/smtp.
+// Unlike the gomail dialer, it supports any smtp.Auth implementation, such
+// as CRAM-MD5 (see smtp.CRAMMD5Auth) or XOAUTH2 (see XOAuth2Auth), and can
+// choose between several of them (see AuthMechanisms).
+type SMTPDialer struct {
+	Host string
+	Port int
+	// Auth is used to authenticate if the server supports the AUTH
+	// extension. If nil, no authentication is performed.
+	Auth smtp.Auth
+	// AuthMechanisms, if set, are used in place of Auth, in order of
+	// preference: the first mechanism the server advertises which is
+	// allowed over the connection is used to authenticate. If the server
+	// offers none of them, Dial returns a *PermanentError wrapping
+	// ErrNoAcceptableAuth rather than falling back to a weaker mechanism.
+	AuthMechanisms []SASLMechanism
+	// SSL makes the dialer use implicit TLS rather than STARTTLS.
+	SSL bool
+	// TLSConfig is used for both implicit TLS and STARTTLS. If nil, a config
+	// with ServerName set to Host is used.
+	TLSConfig *tls.Config
+	// ClientCertificate, if set, returns the client certificate presented to
+	// servers requesting one for mutual TLS, in place of those in
+	// TLSConfig. It is called for every handshake, so the certificate can
+	// be renewed without restarting the worker, for example with
+	// ClientCertificateFiles. If the server rejects the certificate, Dial
+	// returns a *PermanentError wrapping ErrClientCertRejected, since
+	// dialing again won't help.
+	ClientCertificate func() (*tls.Certificate, error)
+	// LocalName is the hostname sent with the HELO/EHLO command. Defaults to
+	// "localhost".
+	LocalName string
+	// LocalNameFunc, if set, is called with the local IP address of every
+	// connection and returns the hostname to send with the HELO/EHLO
+	// command in place of LocalName. On hosts sending from several IP
+	// addresses, this lets the name match the PTR record of the address
+	// actually used, which some receivers check. An empty name falls back
+	// to LocalName.
+	LocalNameFunc func(ip net.IP) string
+	// Timeout is the maximum time to wait when connecting. Defaults to
+	// DefaultDialTimeout.
+	Timeout time.Duration
+	// FallbackDelay is the head start given to connecting to the first
+	// address family the Host resolves to, usually IPv6, before racing a
+	// connection to the other family when it has both IPv4 and IPv6
+	// addresses, as described by Happy Eyeballs (RFC 6555). The first
+	// connection to succeed is used, so a broken IPv6 path doesn't hold up
+	// sending until Timeout expires. Defaults to 300ms, and a negative
+	// value disables racing, so addresses are tried one after the other.
+	FallbackDelay time.Duration
+	// ReadTimeout and WriteTimeout, if non-zero, limit how long any single
+	// read from or write to the connection may take once connected, so
+	// that a stalled network fails the send instead of hanging it. The
+	// deadlines are renewed for every read and write rather than covering a
+	// whole message, so sending a large message doesn't time out as long as
+	// the connection keeps making progress.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// GreetingTimeout, if non-zero, is the maximum time to wait for the
+	// server's greeting once connected, including the handshake with
+	// implicit TLS. Unlike ReadTimeout it only applies to the greeting, so
+	// it can be short enough to quickly give up on servers which accept
+	// connections and never answer. Dial returns ErrGreetingTimeout
+	// when it expires.
+	GreetingTimeout time.Duration
+	// Chunking makes the dialer send messages with BDAT commands (RFC 3030)
+	// instead of DATA when the server advertises the CHUNKING extension.
+	Chunking bool
+	// MinTLSVersion and CipherSuites, if set, override those of TLSConfig.
+	// Setting either makes TLS mandatory: if the server doesn't offer
+	// STARTTLS, or the handshake fails because the server doesn't support
+	// the version or any of the cipher suites, Dial returns a
+	// *PermanentError wrapping ErrTLSPolicy rather than sending in the
+	// clear.
+	MinTLSVersion uint16
+	CipherSuites  []uint16
+}
+
+// Dial connects and authenticates to the SMTP server. If the server rejects
+// our credentials, a *PermanentError is returned.
+func (d *SMTPDialer) Dial() (Sender, error) {
+	timeout := d.Timeout
+	if timeout == 0 {
+		timeout = DefaultDialTimeout
+	}
+	var timings SendTimings
+	start := time.Now()
+	nd := &net.Dialer{Timeout: timeout, FallbackDelay: d.FallbackDelay}
+	conn, err := nd.Dial("tcp", d.Address())
+	if err != nil {
+		return nil, err
+	}
+	timings.Connect = time.Since(start)
+	if d.ReadTimeout > 0 || d.WriteTimeout > 0 {
+		conn = &deadlineConn{
+			Conn:         conn,
+			readTimeout:  d.ReadTimeout,
+			writeTimeout: d.WriteTimeout,
+		}
+	}
+	if d.SSL {
+		conn = tls.Client(conn, d.tlsConfig())
+	}
+	// With implicit TLS, the handshake happens when reading the greeting
+	greeted := d.awaitGreeting(conn)
+	start = time.Now()
+	c, err := smtp.NewClient(conn, d.Host)
+	if d.SSL {
+		timings.TLS = time.Since(start)
+	}
+	if !greeted() {
+		conn.Close()
+		return nil, fmt.Errorf("%w after %s", ErrGreetingTimeout, d.GreetingTimeout)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, d.tlsError(err)
+	}
+	if err := c.Hello(d.localName(conn)); err != nil {
+		c.Close()
+		return nil, err
+	}
+	// The server only offers STARTTLS before the connection is upgraded.
+	starttls := false
+	if !d.SSL {
+		ok, _ := c.Extension("STARTTLS")
+		starttls = ok
+		if !ok && d.requireTLS() {
+			c.Close()
+			return nil, &PermanentError{Op: "starttls", Err: fmt.Errorf("%w: STARTTLS isn't supported", ErrTLSPolicy)}
+		}
+		if ok {
+			start = time.Now()
+			if err := c.StartTLS(d.tlsConfig()); err != nil {
+				c.Close()
+				return nil, d.tlsError(err)
+			}
+			timings.TLS = time.Since(start)
+		}
+	}
+	if d.Auth != nil || len(d.AuthMechanisms) > 0 {
+		if ok, mechanisms := c.Extension("AUTH"); ok {
+			auth := d.Auth
+			if len(d.AuthMechanisms) > 0 {
+				_, tls := c.TLSConnectionState()
+				var err error
+				auth, err = d.selectAuth(mechanisms, tls)
+				if err != nil {
+					c.Close()
+					return nil, &PermanentError{Op: "auth", Err: err}
+				}
+			}
+			start = time.Now()
+			err := c.Auth(auth)
+			timings.Auth = time.Since(start)
+			if err != nil {
+				c.Close()
+				// A 5xx reply means the credentials were rejected, so
+				// trying again won't help.
+				if te, ok := err.(*textproto.Error); ok && te.Code >= 500 && te.Code <= 599 {
+					return nil, &PermanentError{Op: "auth", Err: err}
+				}
+				return nil, err
+			}
+		}
+	}
+	advertised, _ := c.Extension("CHUNKING")
+	// The client adds the SMTPUTF8 parameter to MAIL FROM by itself when
+	// the server advertises the extension.
+	smtputf8, _ := c.Extension("SMTPUTF8")
+	return &smtpSender{
+		c:                  c,
+		chunking:           d.Chunking && advertised,
+		chunkingAdvertised: advertised,
+		smtputf8:           smtputf8,
+		extensions:         smtpExtensions(c, starttls),
+		connTimings:        timings,
+	}, nil
+}
+
+// knownExtensions are the service extensions whose advertisement smtpSender
+// reports, since net/smtp only answers for the ones it is asked about.
+var knownExtensions = []string{
+	"8BITMIME", "AUTH", "BINARYMIME", "CHUNKING", "DSN", "ENHANCEDSTATUSCODES",
+	"PIPELINING", "REQUIRETLS", "SIZE", "SMTPUTF8", "STARTTLS",
+}
+
+// smtpExtensions returns the known extensions the server advertised to the
+// client. starttls is whether it offered STARTTLS before the connection was
+// upgraded.
+func smtpExtensions(c *smtp.Client, starttls bool) map[string]string {
+	extensions := make(map[string]string)
+	for _, name := range knownExtensions {
+		if ok, params := c.Extension(name); ok {
+			extensions[name] = params
+		}
+	}
+	if starttls {
+		extensions["STARTTLS"] = ""
+	}
+	return extensions
+}
+
+// localName returns the hostname to send with the HELO/EHLO command over the
+// connection.
+func (d *SMTPDialer) localName(conn net.Conn) string {
+	if d.LocalNameFunc != nil {
+		if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+			if name := d.LocalNameFunc(addr.IP); name != "" {
+				return name
+			}
+		}
+	}
+	if d.LocalName != "" {
+		return d.LocalName
+	}
+	return "localhost"
+}
+
+// awaitGreeting closes the connection if the GreetingTimeout expires before
+// the returned function is called, which reports whether it didn't.
+func (d *SMTPDialer) awaitGreeting(conn net.Conn) func() bool {
+	if d.GreetingTimeout <= 0 {
+		return func() bool { return true }
+	}
+	t := time.AfterFunc(d.GreetingTimeout, func() {
+		conn.Close()
+	})
+	return t.Stop
+}
+
+// Address returns the host:port address of the SMTP server.
+func (d *SMTPDialer) Address() string {
+	return net.JoinHostPort(d.Host, strconv.Itoa(d.Port))
+}
+
+func (d *SMTPDialer) tlsConfig() *tls.Config {
+	config := d.TLSConfig
+	if config == nil {
+		config = &tls.Config{ServerName: d.Host}
+	}
+	if !d.requireTLS() && d.ClientCertificate == nil {
+		return config
+	}
+	config = config.Clone()
+	if d.MinTLSVersion != 0 {
+		config.MinVersion = d.MinTLSVersion
+	}
+	if d.CipherSuites != nil {
+		config.CipherSuites = d.CipherSuites
+	}
+	if d.ClientCertificate != nil {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return d.ClientCertificate()
+		}
+	}
+	return config
+}
+
+// requireTLS returns whether the dialer has a TLS policy to enforce.
+func (d *SMTPDialer) requireTLS() bool {
+	return d.MinTLSVersion != 0 || d.CipherSuites != nil
+}
+
+// tlsError turns an error from the TLS handshake into a *PermanentError if
+// the server rejected our client certificate, or if the dialer has a TLS
+// policy and the handshake failed because the server couldn't agree to it,
+// rather than because of the network.
+func (d *SMTPDialer) tlsError(err error) error {
+	if d.ClientCertificate != nil && isClientCertRejection(err) {
+		return &PermanentError{Op: "tls", Err: fmt.Errorf("%w: %v", ErrClientCertRejected, err)}
+	}
+	if !d.requireTLS() {
+		return err
+	}
+	// The server rejected the STARTTLS command itself
+	if _, ok := err.(*textproto.Error); ok {
+		return err
+	}
+	// Alerts are reported as a "remote error" when sent by the server and
+	// a "local error" when we refuse its choice of version or cipher
+	// suite, which may also be reported without a network error.
+	var oe *net.OpError
+	var ne net.Error
+	switch {
+	case errors.As(err, &oe):
+		if oe.Op != "remote error" && oe.Op != "local error" {
+			return err
+		}
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.As(err, &ne):
+		return err
+	}
+	return &PermanentError{Op: "tls", Err: fmt.Errorf("%w: %v", ErrTLSPolicy, err)}
+}
+
+// deadlineConn is a net.Conn which sets a deadline before every read and
+// write.
+type deadlineConn struct {
+	net.Conn
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	if c.readTimeout > 0 {
+		if err := c.Conn.SetReadDeadline(time.Now().Add(c.readTimeout)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	if c.writeTimeout > 0 {
+		if err := c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Write(b)
+}
+
+// smtpSender is the Sender returned by SMTPDialer.
+type smtpSender struct {
+	c                  *smtp.Client
+	chunking           bool
+	chunkingAdvertised bool
+	smtputf8           bool
+	extensions         map[string]string
+	// response is the server's reply to the last message sent.
+	response string
+	// connTimings holds how long it took to establish the connection
+	// until they are reported with the first message, and timings those
+	// of the last message sent.
+	connTimings SendTimings
+	timings     SendTimings
+}
+
+func (s *smtpSender) Send(from string, to []string, msg io.WriterTo) error {
+	start := s.startTimings()
+	if err := s.c.Mail(from); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := s.c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	s.timings.Envelope = time.Since(start)
+	return s.data(msg)
+}
+
+// startTimings resets the timings for a new message, returning the time it
+// started being sent.
+func (s *smtpSender) startTimings() time.Time {
+	s.timings, s.connTimings = s.connTimings, SendTimings{}
+	return time.Now()
+}
+
+// LastTimings returns how long the phases of sending the last message took.
+func (s *smtpSender) LastTimings() SendTimings {
+	return s.timings
+}
+
+// SendRecipients sends the message to the recipients the server accepts,
+// returning those it rejected.
+func (s *smtpSender) SendRecipients(from string, to []string, msg io.WriterTo) (map[string]error, error) {
+	start := s.startTimings()
+	if err := s.c.Mail(from); err != nil {
+		return nil, err
+	}
+	var rejected map[string]error
+	var err error
+	for _, addr := range to {
+		err = s.c.Rcpt(addr)
+		if err == nil {
+			continue
+		}
+		// Anything but a reply to the RCPT command means the connection
+		// is in trouble, so give up on the message.
+		if _, ok := err.(*textproto.Error); !ok {
+			return nil, err
+		}
+		if rejected == nil {
+			rejected = make(map[string]error)
+		}
+		rejected[addr] = err
+	}
+	if rejected != nil && len(rejected) == len(to) {
+		return nil, err
+	}
+	s.timings.Envelope = time.Since(start)
+	return rejected, s.data(msg)
+}
+
+// data sends the message to the recipients accepted so far, recording the
+// server's reply.
+func (s *smtpSender) data(msg io.WriterTo) error {
+	s.response = ""
+	start := time.Now()
+	var w responseWriter
+	if s.chunking {
+		w = &bdatWriter{text: s.c.Text}
+	} else {
+		dw, err := startData(s.c.Text)
+		if err != nil {
+			return err
+		}
+		w = dw
+	}
+	if _, err := msg.WriteTo(w); err != nil {
+		w.Close()
+		return err
+	}
+	s.timings.Data = time.Since(start)
+	start = time.Now()
+	err := w.Close()
+	s.timings.Response = time.Since(start)
+	if err != nil {
+		return err
+	}
+	s.response = w.Response()
+	return nil
+}
+
+// LastResponse returns the server's reply to the last message sent.
+func (s *smtpSender) LastResponse() string {
+	return s.response
+}
+
+// SMTPUTF8 returns whether the server advertised the SMTPUTF8 extension.
+func (s *smtpSender) SMTPUTF8() bool {
+	return s.smtputf8
+}
+
+func (s *smtpSender) Chunking() (advertised, enabled bool) {
+	return s.chunkingAdvertised, s.chunking
+}
+
+func (s *smtpSender) Extensions() map[string]string {
+	return s.extensions
+}
+
+func (s *smtpSender) Noop() error {
+	return s.c.Noop()
+}
+
+func (s *smtpSender) Reset() error {
+	return s.c.Reset()
+}
+
+func (s *smtpSender) Close() error {
+	return s.c.Quit()
+}
+
+// xoauth2Auth implements the XOAUTH2 mechanism used by providers such as
+// Gmail and Office 365.
+type xoauth2Auth struct {
+	username string
+	token    func() (string, error)
+}
+
+// XOAuth2Auth returns an smtp.Auth implementing the XOAUTH2 mechanism. The
+// token function is called every time a connection is authenticated, so it
+// may refresh the OAuth2 access token as needed.
+func XOAuth2Auth(username string, token func() (string, error)) smtp.Auth {
+	return &xoauth2Auth{username: username, token: token}
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	token, err := a.token()
+	if err != nil {
+		return "", nil, err
+	}
+	resp := "user=" + a.username + "\x01auth=Bearer " + token + "\x01\x01"
+	return "XOAUTH2", []byte(resp), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	// On failure the server sends a challenge containing the error details,
+	// to which we must send an empty response to receive the final error.
+	if more {
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
+
+// responseWriter is implemented by the writers used to send message data,
+// which record the server's reply once closed.
+type responseWriter interface {
+	io.WriteCloser
+	Response() string
+}
+
+// dataWriter sends the message written to it with the DATA command. Unlike
+// the writer returned by smtp.Client.Data it keeps the server's final reply.
+type dataWriter struct {
+	text     *textproto.Conn
+	w        io.WriteCloser
+	response string
+}
+
+// startData issues the DATA command and returns the writer for the message.
+func startData(text *textproto.Conn) (*dataWriter, error) {
+	id, err := text.Cmd("DATA")
+	if err != nil {
+		return nil, err
+	}
+	text.StartResponse(id)
+	defer text.EndResponse(id)
+	if _, _, err := text.ReadResponse(354); err != nil {
+		return nil, err
+	}
+	return &dataWriter{text: text, w: text.DotWriter()}, nil
+}
+
+func (w *dataWriter) Write(p []byte) (int, error) {
+	return w.w.Write(p)
+}
+
+// Close terminates the message and waits for the server to accept it.
+func (w *dataWriter) Close() error {
+	if err := w.w.Close(); err != nil {
+		return err
+	}
+	var err error
+	_, w.response, err = w.text.ReadResponse(250)
+	return err
+}
+
+func (w *dataWriter) Response() string {
+	return w.response
+}
+
+// bdatChunkSize is the size of the chunks sent by bdatWriter.
+const bdatChunkSize = 64 * 1024
+
+// bdatWriter sends the message written to it in BDAT chunks, the last of
+// which is sent when the writer is closed.
+type bdatWriter struct {
+	text *textproto.Conn
+	buf  []byte
+	// err is the first error returned by the server, after which nothing
+	// more is sent.
+	err error
+	// response is the server's reply to the last chunk sent.
+	response string
+}
+
+func (w *bdatWriter) Write(p []byte) (int, error) {
+	if w.buf == nil {
+		w.buf = make([]byte, 0, bdatChunkSize)
+	}
+	n := 0
+	for len(p) > 0 {
+		if w.err != nil {
+			return n, w.err
+		}
+		if len(w.buf) == cap(w.buf) {
+			w.err = w.send(false)
+			continue
+		}
+		c := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+// Close sends the remaining data as the LAST chunk.
+func (w *bdatWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.err = w.send(true)
+	return w.err
+}
+
+// send sends the buffered data in a BDAT command, and waits for the server
+// to accept it.
+func (w *bdatWriter) send(last bool) error {
+	id := w.text.Next()
+	w.text.StartRequest(id)
+	if last {
+		fmt.Fprintf(w.text.W, "BDAT %d LAST\r\n", len(w.buf))
+	} else {
+		fmt.Fprintf(w.text.W, "BDAT %d\r\n", len(w.buf))
+	}
+	w.text.W.Write(w.buf)
+	err := w.text.W.Flush()
+	w.text.EndRequest(id)
+	if err != nil {
+		return err
+	}
+	w.text.StartResponse(id)
+	defer w.text.EndResponse(id)
+	w.buf = w.buf[:0]
+	_, w.response, err = w.text.ReadResponse(250)
+	return err
+}
+
+func (w *bdatWriter) Response() string {
+	return w.response
+}
@@ -0,0 +1,767 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeSMTPServer is a minimal SMTP server used to test SMTPDialer.
+type fakeSMTPServer struct {
+	ln         net.Listener
+	extensions []string
+	// auth is called with the mechanism and the decoded client response. It
+	// returns the reply sent to the client.
+	auth func(mechanism, response string) (int, string)
+	// rcpt, if set, is called with the address of every RCPT command and
+	// returns the reply sent to the client.
+	rcpt func(addr string) (int, string)
+
+	mu       sync.Mutex
+	conns    int
+	messages []string
+	// mails holds the arguments of every MAIL command received, and helo
+	// the argument of the last EHLO command.
+	mails []string
+	helo  string
+	// chunks is the number of BDAT commands received, and noops the number
+	// of NOOP commands.
+	chunks int
+	noops  int
+}
+
+func newFakeSMTPServer() *fakeSMTPServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	s := &fakeSMTPServer{
+		ln:         ln,
+		extensions: []string{"AUTH PLAIN CRAM-MD5 XOAUTH2"},
+		auth: func(string, string) (int, string) {
+			return 235, "Authentication successful"
+		},
+	}
+	go s.serve()
+	return s
+}
+
+func (s *fakeSMTPServer) dialer() *SMTPDialer {
+	addr := s.ln.Addr().(*net.TCPAddr)
+	return &SMTPDialer{Host: "127.0.0.1", Port: addr.Port}
+}
+
+func (s *fakeSMTPServer) connCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns
+}
+
+func (s *fakeSMTPServer) Close() {
+	s.ln.Close()
+}
+
+func (s *fakeSMTPServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns++
+		s.mu.Unlock()
+		go s.handle(textproto.NewConn(conn))
+	}
+}
+
+func (s *fakeSMTPServer) handle(c *textproto.Conn) {
+	defer c.Close()
+	c.PrintfLine("220 fake ESMTP")
+	var bdat []byte
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.Index(line, " "); i != -1 {
+			verb, arg = line[:i], line[i+1:]
+		}
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			s.mu.Lock()
+			s.helo = arg
+			s.mu.Unlock()
+			lines := append([]string{"fake"}, s.extensions...)
+			for i, l := range lines {
+				sep := "-"
+				if i == len(lines)-1 {
+					sep = " "
+				}
+				c.PrintfLine("250%s%s", sep, l)
+			}
+		case "RCPT":
+			addr := strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>")
+			if s.rcpt != nil {
+				code, msg := s.rcpt(addr)
+				c.PrintfLine("%d %s", code, msg)
+				continue
+			}
+			c.PrintfLine("250 OK")
+		case "MAIL":
+			s.mu.Lock()
+			s.mails = append(s.mails, arg)
+			s.mu.Unlock()
+			c.PrintfLine("250 OK")
+		case "NOOP":
+			s.mu.Lock()
+			s.noops++
+			s.mu.Unlock()
+			c.PrintfLine("250 OK")
+		case "HELO", "RSET":
+			c.PrintfLine("250 OK")
+		case "AUTH":
+			s.handleAuth(c, arg)
+		case "DATA":
+			c.PrintfLine("354 Go ahead")
+			data, err := c.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, string(data))
+			s.mu.Unlock()
+			c.PrintfLine("250 OK queued")
+		case "BDAT":
+			var size int
+			var last string
+			fmt.Sscanf(arg, "%d %s", &size, &last)
+			chunk := make([]byte, size)
+			if _, err := io.ReadFull(c.R, chunk); err != nil {
+				return
+			}
+			bdat = append(bdat, chunk...)
+			s.mu.Lock()
+			s.chunks++
+			if last == "LAST" {
+				s.messages = append(s.messages, string(bdat))
+				bdat = nil
+			}
+			s.mu.Unlock()
+			c.PrintfLine("250 OK")
+		case "QUIT":
+			c.PrintfLine("221 Bye")
+			return
+		default:
+			c.PrintfLine("502 Unrecognized command")
+		}
+	}
+}
+
+func (s *fakeSMTPServer) handleAuth(c *textproto.Conn, arg string) {
+	parts := strings.SplitN(arg, " ", 2)
+	mechanism := parts[0]
+	var response string
+	if len(parts) == 2 {
+		response = parts[1]
+	} else {
+		challenge := base64.StdEncoding.EncodeToString([]byte("<1@fake>"))
+		c.PrintfLine("334 %s", challenge)
+		response, _ = c.ReadLine()
+	}
+	decoded, _ := base64.StdEncoding.DecodeString(response)
+	code, msg := s.auth(mechanism, string(decoded))
+	if code >= 500 && mechanism == "XOAUTH2" {
+		// XOAUTH2 servers send the error details as a challenge first
+		c.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(`{"status":"401"}`)))
+		c.ReadLine()
+	}
+	c.PrintfLine("%d %s", code, msg)
+}
+
+func (ms *MailerSuite) TestSMTPDialerXOAuth2() {
+	server := newFakeSMTPServer()
+	defer server.Close()
+	var got string
+	server.auth = func(mechanism, response string) (int, string) {
+		got = mechanism + " " + response
+		return 235, "Authentication successful"
+	}
+
+	tokens := 0
+	d := server.dialer()
+	d.Auth = XOAuth2Auth("user@example.com", func() (string, error) {
+		tokens++
+		return "token", nil
+	})
+	sender, err := d.Dial()
+	if err != nil {
+		ms.T().Fatalf("Unexpected error when dialing: %s", err)
+	}
+	err = sender.Send("from@example.com", []string{"to@example.com"}, bytes.NewBufferString("Subject: test\r\n\r\nbody\r\n"))
+	if err != nil {
+		ms.T().Fatalf("Unexpected error when sending: %s", err)
+	}
+	sender.Close()
+
+	expected := "XOAUTH2 user=user@example.com\x01auth=Bearer token\x01\x01"
+	if got != expected {
+		ms.T().Fatalf("Unexpected XOAUTH2 response. Expected %q, Got %q", expected, got)
+	}
+	if tokens != 1 {
+		ms.T().Fatalf("Unexpected number of token requests. Expected %d, Got %d", 1, tokens)
+	}
+}
+
+func (ms *MailerSuite) TestSMTPDialerCRAMMD5() {
+	server := newFakeSMTPServer()
+	defer server.Close()
+	var got string
+	server.auth = func(mechanism, response string) (int, string) {
+		got = mechanism
+		return 235, "Authentication successful"
+	}
+
+	d := server.dialer()
+	d.Auth = smtp.CRAMMD5Auth("user", "secret")
+	sender, err := d.Dial()
+	if err != nil {
+		ms.T().Fatalf("Unexpected error when dialing: %s", err)
+	}
+	sender.Close()
+	if got != "CRAM-MD5" {
+		ms.T().Fatalf("Unexpected auth mechanism. Expected %s, Got %s", "CRAM-MD5", got)
+	}
+}
+
+func (ms *MailerSuite) TestSMTPDialerAuthFailure() {
+	server := newFakeSMTPServer()
+	defer server.Close()
+	server.auth = func(string, string) (int, string) {
+		return 535, "Invalid credentials"
+	}
+
+	d := server.dialer()
+	d.Auth = XOAuth2Auth("user@example.com", func() (string, error) {
+		return "expired", nil
+	})
+	_, err := dialHost(context.Background(), d, MaxReconnectAttempts)
+	pe, ok := err.(*PermanentError)
+	if !ok {
+		ms.T().Fatalf("Didn't receive expected *PermanentError. Got: %#v", err)
+	}
+	if pe.Op != "auth" {
+		ms.T().Fatalf("Unexpected PermanentError op. Expected %s, Got %s", "auth", pe.Op)
+	}
+	// A rejected credential shouldn't be retried
+	if server.connCount() != 1 {
+		ms.T().Fatalf("Unexpected number of connection attempts. Expected %d, Got %d", 1, server.connCount())
+	}
+}
+
+func (ms *MailerSuite) TestSMTPDialerChunking() {
+	server := newFakeSMTPServer()
+	defer server.Close()
+	server.extensions = append(server.extensions, "CHUNKING")
+
+	d := server.dialer()
+	d.Chunking = true
+	sender, err := d.Dial()
+	if err != nil {
+		ms.T().Fatalf("Unexpected error when dialing: %s", err)
+	}
+	advertised, enabled := sender.(ChunkingSender).Chunking()
+	if !advertised || !enabled {
+		ms.T().Fatalf("Unexpected chunking state. Expected advertised and enabled, Got %t and %t", advertised, enabled)
+	}
+	// Large enough to be sent in several chunks
+	body := "Subject: test\r\n\r\n" + strings.Repeat("x", 2*bdatChunkSize+10)
+	err = sender.Send("from@example.com", []string{"to@example.com"}, bytes.NewBufferString(body))
+	if err != nil {
+		ms.T().Fatalf("Unexpected error when sending: %s", err)
+	}
+	sender.Close()
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.messages) != 1 || server.messages[0] != body {
+		ms.T().Fatalf("Message wasn't received intact")
+	}
+	if server.chunks != 3 {
+		ms.T().Fatalf("Unexpected number of BDAT chunks. Expected %d, Got %d", 3, server.chunks)
+	}
+}
+
+func (ms *MailerSuite) TestSMTPDialerReadTimeout() {
+	// A server which accepts connections but never greets the client
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		ms.T().Fatalf("Unexpected error when listening: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	d := &SMTPDialer{
+		Host:        "127.0.0.1",
+		Port:        ln.Addr().(*net.TCPAddr).Port,
+		ReadTimeout: 50 * time.Millisecond,
+	}
+	_, err = d.Dial()
+	ne, ok := err.(net.Error)
+	if !ok || !ne.Timeout() {
+		ms.T().Fatalf("Didn't receive expected timeout error. Got: %#v", err)
+	}
+}
+
+func (ms *MailerSuite) TestSMTPDialerGreetingTimeout() {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		ms.T().Fatalf("Unexpected error when listening: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	d := &SMTPDialer{
+		Host:            "127.0.0.1",
+		Port:            ln.Addr().(*net.TCPAddr).Port,
+		GreetingTimeout: 50 * time.Millisecond,
+	}
+	start := time.Now()
+	_, err = d.Dial()
+	if !errors.Is(err, ErrGreetingTimeout) || isPermanent(err) {
+		ms.T().Fatalf("Didn't receive expected temporary error. Got: %#v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		ms.T().Fatalf("Dial took %s to time out", elapsed)
+	}
+
+	// The timeout doesn't affect servers which greet us in time
+	server := newFakeSMTPServer()
+	defer server.Close()
+	d = server.dialer()
+	d.GreetingTimeout = time.Second
+	sender, err := d.Dial()
+	if err != nil {
+		ms.T().Fatalf("Unexpected error when dialing: %s", err)
+	}
+	sender.Close()
+}
+
+func (ms *MailerSuite) TestSMTPDialerFallbackDelay() {
+	server := newFakeSMTPServer()
+	defer server.Close()
+
+	// localhost may also resolve to ::1, which nothing listens on, so the
+	// connection has to fall back to 127.0.0.1 whether or not it races.
+	d := server.dialer()
+	d.Host = "localhost"
+	for _, delay := range []time.Duration{-1, 10 * time.Millisecond} {
+		d.FallbackDelay = delay
+		sender, err := d.Dial()
+		if err != nil {
+			ms.T().Fatalf("Unexpected error when dialing with FallbackDelay %s: %s", delay, err)
+		}
+		if err := sender.Close(); err != nil {
+			ms.T().Fatalf("Unexpected error when closing the connection: %s", err)
+		}
+	}
+	if got := server.connCount(); got != 2 {
+		ms.T().Fatalf("Unexpected number of connections. Expected %d, Got %d", 2, got)
+	}
+}
+
+func (ms *MailerSuite) TestSMTPDialerLocalNameFunc() {
+	server := newFakeSMTPServer()
+	defer server.Close()
+
+	names := map[string]string{"127.0.0.1": "mx1.example.com"}
+	d := server.dialer()
+	d.LocalName = "fallback.example.com"
+	for _, tc := range []struct {
+		names    map[string]string
+		expected string
+	}{
+		{names, "mx1.example.com"},
+		{nil, "fallback.example.com"},
+	} {
+		var got net.IP
+		d.LocalNameFunc = func(ip net.IP) string {
+			got = ip
+			return tc.names[ip.String()]
+		}
+		sender, err := d.Dial()
+		if err != nil {
+			ms.T().Fatalf("Unexpected error when dialing: %s", err)
+		}
+		sender.Close()
+		if !got.Equal(net.ParseIP("127.0.0.1")) {
+			ms.T().Fatalf("Unexpected local address. Got %v", got)
+		}
+		server.mu.Lock()
+		helo := server.helo
+		server.mu.Unlock()
+		if helo != tc.expected {
+			ms.T().Fatalf("Unexpected EHLO name. Expected %q, Got %q", tc.expected, helo)
+		}
+	}
+}
+
+func (ms *MailerSuite) TestPartialDelivery() {
+	server := newFakeSMTPServer()
+	defer server.Close()
+	server.rcpt = func(addr string) (int, string) {
+		if addr == "rejected@example.com" {
+			return 550, "No such user"
+		}
+		return 250, "OK"
+	}
+
+	var result Result
+	p := &Processor{
+		OnResult: func(m Mail, r Result) {
+			result = r
+		},
+	}
+	to := []string{"accepted@example.com", "rejected@example.com"}
+	m := newMockMessage("from@example.com", to, bytes.NewBufferString("Email"))
+	stats := p.ProcessChunk(context.Background(), server.dialer(), []Mail{m})
+
+	if stats.Partial != 1 {
+		ms.T().Fatalf("Unexpected stats. Expected a partial delivery, Got %+v", stats)
+	}
+	if !m.finished || m.err != nil {
+		ms.T().Fatalf("Message wasn't marked as sent. Got error: %v", m.err)
+	}
+	if result.Outcome != OutcomePartial {
+		ms.T().Fatalf("Unexpected outcome. Expected %s, Got %s", OutcomePartial, result.Outcome)
+	}
+	if len(result.Accepted) != 1 || result.Accepted[0] != "accepted@example.com" {
+		ms.T().Fatalf("Unexpected accepted recipients. Got %v", result.Accepted)
+	}
+	te, ok := result.Rejected["rejected@example.com"].(*textproto.Error)
+	if len(result.Rejected) != 1 || !ok || te.Code != 550 {
+		ms.T().Fatalf("Unexpected rejected recipients. Got %v", result.Rejected)
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.messages) != 1 {
+		ms.T().Fatalf("Unexpected number of messages received. Expected %d, Got %d", 1, len(server.messages))
+	}
+}
+
+func (ms *MailerSuite) TestSMTPResponse() {
+	server := newFakeSMTPServer()
+	defer server.Close()
+
+	var result Result
+	var record AuditRecord
+	p := &Processor{
+		OnResult: func(m Mail, r Result) {
+			result = r
+		},
+		AuditFunc: func(r AuditRecord) {
+			record = r
+		},
+	}
+	m := newMockMessage("from@example.com", []string{"to@example.com"}, bytes.NewBufferString("Email"))
+	stats := p.ProcessChunk(context.Background(), server.dialer(), []Mail{m})
+	if stats.Sent != 1 {
+		ms.T().Fatalf("Unexpected stats. Expected a successful send, Got %+v", stats)
+	}
+	if result.Response != "OK queued" {
+		ms.T().Fatalf("Unexpected result response. Expected %q, Got %q", "OK queued", result.Response)
+	}
+	if record.Response != "OK queued" {
+		ms.T().Fatalf("Unexpected audit response. Expected %q, Got %q", "OK queued", record.Response)
+	}
+}
+
+func (ms *MailerSuite) TestSMTPUTF8() {
+	server := newFakeSMTPServer()
+	defer server.Close()
+
+	to := []string{"josé@example.com"}
+	m := newMockMessage("from@example.com", to, bytes.NewBufferString("Email"))
+	stats := (&Processor{}).ProcessChunk(context.Background(), server.dialer(), []Mail{m})
+	if stats.Errors != 1 {
+		ms.T().Fatalf("Unexpected stats. Expected a failure, Got %+v", stats)
+	}
+	if !errors.Is(m.err, ErrUnsupportedRecipient) {
+		ms.T().Fatalf("Unexpected error. Expected %v, Got %v", ErrUnsupportedRecipient, m.err)
+	}
+	server.mu.Lock()
+	if len(server.mails) != 0 {
+		ms.T().Fatalf("Unexpected MAIL commands. Expected none, Got %v", server.mails)
+	}
+	server.mu.Unlock()
+
+	server.extensions = append(server.extensions, "SMTPUTF8")
+	m = newMockMessage("from@example.com", to, bytes.NewBufferString("Email"))
+	stats = (&Processor{}).ProcessChunk(context.Background(), server.dialer(), []Mail{m})
+	if stats.Sent != 1 {
+		ms.T().Fatalf("Unexpected stats. Expected a successful send, Got %+v", stats)
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.mails) != 1 || !strings.Contains(server.mails[0], "SMTPUTF8") {
+		ms.T().Fatalf("Unexpected MAIL commands. Expected the SMTPUTF8 parameter, Got %v", server.mails)
+	}
+}
+
+func (ms *MailerSuite) TestSendTimings() {
+	server := newFakeSMTPServer()
+	defer server.Close()
+
+	var results []Result
+	var records []AuditRecord
+	p := &Processor{
+		OnResult: func(m Mail, r Result) {
+			results = append(results, r)
+		},
+		AuditFunc: func(r AuditRecord) {
+			records = append(records, r)
+		},
+	}
+	var messages []Mail
+	for i := 0; i < 2; i++ {
+		messages = append(messages, newMockMessage("from@example.com", []string{"to@example.com"}, bytes.NewBufferString("Email")))
+	}
+	stats := p.ProcessChunk(context.Background(), server.dialer(), messages)
+	if stats.Sent != 2 {
+		ms.T().Fatalf("Unexpected stats. Expected every message to be sent, Got %+v", stats)
+	}
+	for i, r := range results {
+		t := r.Timings
+		if t.Envelope <= 0 || t.Data <= 0 || t.Response <= 0 {
+			ms.T().Fatalf("Missing send timings for message %d. Got %+v", i, t)
+		}
+		// The connection is only accounted for once
+		if (i == 0) != (t.Connect > 0) {
+			ms.T().Fatalf("Unexpected connect timing for message %d. Got %+v", i, t)
+		}
+		if records[i].Timings != t {
+			ms.T().Fatalf("Unexpected audit timings. Expected %+v, Got %+v", t, records[i].Timings)
+		}
+	}
+}
+
+// newCertificate returns a self-signed certificate for 127.0.0.1.
+func newCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// newTLSListener returns a listener serving TLS with a self-signed
+// certificate, limited to the given maximum version.
+func newTLSListener(maxVersion uint16) (net.Listener, error) {
+	cert, err := newCertificate()
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MaxVersion:   maxVersion,
+	}
+	return tls.Listen("tcp", "127.0.0.1:0", config)
+}
+
+func (ms *MailerSuite) TestSMTPDialerTLSPolicy() {
+	// The fake server doesn't offer STARTTLS
+	server := newFakeSMTPServer()
+	defer server.Close()
+	d := server.dialer()
+	d.MinTLSVersion = tls.VersionTLS12
+	_, err := dialHost(context.Background(), d, MaxReconnectAttempts)
+	if _, ok := err.(*PermanentError); !ok || !errors.Is(err, ErrTLSPolicy) {
+		ms.T().Fatalf("Didn't receive expected TLS policy error. Got: %#v", err)
+	}
+	if server.connCount() != 1 {
+		ms.T().Fatalf("Unexpected number of connection attempts. Expected %d, Got %d", 1, server.connCount())
+	}
+
+	// A server which only supports TLS 1.2
+	ln, err := newTLSListener(tls.VersionTLS12)
+	if err != nil {
+		ms.T().Fatalf("Unexpected error when listening: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+			}()
+		}
+	}()
+	d = &SMTPDialer{
+		Host:          "127.0.0.1",
+		Port:          ln.Addr().(*net.TCPAddr).Port,
+		SSL:           true,
+		TLSConfig:     &tls.Config{InsecureSkipVerify: true},
+		MinTLSVersion: tls.VersionTLS13,
+	}
+	_, err = d.Dial()
+	if _, ok := err.(*PermanentError); !ok || !errors.Is(err, ErrTLSPolicy) {
+		ms.T().Fatalf("Didn't receive expected TLS policy error. Got: %#v", err)
+	}
+}
+
+func (ms *MailerSuite) TestSMTPDialerClientCertificate() {
+	serverCert, err := newCertificate()
+	if err != nil {
+		ms.T().Fatalf("Unexpected error when generating a certificate: %s", err)
+	}
+	clientCert, err := newCertificate()
+	if err != nil {
+		ms.T().Fatalf("Unexpected error when generating a certificate: %s", err)
+	}
+	// The server only trusts clientCert
+	cas := x509.NewCertPool()
+	cas.AddCert(clientCert.Leaf)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    cas,
+	})
+	if err != nil {
+		ms.T().Fatalf("Unexpected error when listening: %s", err)
+	}
+	server := &fakeSMTPServer{
+		ln: ln,
+		auth: func(string, string) (int, string) {
+			return 235, "Authentication successful"
+		},
+	}
+	go server.serve()
+	defer server.Close()
+
+	presented := clientCert
+	calls := 0
+	d := &SMTPDialer{
+		Host:      "127.0.0.1",
+		Port:      ln.Addr().(*net.TCPAddr).Port,
+		SSL:       true,
+		TLSConfig: &tls.Config{InsecureSkipVerify: true},
+		ClientCertificate: func() (*tls.Certificate, error) {
+			calls++
+			return &presented, nil
+		},
+	}
+	sender, err := d.Dial()
+	if err != nil {
+		ms.T().Fatalf("Unexpected error when dialing: %s", err)
+	}
+	sender.Close()
+
+	// The certificate is asked for again on every handshake
+	presented = serverCert
+	_, err = dialHost(context.Background(), d, MaxReconnectAttempts)
+	if _, ok := err.(*PermanentError); !ok || !errors.Is(err, ErrClientCertRejected) {
+		ms.T().Fatalf("Didn't receive expected client certificate error. Got: %#v", err)
+	}
+	if calls != 2 {
+		ms.T().Fatalf("Unexpected number of calls to ClientCertificate. Expected %d, Got %d", 2, calls)
+	}
+}
+
+func (ms *MailerSuite) TestClientCertificateFiles() {
+	dir := ms.T().TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	write := func(modTime time.Time) tls.Certificate {
+		cert, err := newCertificate()
+		if err != nil {
+			ms.T().Fatalf("Unexpected error when generating a certificate: %s", err)
+		}
+		key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+		if err != nil {
+			ms.T().Fatalf("Unexpected error when marshalling the key: %s", err)
+		}
+		os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+		os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600)
+		os.Chtimes(certFile, modTime, modTime)
+		os.Chtimes(keyFile, modTime, modTime)
+		return cert
+	}
+	load := ClientCertificateFiles(certFile, keyFile)
+
+	now := time.Now()
+	first := write(now.Add(-time.Hour))
+	cert, err := load()
+	if err != nil {
+		ms.T().Fatalf("Unexpected error when loading the certificate: %s", err)
+	}
+	if !bytes.Equal(cert.Certificate[0], first.Certificate[0]) {
+		ms.T().Fatalf("Unexpected certificate loaded")
+	}
+	if again, _ := load(); again != cert {
+		ms.T().Fatalf("Expected the certificate to be reused while the files are unchanged")
+	}
+
+	second := write(now)
+	cert, err = load()
+	if err != nil {
+		ms.T().Fatalf("Unexpected error when reloading the certificate: %s", err)
+	}
+	if !bytes.Equal(cert.Certificate[0], second.Certificate[0]) {
+		ms.T().Fatalf("Renewed certificate wasn't loaded")
+	}
+}
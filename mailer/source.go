@@ -0,0 +1,93 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+)
+
+// MailSource produces the Mail instances of a batch one at a time, so that
+// batches too large to hold in memory can be read as they are sent, for
+// example from a database cursor.
+type MailSource interface {
+	// Next returns the next Mail instance of the batch. ok is false once the
+	// source is exhausted, and err is set if the source failed.
+	Next() (m Mail, ok bool, err error)
+}
+
+// EnqueueSource sends the Mail instances read from the source, blocking until
+// the source is exhausted and the mail read from it has been processed.
+//
+// The source is read in batches of MaxBatchSize Mail instances, or
+// MailChunkSize if MaxBatchSize isn't set, and the next batch is only read
+// once the worker is done with the previous one, including the parts of it
+// held back by a Warmup. This bounds the memory used by the batch however
+// large the source is.
+//
+// As with EnqueueContext, the values of ctx are made available while the
+// batches are processed. If ctx is cancelled, or the source returns an
+// error, no more mail is read from the source, the Mail instances already
+// read are still sent and the error is returned. ErrShutdown is returned if
+// the worker is shut down first.
+//
+// Every batch is validated like those passed to Enqueue before being
+// enqueued. If one isn't valid, for example because the source returned a
+// nil Mail, none of it is sent and the error is returned, with the index of
+// the batch's first Mail in the source.
+func (mw *MailWorker) EnqueueSource(ctx context.Context, src MailSource) error {
+	size := MailChunkSize
+	if mw.MaxBatchSize > 0 {
+		size = mw.MaxBatchSize
+	}
+	// The worker mustn't report being idle between the batches.
+	mw.enqueuing.add()
+	defer mw.enqueuing.done()
+	for read := 0; ; {
+		ms, more, err := readSource(ctx, src, size)
+		if len(ms) > 0 {
+			if err := mw.validate(ms); err != nil {
+				return fmt.Errorf("batch read from index %d: %w", read, err)
+			}
+			if err := mw.enqueueAndWait(ctx, ms); err != nil {
+				return err
+			}
+			read += len(ms)
+		}
+		if err != nil || !more {
+			return err
+		}
+	}
+}
+
+// readSource reads up to size Mail instances from the source, reporting
+// whether there may be more to read.
+func readSource(ctx context.Context, src MailSource, size int) ([]Mail, bool, error) {
+	ms := make([]Mail, 0, size)
+	for len(ms) < size {
+		if err := ctx.Err(); err != nil {
+			return ms, false, err
+		}
+		m, ok, err := src.Next()
+		if err != nil {
+			return ms, false, err
+		}
+		if !ok {
+			return ms, false, nil
+		}
+		ms = append(ms, m)
+	}
+	return ms, true, nil
+}
+
+// enqueueAndWait enqueues the batch and waits for the worker to be done with
+// every part of it.
+func (mw *MailWorker) enqueueAndWait(ctx context.Context, ms []Mail) error {
+	s := &stream{c: make(chan ChunkResult), parts: 1}
+	ctx = context.WithValue(ctx, streamKey{}, &streamPart{stream: s})
+	err := mw.enqueue(batch{ctx: ctx, mails: ms})
+	s.release()
+	// The results are reported through OnResult, we only need to know the
+	// batch is finished.
+	for range s.c {
+	}
+	return err
+}
@@ -0,0 +1,130 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+// sliceSource is a MailSource reading from a slice, which records whether
+// any Mail was read before the worker was done with the previous batch.
+type sliceSource struct {
+	mails []Mail
+	read  int
+	size  int
+	early bool
+	err   error
+}
+
+func (s *sliceSource) Next() (Mail, bool, error) {
+	if s.read%s.size == 0 {
+		for _, m := range s.mails[:s.read] {
+			if !m.(*mockMessage).finished {
+				s.early = true
+			}
+		}
+	}
+	if s.read == len(s.mails) {
+		return nil, false, s.err
+	}
+	m := s.mails[s.read]
+	s.read++
+	return m, true, nil
+}
+
+func (ms *MailerSuite) TestEnqueueSource() {
+	defer func(size int, delay time.Duration) {
+		MailChunkSize = size
+		MailDelayTime = delay
+	}(MailChunkSize, MailDelayTime)
+	MailChunkSize = 2
+	MailDelayTime = 0
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mw := NewMailWorker()
+	go mw.Start(ctx)
+
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		sender := newMockSender()
+		sender.setSend(func(*mockMessage) error { return nil })
+		return sender, nil
+	})
+	newSource := func(n int, err error) *sliceSource {
+		src := &sliceSource{size: MailChunkSize, err: err}
+		for i := 0; i < n; i++ {
+			m := newMockMessage("from@example.com", []string{"to@example.com"}, bytes.NewBufferString("Email"))
+			m.setDialer(func() (Dialer, error) { return dialer, nil })
+			src.mails = append(src.mails, m)
+		}
+		return src
+	}
+
+	src := newSource(5, nil)
+	if err := mw.EnqueueSource(context.Background(), src); err != nil {
+		ms.T().Fatalf("Unexpected error when enqueueing: %s", err)
+	}
+	if src.early {
+		ms.T().Fatalf("Mail was read before the previous batch was processed")
+	}
+	for i, m := range src.mails {
+		if mm := m.(*mockMessage); !mm.finished || mm.err != nil {
+			ms.T().Fatalf("Message %d wasn't sent", i)
+		}
+	}
+
+	// The mail read before the source failed is still sent
+	errSource := errors.New("cursor closed")
+	src = newSource(3, errSource)
+	if err := mw.EnqueueSource(context.Background(), src); err != errSource {
+		ms.T().Fatalf("Unexpected error. Expected %v, Got %v", errSource, err)
+	}
+	for i, m := range src.mails {
+		if !m.(*mockMessage).finished {
+			ms.T().Fatalf("Message %d wasn't sent", i)
+		}
+	}
+}
+
+func (ms *MailerSuite) TestEnqueueSourceNilMail() {
+	defer func(size int) {
+		MailChunkSize = size
+	}(MailChunkSize)
+	MailChunkSize = 2
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mw := NewMailWorker()
+	go mw.Start(ctx)
+
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		sender := newMockSender()
+		sender.setSend(func(*mockMessage) error { return nil })
+		return sender, nil
+	})
+	src := &sliceSource{size: MailChunkSize}
+	for i := 0; i < 3; i++ {
+		m := newMockMessage("from@example.com", []string{"to@example.com"}, bytes.NewBufferString("Email"))
+		m.setDialer(func() (Dialer, error) { return dialer, nil })
+		src.mails = append(src.mails, m)
+	}
+	src.mails = append(src.mails, nil)
+
+	err := mw.EnqueueSource(context.Background(), src)
+	if !errors.Is(err, ErrNilMail) {
+		ms.T().Fatalf("Didn't receive expected ErrNilMail. Got: %v", err)
+	}
+	if !strings.Contains(err.Error(), "index 2") {
+		ms.T().Fatalf("Error doesn't locate the invalid batch. Got: %s", err)
+	}
+	// The batch before the invalid one is sent, the invalid one isn't
+	for i, m := range src.mails[:3] {
+		if finished := m.(*mockMessage).finished; finished != (i < 2) {
+			ms.T().Fatalf("Unexpected state for message %d. Expected sent to be %t", i, i < 2)
+		}
+	}
+}
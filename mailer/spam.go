@@ -0,0 +1,46 @@
+package mailer
+
+import (
+	"errors"
+	"net/textproto"
+	"strings"
+)
+
+// spamHints are the words DefaultSpamRejection looks for in the server's
+// reply.
+var spamHints = []string{"spam", "junk", "blocked", "blacklist", "blocklist", "reputation"}
+
+// DefaultSpamRejection is used when a Processor has no SpamRejectionFunc. It
+// reports permanent rejections whose text mentions spam, a block list or the
+// sender's reputation, which is how most providers word them.
+func DefaultSpamRejection(err *textproto.Error) bool {
+	if err.Code < 500 || err.Code > 599 {
+		return false
+	}
+	msg := strings.ToLower(err.Msg)
+	for _, hint := range spamHints {
+		if strings.Contains(msg, hint) {
+			return true
+		}
+	}
+	return false
+}
+
+// spamRejected calls the OnSpamRejection hook, if set, if the server
+// rejected the Mail as spam.
+func (p *Processor) spamRejected(m Mail, err error) {
+	if p.OnSpamRejection == nil {
+		return
+	}
+	var te *textproto.Error
+	if !errors.As(err, &te) {
+		return
+	}
+	isSpam := p.SpamRejectionFunc
+	if isSpam == nil {
+		isSpam = DefaultSpamRejection
+	}
+	if isSpam(te) {
+		p.OnSpamRejection(m, te)
+	}
+}
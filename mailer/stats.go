@@ -0,0 +1,170 @@
+package mailer
+
+import (
+	"sync"
+	"time"
+)
+
+// HostDialer is implemented by Dialers which can report the address of the
+// server they connect to. The address is used to group per-host statistics.
+// Dialers which don't implement it are grouped under the empty address.
+type HostDialer interface {
+	Address() string
+}
+
+// dialerAddress returns the address of the server the Dialer connects to, if
+// known.
+func dialerAddress(d Dialer) string {
+	if hd, ok := d.(HostDialer); ok {
+		return hd.Address()
+	}
+	return ""
+}
+
+// HostStats holds the counters accumulated for a single host over the
+// lifetime of a Processor.
+type HostStats struct {
+	// Sent is the number of messages accepted by the host, including those
+	// accepted for only some of their recipients.
+	Sent int
+	// Backoffs is the number of messages rejected with a temporary error.
+	Backoffs int
+	// Errors is the number of messages rejected with a permanent error.
+	Errors int
+	// DialErrors is the number of times we failed to connect to the host.
+	DialErrors int
+	// Connections is the number of connections made to the host,
+	// CompressedConnections how many of those negotiated compression and
+	// ChunkingConnections how many sent messages with BDAT.
+	Connections           int
+	CompressedConnections int
+	ChunkingConnections   int
+	// DuplicateRecipients is the number of envelope recipients removed by
+	// DedupeRecipients.
+	DuplicateRecipients int
+	// SendTime is the total time spent sending messages to the host.
+	SendTime time.Duration
+	// LastError is the most recent error returned by the host, and
+	// LastErrorTime is when it occurred.
+	LastError     error
+	LastErrorTime time.Time
+}
+
+// Attempts returns the number of messages we tried sending to the host.
+func (hs HostStats) Attempts() int {
+	return hs.Sent + hs.Backoffs + hs.Errors
+}
+
+// AverageLatency returns the average time taken to send a message to the host.
+func (hs HostStats) AverageLatency() time.Duration {
+	if hs.Attempts() == 0 {
+		return 0
+	}
+	return hs.SendTime / time.Duration(hs.Attempts())
+}
+
+// hostStats is a concurrency-safe registry of HostStats keyed by address.
+type hostStats struct {
+	mu    sync.Mutex
+	hosts map[string]*HostStats
+}
+
+// get returns the HostStats for the host, creating it if needed. The caller
+// must hold the lock.
+func (h *hostStats) get(host string) *HostStats {
+	if h.hosts == nil {
+		h.hosts = make(map[string]*HostStats)
+	}
+	hs, ok := h.hosts[host]
+	if !ok {
+		hs = &HostStats{}
+		h.hosts[host] = hs
+	}
+	return hs
+}
+
+// recordSend records the outcome of sending a message to the host.
+func (h *hostStats) recordSend(host string, o Outcome, elapsed time.Duration, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hs := h.get(host)
+	hs.SendTime += elapsed
+	switch o {
+	case OutcomeSuccess, OutcomePartial:
+		hs.Sent++
+	case OutcomeBackoff:
+		hs.Backoffs++
+	case OutcomeError:
+		hs.Errors++
+	}
+	if err != nil {
+		hs.LastError = err
+		hs.LastErrorTime = time.Now()
+	}
+}
+
+// recordDuplicates records that n duplicate recipients of a message to the
+// host were removed.
+func (h *hostStats) recordDuplicates(host string, n int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.get(host).DuplicateRecipients += n
+}
+
+// recordConnection records a new connection to the host.
+func (h *hostStats) recordConnection(host string, compressed, chunking bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hs := h.get(host)
+	hs.Connections++
+	if compressed {
+		hs.CompressedConnections++
+	}
+	if chunking {
+		hs.ChunkingConnections++
+	}
+}
+
+// recordDialError records a failure to connect to the host.
+func (h *hostStats) recordDialError(host string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hs := h.get(host)
+	hs.DialErrors++
+	hs.LastError = err
+	hs.LastErrorTime = time.Now()
+}
+
+// snapshot returns a copy of the stats for every host.
+func (h *hostStats) snapshot() map[string]HostStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	snapshot := make(map[string]HostStats, len(h.hosts))
+	for host, hs := range h.hosts {
+		snapshot[host] = *hs
+	}
+	return snapshot
+}
+
+// HostStats returns a copy of the statistics accumulated for the host, as
+// reported by the Dialer's Address method.
+func (p *Processor) HostStats(host string) HostStats {
+	p.hosts.mu.Lock()
+	defer p.hosts.mu.Unlock()
+	if hs, ok := p.hosts.hosts[host]; ok {
+		return *hs
+	}
+	return HostStats{}
+}
+
+// AllHostStats returns a snapshot of the statistics accumulated for every host.
+func (p *Processor) AllHostStats() map[string]HostStats {
+	return p.hosts.snapshot()
+}
+
+// ResetHostStats clears the statistics accumulated for every host.
+func (p *Processor) ResetHostStats() {
+	p.hosts.mu.Lock()
+	defer p.hosts.mu.Unlock()
+	p.hosts.hosts = nil
+}
@@ -0,0 +1,44 @@
+package mailer
+
+import (
+	"io"
+	"os"
+
+	"github.com/gophish/gomail"
+)
+
+// AttachStream attaches a file to the message whose content is read from the
+// reader returned by open when the message is sent, rather than when it is
+// generated.
+//
+// Attachments added with the content already in memory, such as the base64
+// decoded template attachments, are held for as long as the message is in
+// flight, which for large attachments adds up quickly across the messages of
+// concurrent batches. Attachments added with AttachStream only cost the
+// size of the copy buffer: the worker hands the message straight to the
+// Sender, which for SMTPDialer writes it to the connection as it is read.
+//
+// open is called every time the message is written, which may happen more
+// than once, for example when a lost connection is re-dialed or when the
+// message is copied to an ArchiveRecipient. The returned reader is closed
+// once copied.
+func AttachStream(msg *gomail.Message, name string, open func() (io.ReadCloser, error), settings ...gomail.FileSetting) {
+	settings = append(settings, gomail.SetCopyFunc(func(w io.Writer) error {
+		r, err := open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		_, err = io.Copy(w, r)
+		return err
+	}))
+	msg.Attach(name, settings...)
+}
+
+// AttachFile is a helper around AttachStream which streams the attachment
+// from the file at path.
+func AttachFile(msg *gomail.Message, name, path string, settings ...gomail.FileSetting) {
+	AttachStream(msg, name, func() (io.ReadCloser, error) {
+		return os.Open(path)
+	}, settings...)
+}
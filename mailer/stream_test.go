@@ -0,0 +1,38 @@
+package mailer
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+
+	"github.com/gophish/gomail"
+)
+
+func (ms *MailerSuite) TestAttachStream() {
+	opened := 0
+	msg := gomail.NewMessage()
+	msg.SetHeader("From", "from@example.com")
+	msg.SetHeader("To", "to@example.com")
+	msg.SetBody("text/plain", "See attached")
+	AttachStream(msg, "report.txt", func() (io.ReadCloser, error) {
+		opened++
+		return ioutil.NopCloser(bytes.NewBufferString("attachment contents")), nil
+	})
+	if opened != 0 {
+		ms.T().Fatalf("Attachment was read before the message was written")
+	}
+
+	// The attachment should be read again every time the message is written
+	for i := 1; i <= 2; i++ {
+		buff := &bytes.Buffer{}
+		if _, err := msg.WriteTo(buff); err != nil {
+			ms.T().Fatalf("Unexpected error when writing the message: %s", err)
+		}
+		if !bytes.Contains(buff.Bytes(), []byte("report.txt")) {
+			ms.T().Fatalf("Attachment wasn't written. Got %q", buff.Bytes())
+		}
+		if opened != i {
+			ms.T().Fatalf("Unexpected number of reads. Expected %d Got %d", i, opened)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package mailer
+
+import (
+	"context"
+	"sync"
+)
+
+// ChunkResult describes a chunk of a batch enqueued with EnqueueStreaming once
+// it has been processed.
+type ChunkResult struct {
+	// Stats counts the outcomes of Results. Stats.Err is the error which
+	// stopped the chunk from being sent, if any.
+	Stats BatchStats
+	// Results holds the Result of every Mail of the chunk the worker is
+	// finished with, in the order they were reported.
+	Results []MailResult
+}
+
+// MailResult is the Result reported for a Mail instance.
+type MailResult struct {
+	Mail Mail
+	Result
+}
+
+// EnqueueStreaming is like Enqueue, but returns a channel receiving a
+// ChunkResult every time a chunk of the batch has been processed, so that
+// callers can report progress as the batch is sent. Mail the worker is
+// finished with outside of a chunk, for example because it was skipped or its
+// Dialer couldn't be found, is delivered with the next ChunkResult, or in a
+// final one. The channel is closed once every part of the batch has been
+// processed, including parts held back by a Warmup, or once the worker is
+// shut down.
+//
+// The worker blocks until each ChunkResult is received, so callers must keep
+// receiving until the channel is closed. If an error is returned part way
+// through enqueuing the batch, the channel still delivers the results of the
+// parts enqueued until then.
+func (mw *MailWorker) EnqueueStreaming(ms []Mail) (<-chan ChunkResult, error) {
+	s := &stream{c: make(chan ChunkResult), parts: 1}
+	ctx := context.WithValue(context.Background(), streamKey{}, &streamPart{stream: s})
+	err := mw.enqueueBatches(batch{ctx: ctx, mails: ms})
+	// The batch can only be finished once every part is enqueued.
+	s.release()
+	return s.c, err
+}
+
+// streamKey is the context key of the streamPart of a batch enqueued with
+// EnqueueStreaming.
+type streamKey struct{}
+
+// stream delivers the results of a batch enqueued with EnqueueStreaming,
+// which may be split into several batches.
+type stream struct {
+	c     chan ChunkResult
+	mu    sync.Mutex
+	parts int
+}
+
+// release records that one of the parts of the stream is finished, closing
+// the channel once they all are.
+func (s *stream) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.parts--
+	if s.parts == 0 {
+		close(s.c)
+	}
+}
+
+// streamPart collects the results of one of the batches of a stream.
+type streamPart struct {
+	stream  *stream
+	mu      sync.Mutex
+	results []MailResult
+}
+
+// add collects the Result of the Mail.
+func (sp *streamPart) add(m Mail, r Result) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.results = append(sp.results, MailResult{Mail: m, Result: r})
+}
+
+// flush delivers the results collected so far, if there are any or err is
+// set.
+func (sp *streamPart) flush(err error) {
+	sp.mu.Lock()
+	results := sp.results
+	sp.results = nil
+	sp.mu.Unlock()
+	if len(results) == 0 && err == nil {
+		return
+	}
+	cr := ChunkResult{Results: results}
+	for _, r := range results {
+		cr.Stats.add(r.Outcome, 1)
+	}
+	cr.Stats.Err = err
+	sp.stream.c <- cr
+}
+
+// withStreamPart returns a copy of ctx with a new part of the stream ctx
+// belongs to, if any, for a batch about to be enqueued.
+func withStreamPart(ctx context.Context) context.Context {
+	sp, ok := ctx.Value(streamKey{}).(*streamPart)
+	if !ok {
+		return ctx
+	}
+	sp.stream.mu.Lock()
+	sp.stream.parts++
+	sp.stream.mu.Unlock()
+	return context.WithValue(ctx, streamKey{}, &streamPart{stream: sp.stream})
+}
+
+// flushChunk delivers the results of the chunk which was just processed, if
+// its batch was enqueued with EnqueueStreaming.
+func flushChunk(ctx context.Context, err error) {
+	if sp, ok := ctx.Value(streamKey{}).(*streamPart); ok {
+		sp.flush(err)
+	}
+}
+
+// endStreamPart delivers the remaining results of a batch which is finished,
+// if it was enqueued with EnqueueStreaming.
+func endStreamPart(ctx context.Context) {
+	if sp, ok := ctx.Value(streamKey{}).(*streamPart); ok {
+		sp.flush(nil)
+		sp.stream.release()
+	}
+}
@@ -0,0 +1,188 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+// BatchSummary describes how the Mail instances of a batch were processed.
+// It is passed to the worker's OnBatchDone hook, and is meant to be
+// marshalled to JSON and stored as is, so its schema is kept stable.
+type BatchSummary struct {
+	// BatchID is the ID set with WithBatchID on the context the batch was
+	// enqueued with, if any.
+	BatchID string `json:"batch_id,omitempty"`
+	// Host is the address of the host the batch was sent to. It is empty
+	// if the batch was sent to several hosts, or never got a Dialer.
+	Host string `json:"host,omitempty"`
+	// Labels are those of the first Mail of the batch, which usually
+	// identify its campaign.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Start is when the worker started processing the batch, and Duration
+	// how long it took, in nanoseconds once marshalled.
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+	// BatchStats counts the outcomes of the Mail instances the worker is
+	// finished with. Its Err is left unset.
+	BatchStats
+	// Codes counts the SMTP reply codes Mail instances were backed off or
+	// errored out with.
+	Codes map[int]int `json:"codes,omitempty"`
+}
+
+// Merge returns the summary of both batches, so that the summaries of the
+// batches of a campaign can be aggregated. Counts are added up, and the
+// result spans from the earliest Start to the latest end. BatchID and Host
+// are kept if they are the same for both, as are the Labels which are. The
+// zero BatchSummary can be used to start aggregating, since merging into it
+// returns a copy of o.
+func (s BatchSummary) Merge(o BatchSummary) BatchSummary {
+	switch {
+	case s.Start.IsZero():
+		s.BatchID, s.Host = o.BatchID, o.Host
+		s.Labels = commonLabels(o.Labels, o.Labels)
+		s.Start, s.Duration = o.Start, o.Duration
+	case !o.Start.IsZero():
+		end := s.Start.Add(s.Duration)
+		if oEnd := o.Start.Add(o.Duration); oEnd.After(end) {
+			end = oEnd
+		}
+		if o.Start.Before(s.Start) {
+			s.Start = o.Start
+		}
+		s.Duration = end.Sub(s.Start)
+		if s.BatchID != o.BatchID {
+			s.BatchID = ""
+		}
+		if s.Host != o.Host {
+			s.Host = ""
+		}
+		s.Labels = commonLabels(s.Labels, o.Labels)
+	}
+	s.Sent += o.Sent
+	s.Partial += o.Partial
+	s.Backoffs += o.Backoffs
+	s.Errors += o.Errors
+	s.Skipped += o.Skipped
+	s.Codes = mergeCodes(s.Codes, o.Codes)
+	return s
+}
+
+// commonLabels returns a new map of the labels a and b have in common.
+func commonLabels(a, b map[string]string) map[string]string {
+	var labels map[string]string
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			continue
+		}
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels[k] = v
+	}
+	return labels
+}
+
+// mergeCodes returns a new map adding up the counts of a and b.
+func mergeCodes(a, b map[int]int) map[int]int {
+	if len(a) == 0 && len(b) == 0 {
+		return nil
+	}
+	codes := make(map[int]int, len(a)+len(b))
+	for code, n := range a {
+		codes[code] += n
+	}
+	for code, n := range b {
+		codes[code] += n
+	}
+	return codes
+}
+
+// batchIDKey is the context key of the ID set with WithBatchID.
+type batchIDKey struct{}
+
+// WithBatchID returns a copy of ctx carrying the ID of a batch, to be passed
+// to EnqueueContext. The ID is reported in the BatchSummary of the batch.
+func WithBatchID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, batchIDKey{}, id)
+}
+
+// summaryKey is the context key of the batchSummary of a batch being
+// processed by a worker with an OnBatchDone hook.
+type summaryKey struct{}
+
+// batchSummary collects the BatchSummary of a batch as it is processed.
+type batchSummary struct {
+	mu       sync.Mutex
+	summary  BatchSummary
+	hostSeen bool
+}
+
+// withSummary returns a copy of ctx collecting the summary of a batch of the
+// Mail instances, if the worker has an OnBatchDone hook or the batch belongs
+// to a campaign tracked for OnCampaignComplete.
+func (mw *MailWorker) withSummary(ctx context.Context, ms []Mail) context.Context {
+	if _, tracked := mw.campaignOf(ctx); mw.OnBatchDone == nil && !tracked {
+		return ctx
+	}
+	bs := &batchSummary{}
+	bs.summary.Start = time.Now()
+	bs.summary.BatchID, _ = ctx.Value(batchIDKey{}).(string)
+	if len(ms) > 0 {
+		bs.summary.Labels = mailLabels(ms[0])
+	}
+	return context.WithValue(ctx, summaryKey{}, bs)
+}
+
+// batchDone passes the summary collected for the batch to the OnBatchDone
+// hook, and merges it into that of its campaign.
+func (mw *MailWorker) batchDone(ctx context.Context) {
+	bs, ok := ctx.Value(summaryKey{}).(*batchSummary)
+	if !ok {
+		return
+	}
+	bs.mu.Lock()
+	s := bs.summary
+	bs.mu.Unlock()
+	s.Duration = time.Since(s.Start)
+	if mw.OnBatchDone != nil {
+		mw.OnBatchDone(s)
+	}
+	if key, tracked := mw.campaignOf(ctx); tracked {
+		mw.campaignDone(key, s)
+	}
+}
+
+// summarizeHost records that a chunk of the batch is sent to the host, if
+// its summary is being collected.
+func summarizeHost(ctx context.Context, host string) {
+	bs, ok := ctx.Value(summaryKey{}).(*batchSummary)
+	if !ok {
+		return
+	}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	switch {
+	case !bs.hostSeen:
+		bs.summary.Host, bs.hostSeen = host, true
+	case bs.summary.Host != host:
+		bs.summary.Host = ""
+	}
+}
+
+// add counts the Result of a Mail of the batch.
+func (bs *batchSummary) add(r Result) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.summary.add(r.Outcome, 1)
+	var te *textproto.Error
+	if r.Err != nil && errors.As(r.Err, &te) {
+		if bs.summary.Codes == nil {
+			bs.summary.Codes = make(map[int]int)
+		}
+		bs.summary.Codes[te.Code]++
+	}
+}
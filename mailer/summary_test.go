@@ -0,0 +1,179 @@
+package mailer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/textproto"
+	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+func (ms *MailerSuite) TestOnBatchDone() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mw := NewMailWorker()
+	summaries := make(chan BatchSummary, 1)
+	mw.OnBatchDone = func(s BatchSummary) {
+		summaries <- s
+	}
+	go func(ctx context.Context) {
+		mw.Start(ctx)
+	}(ctx)
+
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		sender := newMockSender()
+		sender.setSend(func(mm *mockMessage) error {
+			if mm.from == "first@example.com" {
+				return &textproto.Error{Code: 550, Msg: "Mailbox unavailable"}
+			}
+			return nil
+		})
+		return sender, nil
+	})
+	messages := generateMessages(dialer)
+	err := mw.EnqueueContext(WithBatchID(context.Background(), "batch-1"), messages)
+	if err != nil {
+		ms.T().Fatalf("Unexpected error when enqueueing: %s", err)
+	}
+
+	var s BatchSummary
+	select {
+	case s = <-summaries:
+	case <-time.After(time.Second):
+		ms.T().Fatalf("OnBatchDone wasn't called")
+	}
+	if s.BatchID != "batch-1" || s.Host != dialer.Address() {
+		ms.T().Fatalf("Unexpected batch ID or host. Got %q and %q", s.BatchID, s.Host)
+	}
+	if s.Sent != 1 || s.Errors != 1 || !reflect.DeepEqual(s.Codes, map[int]int{550: 1}) {
+		ms.T().Fatalf("Unexpected summary: %+v", s)
+	}
+	if s.Start.IsZero() || s.Duration <= 0 {
+		ms.T().Fatalf("Unexpected timing. Got %s and %s", s.Start, s.Duration)
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		ms.T().Fatalf("Unexpected error when marshalling: %s", err)
+	}
+	var fields map[string]interface{}
+	json.Unmarshal(data, &fields)
+	for _, key := range []string{"batch_id", "host", "start", "duration", "sent", "errors", "codes"} {
+		if _, ok := fields[key]; !ok {
+			ms.T().Fatalf("Marshalled summary is missing %q: %s", key, data)
+		}
+	}
+}
+
+func (ms *MailerSuite) TestBatchSummaryMerge() {
+	start := time.Now()
+	a := BatchSummary{
+		BatchID:    "batch-1",
+		Host:       "mock.example.com:25",
+		Labels:     map[string]string{"campaign": "1", "part": "a"},
+		Start:      start,
+		Duration:   time.Minute,
+		BatchStats: BatchStats{Sent: 2, Errors: 1},
+		Codes:      map[int]int{550: 1},
+	}
+	b := BatchSummary{
+		BatchID:    "batch-2",
+		Host:       "mock.example.com:25",
+		Labels:     map[string]string{"campaign": "1", "part": "b"},
+		Start:      start.Add(2 * time.Minute),
+		Duration:   time.Minute,
+		BatchStats: BatchStats{Sent: 1, Backoffs: 1, Errors: 1},
+		Codes:      map[int]int{421: 1, 550: 1},
+	}
+
+	merged := BatchSummary{}.Merge(a).Merge(b)
+	expected := BatchSummary{
+		Host:       "mock.example.com:25",
+		Labels:     map[string]string{"campaign": "1"},
+		Start:      start,
+		Duration:   3 * time.Minute,
+		BatchStats: BatchStats{Sent: 3, Backoffs: 1, Errors: 2},
+		Codes:      map[int]int{421: 1, 550: 2},
+	}
+	if !reflect.DeepEqual(merged, expected) {
+		ms.T().Fatalf("Unexpected merged summary. Expected %+v, Got %+v", expected, merged)
+	}
+	// The merged summaries are left untouched
+	if a.Codes[550] != 1 || len(a.Labels) != 2 {
+		ms.T().Fatalf("Merge modified its receiver: %+v", a)
+	}
+}
+
+func (ms *MailerSuite) TestOnCampaignComplete() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mw := NewMailWorker()
+	mw.MaxBatchSize = 1
+	var batches int32
+	mw.OnBatchDone = func(s BatchSummary) {
+		atomic.AddInt32(&batches, 1)
+	}
+	type completion struct {
+		key string
+		s   BatchSummary
+	}
+	completions := make(chan completion, 2)
+	mw.OnCampaignComplete = func(key string, s BatchSummary) {
+		completions <- completion{key, s}
+	}
+	go func(ctx context.Context) {
+		mw.Start(ctx)
+	}(ctx)
+
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		sender := newMockSender()
+		sender.setSend(func(mm *mockMessage) error {
+			if mm.from == "first@example.com" {
+				return &textproto.Error{Code: 550, Msg: "Mailbox unavailable"}
+			}
+			return nil
+		})
+		return sender, nil
+	})
+	newBatch := func() []Mail {
+		messages := generateMessages(dialer)
+		for _, m := range messages {
+			m.(*mockMessage).setDialer(func() (Dialer, error) { return dialer, nil })
+		}
+		return messages
+	}
+	err := mw.EnqueueCampaign(context.Background(), "campaign-1", newBatch(), newBatch())
+	if err != nil {
+		ms.T().Fatalf("Unexpected error when enqueueing: %s", err)
+	}
+
+	var c completion
+	select {
+	case c = <-completions:
+	case <-time.After(time.Second):
+		ms.T().Fatalf("OnCampaignComplete wasn't called")
+	}
+	if n := atomic.LoadInt32(&batches); n != 4 {
+		ms.T().Fatalf("Campaign completed before all of its batches. Got %d of %d batches done", n, 4)
+	}
+	if c.key != "campaign-1" {
+		ms.T().Fatalf("Unexpected campaign key. Expected %q, Got %q", "campaign-1", c.key)
+	}
+	if c.s.Sent != 2 || c.s.Errors != 2 || !reflect.DeepEqual(c.s.Codes, map[int]int{550: 2}) {
+		ms.T().Fatalf("Unexpected campaign summary: %+v", c.s)
+	}
+	select {
+	case c = <-completions:
+		ms.T().Fatalf("OnCampaignComplete called more than once for %q", c.key)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	err = mw.EnqueueCampaign(context.Background(), "campaign-2", []Mail{nil})
+	if !errors.Is(err, ErrNilMail) {
+		ms.T().Fatalf("Unexpected error enqueueing an invalid campaign. Expected %s, Got %v", ErrNilMail, err)
+	}
+}
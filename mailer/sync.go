@@ -0,0 +1,197 @@
+package mailer
+
+import (
+	"context"
+	"reflect"
+	"sync"
+)
+
+// keyedMutex provides mutual exclusion between callers using equal keys. The
+// zero value is ready to use.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[interface{}]*refMutex
+}
+
+// refMutex is a mutex which keeps track of how many callers are using it so
+// it can be removed from the keyedMutex once unused.
+type refMutex struct {
+	sync.Mutex
+	refs int
+}
+
+// lock blocks until no other caller holds the lock for key, returning the
+// function used to release it. Keys which aren't comparable can't be tracked
+// and aren't locked.
+func (k *keyedMutex) lock(key interface{}) func() {
+	if key == nil || !reflect.TypeOf(key).Comparable() {
+		return func() {}
+	}
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = make(map[interface{}]*refMutex)
+	}
+	l, ok := k.locks[key]
+	if !ok {
+		l = &refMutex{}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		k.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
+
+// activity counts the batches being processed and lets callers wait for all
+// of them to finish. The zero value is ready to use.
+type activity struct {
+	mu      sync.Mutex
+	running int
+	idle    []chan struct{}
+}
+
+// add records that a batch started processing.
+func (a *activity) add() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.running++
+}
+
+// done records that a batch finished processing.
+func (a *activity) done() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.running--
+	if a.running == 0 {
+		for _, c := range a.idle {
+			close(c)
+		}
+		a.idle = nil
+	}
+}
+
+// active returns whether any batch is being processed.
+func (a *activity) active() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.running > 0
+}
+
+// wait returns a channel which is closed once no batch is being processed.
+func (a *activity) wait() <-chan struct{} {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	c := make(chan struct{})
+	if a.running == 0 {
+		close(c)
+	} else {
+		a.idle = append(a.idle, c)
+	}
+	return c
+}
+
+// keyedSemaphore limits how many callers using equal keys may proceed at the
+// same time. Keys are forgotten once no caller is using them, so memory is
+// bounded by the keys in use rather than every key ever seen. The zero value
+// is ready to use.
+type keyedSemaphore struct {
+	mu    sync.Mutex
+	slots map[string]*refSemaphore
+}
+
+// refSemaphore is a semaphore which keeps track of how many callers are
+// holding or waiting for it so it can be removed from the keyedSemaphore once
+// unused.
+type refSemaphore struct {
+	slots chan struct{}
+	refs  int
+}
+
+// acquire blocks until fewer than n callers hold a slot for key, returning
+// the function used to release it, or until the context is cancelled.
+func (k *keyedSemaphore) acquire(ctx context.Context, key string, n int) (func(), error) {
+	k.mu.Lock()
+	if k.slots == nil {
+		k.slots = make(map[string]*refSemaphore)
+	}
+	sem, ok := k.slots[key]
+	if !ok {
+		sem = &refSemaphore{slots: make(chan struct{}, n)}
+		k.slots[key] = sem
+	}
+	sem.refs++
+	k.mu.Unlock()
+
+	unref := func() {
+		k.mu.Lock()
+		sem.refs--
+		if sem.refs == 0 {
+			delete(k.slots, key)
+		}
+		k.mu.Unlock()
+	}
+	select {
+	case sem.slots <- struct{}{}:
+		return func() {
+			<-sem.slots
+			unref()
+		}, nil
+	case <-ctx.Done():
+		unref()
+		return nil, ctx.Err()
+	}
+}
+
+// hostRegistry tracks the contexts chunks are being sent to each host with,
+// so that all the work for a host can be cancelled at once. The zero value
+// is ready to use.
+type hostRegistry struct {
+	mu      sync.Mutex
+	next    int
+	cancels map[string]map[int]context.CancelFunc
+}
+
+// register returns a context derived from ctx for sending to host, which is
+// cancelled when cancel is called for the host, and the function to call
+// once done with it.
+func (r *hostRegistry) register(ctx context.Context, host string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cancels == nil {
+		r.cancels = make(map[string]map[int]context.CancelFunc)
+	}
+	if r.cancels[host] == nil {
+		r.cancels[host] = make(map[int]context.CancelFunc)
+	}
+	id := r.next
+	r.next++
+	r.cancels[host][id] = cancel
+	return ctx, func() {
+		cancel()
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.cancels[host], id)
+		if len(r.cancels[host]) == 0 {
+			delete(r.cancels, host)
+		}
+	}
+}
+
+// cancel cancels the contexts registered for host.
+func (r *hostRegistry) cancel(host string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, cancel := range r.cancels[host] {
+		cancel()
+	}
+}
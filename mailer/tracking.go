@@ -0,0 +1,61 @@
+package mailer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+
+	"github.com/gophish/gomail"
+)
+
+// TrackingStore persists the Message-Id of every message sent, so that later
+// bounce or delivery notifications, which refer to the Message-Id, can be
+// correlated with the Mail which was sent.
+type TrackingStore interface {
+	// Record is called with the Message-Id, including the angle brackets,
+	// after the message is accepted by the server and before the Mail's
+	// Success method is called. Errors are logged, but don't change the
+	// outcome of the message since it has already been sent.
+	Record(id string, m Mail) error
+}
+
+// messageID returns the Message-Id header of the message, if set.
+func messageID(message *gomail.Message) string {
+	for _, field := range []string{"Message-Id", "Message-ID"} {
+		if v := message.GetHeader(field); len(v) > 0 {
+			return v[0]
+		}
+	}
+	return ""
+}
+
+// setMessageID makes sure the generated message has a Message-Id, so the ID
+// recorded in the TrackingStore is the one which goes on the wire.
+func (p *Processor) setMessageID(message *gomail.Message) error {
+	if p.Tracking == nil || messageID(message) != "" {
+		return nil
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	domain := "localhost"
+	if from := message.GetHeader("From"); len(from) > 0 {
+		if i := strings.LastIndex(from[0], "@"); i != -1 {
+			domain = strings.TrimRight(from[0][i+1:], ">")
+		}
+	}
+	message.SetHeader("Message-Id", "<"+hex.EncodeToString(b)+"@"+domain+">")
+	return nil
+}
+
+// track records the message's ID in the TrackingStore, if set.
+func (p *Processor) track(message *gomail.Message, m Mail) {
+	if p.Tracking == nil {
+		return
+	}
+	id := messageID(message)
+	if err := p.Tracking.Record(id, m); err != nil {
+		Logger.Printf("Failed to record message %s: %s\n", id, err)
+	}
+}
@@ -0,0 +1,54 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"strings"
+)
+
+// mapTrackingStore is a TrackingStore recording the messages in a map.
+type mapTrackingStore map[string]Mail
+
+func (s mapTrackingStore) Record(id string, m Mail) error {
+	s[id] = m
+	return nil
+}
+
+func (ms *MailerSuite) TestTrackingStore() {
+	sender := newMockSender()
+	sender.setSend(func(*mockMessage) error {
+		return nil
+	})
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		return sender, nil
+	})
+	generated := newMockMessage("from@example.com", []string{"to@example.com"}, bytes.NewBufferString("Email"))
+	provided := &headerMessage{
+		mockMessage: newMockMessage("from@example.com", []string{"to@example.com"}, bytes.NewBufferString("Email")),
+		headers:     map[string][]string{"Message-Id": {"<1234@example.com>"}},
+	}
+
+	store := mapTrackingStore{}
+	p := &Processor{Tracking: store}
+	p.ProcessChunk(context.Background(), dialer, []Mail{generated, provided})
+
+	if len(store) != 2 {
+		ms.T().Fatalf("Unexpected number of recorded messages. Expected %d, Got %d", 2, len(store))
+	}
+	if store["<1234@example.com>"] != provided {
+		ms.T().Fatalf("Provided Message-Id wasn't recorded. Got %v", store)
+	}
+	for id, m := range store {
+		if !strings.HasSuffix(id, "@example.com>") {
+			ms.T().Fatalf("Unexpected generated Message-Id %q", id)
+		}
+		i := 0
+		if m == provided {
+			i = 1
+		}
+		if !strings.Contains(string(sender.messages[i].message), "Message-Id: "+id) {
+			ms.T().Fatalf("Recorded Message-Id %q wasn't sent. Got %q", id, sender.messages[i].message)
+		}
+	}
+}
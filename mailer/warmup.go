@@ -0,0 +1,148 @@
+package mailer
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultWarmupWindow is the window used by a WarmupPolicy with no Window set.
+var DefaultWarmupWindow = 24 * time.Hour
+
+// WarmupPolicy caps the number of messages sent to each host per window,
+// following a schedule which gradually raises the cap. Warming up a new
+// sending IP this way helps its reputation with mailbox providers.
+type WarmupPolicy struct {
+	// Window is the length of each window. Defaults to DefaultWarmupWindow.
+	Window time.Duration
+	// Schedule holds the cap for each successive window, starting from the
+	// first window in which a message was sent to the host. The last cap
+	// applies to every window after that. An empty schedule means no cap.
+	Schedule []int
+	// Store, if set, persists the warmup state of every host so that the
+	// schedule survives restarts.
+	Store WarmupStore
+}
+
+func (wp *WarmupPolicy) window() time.Duration {
+	if wp.Window <= 0 {
+		return DefaultWarmupWindow
+	}
+	return wp.Window
+}
+
+// WarmupState is how far along its warmup schedule a host is.
+type WarmupState struct {
+	// Started is when the first window started.
+	Started time.Time
+	// WindowStarted is when the current window started, and Sent is the
+	// number of messages sent to the host since.
+	WindowStarted time.Time
+	Sent          int
+}
+
+// WarmupStore persists the WarmupState of hosts. LoadWarmup returns false if
+// no state was saved for the host.
+type WarmupStore interface {
+	LoadWarmup(host string) (state WarmupState, ok bool, err error)
+	SaveWarmup(host string, state WarmupState) error
+}
+
+// warmupTracker holds the WarmupState of every host. The zero value is ready
+// to use.
+type warmupTracker struct {
+	mu    sync.Mutex
+	hosts map[string]*WarmupState
+}
+
+// state returns the WarmupState for the host as of now, loading it from the
+// policy's Store if needed and moving it to the current window. The caller
+// must hold the lock.
+func (wt *warmupTracker) state(wp *WarmupPolicy, host string, now time.Time) *WarmupState {
+	if wt.hosts == nil {
+		wt.hosts = make(map[string]*WarmupState)
+	}
+	ws, ok := wt.hosts[host]
+	if !ok {
+		ws = &WarmupState{Started: now, WindowStarted: now}
+		if wp.Store != nil {
+			saved, found, err := wp.Store.LoadWarmup(host)
+			if err != nil {
+				Logger.Printf("Failed to load warmup state for %s: %s\n", host, err)
+			} else if found {
+				*ws = saved
+			}
+		}
+		wt.hosts[host] = ws
+	}
+	window := wp.window()
+	if elapsed := now.Sub(ws.WindowStarted); elapsed >= window {
+		ws.WindowStarted = ws.WindowStarted.Add(elapsed / window * window)
+		ws.Sent = 0
+	}
+	return ws
+}
+
+// take reserves up to n messages of the host's cap for the current window,
+// returning how many were granted and when the next window starts.
+func (wt *warmupTracker) take(wp *WarmupPolicy, host string, n int, now time.Time) (int, time.Time) {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	ws := wt.state(wp, host, now)
+	window := wp.window()
+	next := ws.WindowStarted.Add(window)
+	if len(wp.Schedule) == 0 {
+		return n, next
+	}
+	i := int(ws.WindowStarted.Sub(ws.Started) / window)
+	if i >= len(wp.Schedule) {
+		i = len(wp.Schedule) - 1
+	}
+	granted := wp.Schedule[i] - ws.Sent
+	if granted > n {
+		granted = n
+	}
+	if granted < 0 {
+		granted = 0
+	}
+	ws.Sent += granted
+	if wp.Store != nil {
+		if err := wp.Store.SaveWarmup(host, *ws); err != nil {
+			Logger.Printf("Failed to save warmup state for %s: %s\n", host, err)
+		}
+	}
+	return granted, next
+}
+
+// takeWarmup reserves up to n messages of the host's warmup cap, returning
+// how many may be sent now and when the next window starts. Every message
+// attempted counts against the cap, whatever its outcome.
+func (mw *MailWorker) takeWarmup(host string, n int, now time.Time) (int, time.Time) {
+	if mw.Warmup == nil {
+		return n, time.Time{}
+	}
+	return mw.warmup.take(mw.Warmup, host, n, now)
+}
+
+// deferWarmup holds the Mail instances until the host's next warmup window.
+// If the worker is shut down first, they are left untouched.
+func (mw *MailWorker) deferWarmup(ctx context.Context, host string, ms []Mail, next time.Time) {
+	Logger.Printf("Warmup cap reached for %s, deferring %d mail until %s\n", host, len(ms), next)
+	ctx = mw.holdInFlight(ctx, ms)
+	err := mw.enqueue(batch{ctx: ctx, mails: ms, notBefore: next})
+	if err != nil {
+		Logger.Printf("Failed to defer mail for %s: %s\n", host, err)
+		mw.releaseInFlight(ctx, ms)
+	}
+}
+
+// WarmupStates returns a copy of the warmup state of every host sent to.
+func (mw *MailWorker) WarmupStates() map[string]WarmupState {
+	mw.warmup.mu.Lock()
+	defer mw.warmup.mu.Unlock()
+	states := make(map[string]WarmupState, len(mw.warmup.hosts))
+	for host, ws := range mw.warmup.hosts {
+		states[host] = *ws
+	}
+	return states
+}
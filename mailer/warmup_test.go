@@ -0,0 +1,137 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"time"
+)
+
+// mapWarmupStore is a WarmupStore keeping the states in memory.
+type mapWarmupStore map[string]WarmupState
+
+func (s mapWarmupStore) LoadWarmup(host string) (WarmupState, bool, error) {
+	state, ok := s[host]
+	return state, ok, nil
+}
+
+func (s mapWarmupStore) SaveWarmup(host string, state WarmupState) error {
+	s[host] = state
+	return nil
+}
+
+func (ms *MailerSuite) TestWarmupSchedule() {
+	store := mapWarmupStore{}
+	wp := &WarmupPolicy{
+		Window:   time.Hour,
+		Schedule: []int{2, 5},
+		Store:    store,
+	}
+	host := "mail.example.com:25"
+	start := time.Now()
+	tests := []struct {
+		offset   time.Duration
+		n        int
+		expected int
+	}{
+		{0, 3, 2},
+		{time.Minute, 1, 0},
+		{time.Hour, 10, 5},
+		{time.Hour + time.Minute, 1, 0},
+		// The last cap applies once the schedule is over
+		{5 * time.Hour, 10, 5},
+	}
+	wt := &warmupTracker{}
+	for _, test := range tests {
+		got, _ := wt.take(wp, host, test.n, start.Add(test.offset))
+		if got != test.expected {
+			ms.T().Fatalf("Unexpected number of messages granted after %s. Expected %d, Got %d", test.offset, test.expected, got)
+		}
+	}
+
+	// The state should survive a restart
+	wt = &warmupTracker{}
+	got, next := wt.take(wp, host, 1, start.Add(5*time.Hour+time.Minute))
+	if got != 0 {
+		ms.T().Fatalf("Saved warmup state wasn't loaded. Got %d messages granted", got)
+	}
+	if !next.Equal(start.Add(6 * time.Hour)) {
+		ms.T().Fatalf("Unexpected next window. Expected %s, Got %s", start.Add(6*time.Hour), next)
+	}
+}
+
+func (ms *MailerSuite) TestWarmupDefersBatch() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mw := NewMailWorker()
+	mw.Warmup = &WarmupPolicy{Schedule: []int{1}}
+	go func(ctx context.Context) {
+		mw.Start(ctx)
+	}(ctx)
+
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		sender := newMockSender()
+		sender.setSend(func(mm *mockMessage) error {
+			return nil
+		})
+		return sender, nil
+	})
+	messages := generateMessages(dialer)
+	mw.Queue <- messages
+	if err := mw.FlushAndWait(ctx); err != nil {
+		ms.T().Fatalf("Unexpected error when flushing: %s", err)
+	}
+
+	if !messages[0].(*mockMessage).finished {
+		ms.T().Fatalf("First message wasn't sent")
+	}
+	// The second message waits for the next window
+	if messages[1].(*mockMessage).finished {
+		ms.T().Fatalf("Second message was sent despite the warmup cap")
+	}
+	if sent := mw.WarmupStates()[dialer.Address()].Sent; sent != 1 {
+		ms.T().Fatalf("Unexpected warmup state. Expected %d sent, Got %d", 1, sent)
+	}
+}
+
+func (ms *MailerSuite) TestWarmupProgress() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mw := NewMailWorker()
+	mw.Warmup = &WarmupPolicy{Schedule: []int{2}}
+	mw.ProgressEvery = 3
+	type report struct{ sent, total int }
+	var reports []report
+	mw.OnProgress = func(sent, total int) {
+		reports = append(reports, report{sent, total})
+	}
+	go mw.Start(ctx)
+
+	dialer := newMockDialer()
+	dialer.setDial(func() (Sender, error) {
+		sender := newMockSender()
+		sender.setSend(func(*mockMessage) error { return nil })
+		return sender, nil
+	})
+	var messages []Mail
+	for i := 0; i < 5; i++ {
+		m := newMockMessage("from@example.com", []string{"to@example.com"}, bytes.NewBufferString("Email"))
+		m.setDialer(func() (Dialer, error) { return dialer, nil })
+		messages = append(messages, m)
+	}
+	if err := mw.Enqueue(messages); err != nil {
+		ms.T().Fatalf("Unexpected error when enqueueing: %s", err)
+	}
+	if err := mw.FlushAndWait(ctx); err != nil {
+		ms.T().Fatalf("Unexpected error when flushing: %s", err)
+	}
+
+	// The deferred mail isn't counted towards the batch's total
+	expected := []report{{2, 2}}
+	if !reflect.DeepEqual(reports, expected) {
+		ms.T().Fatalf("Unexpected progress reports. Expected %v, Got %v", expected, reports)
+	}
+}
@@ -172,6 +172,12 @@ func (m *MailLog) Success() error {
 	return nil
 }
 
+// CallbackGroup groups maillogs by campaign so that the mailer never updates
+// the same campaign from concurrent Backoff, Error or Success calls.
+func (m *MailLog) CallbackGroup() interface{} {
+	return m.CampaignId
+}
+
 // GetDialer returns a dialer based on the maillog campaign's SMTP configuration
 func (m *MailLog) GetDialer() (mailer.Dialer, error) {
 	c, err := GetCampaign(m.CampaignId, m.UserId)
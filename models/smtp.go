@@ -3,6 +3,7 @@ package models
 import (
 	"crypto/tls"
 	"errors"
+	"net"
 	"net/mail"
 	"os"
 	"strconv"
@@ -27,6 +28,12 @@ func (d *Dialer) Dial() (mailer.Sender, error) {
 	return d.Dialer.Dial()
 }
 
+// Address returns the host:port address of the SMTP server so the mailer
+// can track statistics per host.
+func (d *Dialer) Address() string {
+	return net.JoinHostPort(d.Host, strconv.Itoa(d.Port))
+}
+
 // SMTP contains the attributes needed to handle the sending of campaign emails
 type SMTP struct {
 	Id               int64     `json:"id" gorm:"column:id; primary_key:yes"`
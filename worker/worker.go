@@ -63,7 +63,10 @@ func (w *Worker) Start() {
 					}
 				}
 				Logger.Printf("Sending %d maillogs to Mailer", len(msc))
-				mailer.Mailer.Queue <- msc
+				err = mailer.Mailer.Enqueue(msc)
+				if err != nil {
+					Logger.Println(err)
+				}
 			}(cid, msc)
 		}
 	}
@@ -83,13 +86,19 @@ func (w *Worker) LaunchCampaign(c models.Campaign) {
 	for _, m := range ms {
 		mailEntries = append(mailEntries, m)
 	}
-	mailer.Mailer.Queue <- mailEntries
+	err = mailer.Mailer.Enqueue(mailEntries)
+	if err != nil {
+		Logger.Println(err)
+	}
 }
 
 // SendTestEmail sends a test email
 func (w *Worker) SendTestEmail(s *models.SendTestEmailRequest) error {
 	go func() {
-		mailer.Mailer.Queue <- []mailer.Mail{s}
+		err := mailer.Mailer.Enqueue([]mailer.Mail{s})
+		if err != nil {
+			s.ErrorChan <- err
+		}
 	}()
 	return <-s.ErrorChan
 }